@@ -72,7 +72,7 @@ func Info() {
 	if err != nil {
 		fmt.Println("Server hasn't responded", err)
 	}
-	fmt.Printf("Server: version=%s, deployments=%d\n", get.Version, get.NumberOfDeployments)
+	fmt.Printf("Server: version=%s, deployments=%d, proxy backend=%s\n", get.Version, get.NumberOfDeployments, get.ProxyBackend)
 }
 
 func GetDeployments() {
@@ -91,9 +91,9 @@ func printDeploymentTable() (int, bool) {
 		return 0, false
 	} else {
 		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
-		fmt.Fprintln(tw, "NAME\tSTATUS\tPID\tRESTARTS\tAGE\tCOMMAND\tPORT")
+		fmt.Fprintln(tw, "NAME\tREADY\tSTATUS\tPID\tRESTARTS\tAGE\tCOMMAND\tPORT")
 		for _, d := range views {
-			fmt.Fprintln(tw, fmt.Sprintf("%s\t%s\t%d\t%d\t%s\t%s\t%s", d.Name, d.Status, d.Pid, d.Restarts, d.Age, d.Command, d.PortInfo))
+			fmt.Fprintln(tw, fmt.Sprintf("%s\t%t\t%s\t%d\t%d\t%s\t%s\t%s", d.Name, d.Ready, d.Status, d.Pid, d.Restarts, d.Age, d.Command, d.PortInfo))
 		}
 		tw.Flush()
 		return len(views), true
@@ -138,11 +138,30 @@ func DescribeDeployment(name string) {
 		fmt.Println(err)
 	} else {
 		buf := bytes.Buffer{}
+		buf.WriteString(fmt.Sprintf("Instance: %s\n", r.Instance))
+		if r.Preview {
+			buf.WriteString(fmt.Sprintf("Preview: %t\n", r.Preview))
+		}
 		buf.WriteString(fmt.Sprintf("PID: %d\n", r.Pid))
 		buf.WriteString(fmt.Sprintf("Restarts: %d\n", r.Restarts))
 		buf.WriteString(fmt.Sprintf("Status: %s\n", r.Status))
+		buf.WriteString(fmt.Sprintf("Ready: %t\n", r.Ready))
 		buf.WriteString(fmt.Sprintf("Age: %s\n", r.Age))
 		buf.WriteString(fmt.Sprintf("Log Path: %s\n", r.LogPath))
+		if t := r.LastTermination; t != nil {
+			buf.WriteString("Last Termination:\n")
+			buf.WriteString(fmt.Sprintf("  Pid: %d\n", t.Pid))
+			buf.WriteString(fmt.Sprintf("  Reason: %s\n", t.Reason))
+			buf.WriteString(fmt.Sprintf("  Exit Code: %d\n", t.ExitCode))
+			if t.Signal != "" {
+				buf.WriteString(fmt.Sprintf("  Signal: %s\n", t.Signal))
+			}
+			buf.WriteString(fmt.Sprintf("  OOM Killed: %t\n", t.OOMKilled))
+			buf.WriteString(fmt.Sprintf("  Finished: %s\n", t.FinishedAt.Format(time.RFC3339)))
+		}
+		if r.Spec.LivenessProbe.Exec.IsSet() || (r.Spec.StartupProbe != nil && r.Spec.StartupProbe.Exec.IsSet()) {
+			buf.WriteString(fmt.Sprintf("Probe Output: %s\n", r.ProbeOutput))
+		}
 		c, err := yaml.Marshal(r.Spec)
 		if err != nil {
 			panic("failed to marshal config" + err.Error())
@@ -152,6 +171,22 @@ func DescribeDeployment(name string) {
 	}
 }
 
+// DescribeInstances prints the processes of all the replicas of the deployment, including the old ones during RollingUpdate.
+func DescribeInstances(name string) {
+	versionsWarning()
+	instances, err := fetch.Get[[]server.DeploymentFullInfo]("/deployments/" + name + "/instances")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "INSTANCE\tREPLICA\tPREVIEW\tREADY\tSTATUS\tPID\tRESTARTS\tAGE\tLOG")
+	for _, d := range instances {
+		fmt.Fprintln(tw, fmt.Sprintf("%s\t%d\t%t\t%t\t%s\t%d\t%d\t%s\t%s", d.Instance, d.Replica, d.Preview, d.Ready, d.Status, d.Pid, d.Restarts, d.Age, d.LogPath))
+	}
+	tw.Flush()
+}
+
 func GetDeployment(name string) (server.DeploymentFullInfo, error) {
 	return fetch.Get[server.DeploymentFullInfo]("/deployments/" + name)
 }
@@ -184,7 +219,11 @@ func Apply(path string) []error {
 				errs = append(errs, err)
 				fmt.Printf("Failure applying %s deployment: %s\n", spec.Name, err)
 			} else {
-				if res.Existed {
+				if res.PreviewPort > 0 {
+					fmt.Printf("Previewing %s deployment on port %d, promote or abort it\n", spec.Name, res.PreviewPort)
+				} else if res.CanaryWeight > 0 {
+					fmt.Printf("Canary of %s deployment takes %d%% of the connections, see rollout status\n", spec.Name, res.CanaryWeight)
+				} else if res.Existed {
 					fmt.Printf("Restarted %s deployment successfully\n", spec.Name)
 				} else {
 					fmt.Printf("Created %s deployment successfully\n", spec.Name)
@@ -222,11 +261,128 @@ func Restart(name string) error {
 	return err
 }
 
+func Scale(name string, replicas int) error {
+	_, err := fetch.Put[fetch.Empty]("/deployments/"+name+"/scale", server.ScaleRequest{Replicas: replicas})
+	if err != nil {
+		fmt.Println(err)
+	} else {
+		fmt.Printf("Successfully scaled '%s' deployment to %d replicas\n", name, replicas)
+	}
+	return err
+}
+
+func RolloutStatus(name string) {
+	ro, err := fetch.Get[server.Rollout]("/deployments/" + name + "/rollout")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	buf := bytes.Buffer{}
+	buf.WriteString(fmt.Sprintf("Status: %s\n", ro.Status))
+	if ro.Revision > 0 {
+		buf.WriteString(fmt.Sprintf("Revision: %d\n", ro.Revision))
+	}
+	if ro.Status == server.RolloutProgressing && ro.Weight > 0 {
+		buf.WriteString(fmt.Sprintf("Canary Weight: %d%%\n", ro.Weight))
+	}
+	buf.WriteString(fmt.Sprintf("Started: %s\n", ro.StartedAt.Format(time.RFC3339)))
+	if !ro.FinishedAt.IsZero() {
+		buf.WriteString(fmt.Sprintf("Finished: %s\n", ro.FinishedAt.Format(time.RFC3339)))
+	}
+	if ro.Message != "" {
+		buf.WriteString(fmt.Sprintf("Message: %s\n", ro.Message))
+	}
+	if ro.Status == server.RolloutFailed {
+		buf.WriteString(fmt.Sprintf("Rolled Back: %t\n", ro.RolledBack))
+	}
+	if f := ro.Failure; f != nil {
+		buf.WriteString("Failed Instance:\n")
+		buf.WriteString(fmt.Sprintf("  Name: %s\n", f.Instance))
+		buf.WriteString(fmt.Sprintf("  PID: %d\n", f.Pid))
+		buf.WriteString(fmt.Sprintf("  Status: %s\n", f.Status))
+		buf.WriteString(fmt.Sprintf("  Restarts: %d\n", f.Restarts))
+		if t := f.LastTermination; t != nil {
+			buf.WriteString(fmt.Sprintf("  Exit Code: %d\n", t.ExitCode))
+			buf.WriteString(fmt.Sprintf("  Reason: %s\n", t.Reason))
+		}
+		if f.ProbeOutput != "" {
+			buf.WriteString(fmt.Sprintf("  Probe Output: %s\n", f.ProbeOutput))
+		}
+		buf.WriteString("  Logs:\n")
+		buf.WriteString(f.Logs)
+	}
+	fmt.Println(buf.String())
+}
+
+func RolloutHistory(name string) {
+	revs, err := fetch.Get[[]server.Revision]("/deployments/" + name + "/rollout/history")
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "REVISION\tAPPLIED\tREPLICAS\tCOMMAND")
+	for _, rev := range revs {
+		fmt.Fprintln(tw, fmt.Sprintf("%d\t%s\t%d\t%s", rev.Number, rev.CreatedAt.Format(time.RFC3339), rev.Spec.Replicas, rev.Spec.Cmd))
+	}
+	tw.Flush()
+}
+
+// RolloutUndo restarts the deployment with the revision, zero for the previous one.
+func RolloutUndo(name string, toRevision int) error {
+	fmt.Println("Rolling back deployment...")
+	res, err := fetch.Post[server.UndoResponse]("/deployments/"+name+"/rollout/undo", server.UndoRequest{ToRevision: toRevision})
+	if err != nil {
+		fmt.Println(err)
+	} else {
+		fmt.Printf("Successfully rolled back '%s' deployment to revision %d\n", name, res.Revision)
+	}
+	return err
+}
+
+func Promote(name string) error {
+	fmt.Println("Promoting deployment...")
+	_, err := fetch.Post[fetch.Empty]("/deployments/"+name+"/promote", nil)
+	if err != nil {
+		fmt.Println(err)
+	} else {
+		fmt.Printf("Successfully promoted '%s' deployment\n", name)
+	}
+	return err
+}
+
+func Abort(name string) error {
+	_, err := fetch.Post[fetch.Empty]("/deployments/"+name+"/abort", nil)
+	if err != nil {
+		fmt.Println(err)
+	} else {
+		fmt.Printf("Successfully aborted the rollout of '%s' deployment\n", name)
+	}
+	return err
+}
+
+func ReconcileProxy() {
+	res, err := fetch.Post[server.ReconcileResponse]("/proxy/reconcile", nil)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if len(res.Changes) == 0 {
+		fmt.Println("Proxy rules are up to date")
+		return
+	}
+	for _, c := range res.Changes {
+		fmt.Println(c)
+	}
+}
+
 func IsServerRunning() bool {
 	return common.IsPortOpen(server.YetisServerPort)
 }
 
-func ShutdownServer(timeout time.Duration) {
+// ShutdownServer stops Yetis server. With keepProcesses, the deployments' processes keep running
+// and the next start of Yetis adopts them.
+func ShutdownServer(timeout time.Duration, keepProcesses bool) {
 	pid, err := unix.GetPidByPort(server.YetisServerPort)
 	if err != nil {
 		fmt.Println("Couldn't get Yetis pid:", err)
@@ -238,9 +394,17 @@ func ShutdownServer(timeout time.Duration) {
 		fmt.Printf("Couldn't find Yetis process %d: %s\n", pid, err)
 	}
 
-	err = process.Signal(syscall.SIGTERM)
-	if err != nil {
-		fmt.Printf("Failed to terminate %d server: %s\n", pid, err)
+	if keepProcesses {
+		_, err = fetch.Post[fetch.Empty]("/shutdown", server.ShutdownRequest{KeepProcesses: true})
+		if err != nil {
+			fmt.Printf("Failed to shutdown %d server: %s\n", pid, err)
+			return
+		}
+	} else {
+		err = process.Signal(syscall.SIGTERM)
+		if err != nil {
+			fmt.Printf("Failed to terminate %d server: %s\n", pid, err)
+		}
 	}
 	after := time.After(timeout)
 loop:
@@ -273,7 +437,11 @@ loop:
 			}
 		}
 	}
-	fmt.Println("Yetis server stopped.")
+	if keepProcesses {
+		fmt.Println("Yetis server stopped, the processes are kept running.")
+	} else {
+		fmt.Println("Yetis server stopped.")
+	}
 }
 
 func versionsWarning() {
@@ -1,15 +1,19 @@
 package common
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"github.com/glossd/fetch"
 	"io"
 	"log"
+	"net"
 	"os"
 	"path/filepath"
+	"regexp"
 	yaml2 "sigs.k8s.io/yaml"
 	yaml "sigs.k8s.io/yaml/goyaml.v2"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -26,6 +30,16 @@ type StrategyType string
 const (
 	RollingUpdate StrategyType = "RollingUpdate"
 	Recreate      StrategyType = "Recreate"
+	BlueGreen     StrategyType = "BlueGreen"
+	Canary        StrategyType = "Canary"
+)
+
+type RestartPolicy string
+
+const (
+	Always    RestartPolicy = "Always"
+	OnFailure RestartPolicy = "OnFailure"
+	Never     RestartPolicy = "Never"
 )
 
 type Spec interface {
@@ -35,15 +49,27 @@ type Spec interface {
 }
 
 type DeploymentSpec struct {
-	Name          string
-	Cmd           string
-	PreCmd        string
-	Workdir       string
-	Logdir        string
-	Strategy      DeploymentStrategy
-	LivenessProbe Probe `yaml:"livenessProbe"`
-	Env           []EnvVar
-	Proxy         Proxy
+	Name     string
+	Cmd      string
+	PreCmd   string
+	Workdir  string
+	Logdir   string
+	Strategy DeploymentStrategy
+	// Decides whether to restart the process once it exits. Defaults to Always.
+	RestartPolicy RestartPolicy `yaml:"restartPolicy"`
+	LivenessProbe Probe         `yaml:"livenessProbe"`
+	// Optional. Decides when the deployment is ready to receive traffic. Defaults to livenessProbe.
+	ReadinessProbe *Probe `yaml:"readinessProbe"`
+	// Optional. Holds off livenessProbe until the deployment has started.
+	StartupProbe *Probe `yaml:"startupProbe"`
+	// Number of processes to run. Each replica gets its own YETIS_PORT. Defaults to 1.
+	Replicas int
+	Env      []EnvVar
+	// Extra ports, each one assigned by Yetis like YETIS_PORT and passed as YETIS_PORT_<NAME>.
+	Ports []Port
+	Proxy Proxies
+	// Optional. Routes the requests of the HTTP proxy of Yetis to the deployment.
+	Route *Route
 }
 
 func (ds DeploymentSpec) Validate() error {
@@ -53,9 +79,103 @@ func (ds DeploymentSpec) Validate() error {
 	if ds.Name == "" {
 		return fmt.Errorf("invalid spec: name is required")
 	}
-	if ds.Strategy.Type != Recreate && ds.Strategy.Type != RollingUpdate {
+	if !deploymentNamePattern.MatchString(ds.Name) {
+		return fmt.Errorf("invalid spec: name '%s' can only contain letters, digits, '.', '_', '@' and '-'", ds.Name)
+	}
+	if ds.Strategy.Type != Recreate && ds.Strategy.Type != RollingUpdate && ds.Strategy.Type != BlueGreen && ds.Strategy.Type != Canary {
 		return fmt.Errorf("invalid strategy type: %s", ds.Strategy.Type)
 	}
+	if ds.Strategy.RollbackOnFailure && ds.Strategy.Type != RollingUpdate {
+		return fmt.Errorf("strategy.rollbackOnFailure requires RollingUpdate strategy")
+	}
+	if ds.Strategy.DrainSeconds < 0 {
+		return fmt.Errorf("strategy.drainSeconds can't be negative")
+	}
+	if ds.Strategy.Type == BlueGreen && ds.Strategy.PreviewPort <= 0 {
+		return fmt.Errorf("strategy.previewPort is required with BlueGreen strategy")
+	}
+	if ds.Strategy.PreviewPort != 0 {
+		if ds.Strategy.Type != BlueGreen {
+			return fmt.Errorf("strategy.previewPort requires BlueGreen strategy")
+		}
+		if slices.Contains(ds.ProxyPorts(), ds.Strategy.PreviewPort) {
+			return fmt.Errorf("strategy.previewPort %d is already a proxy port", ds.Strategy.PreviewPort)
+		}
+	}
+	if ds.Strategy.Canary != nil && ds.Strategy.Type != Canary {
+		return fmt.Errorf("strategy.canary requires Canary strategy")
+	}
+	if ds.Strategy.Type == Canary {
+		if len(ds.ProxyPorts()) == 0 {
+			return fmt.Errorf("proxy.port is required with Canary strategy")
+		}
+		if ds.Route != nil {
+			return fmt.Errorf("route can't be specified with Canary strategy, only proxy.port is weighted")
+		}
+		if err := ds.Strategy.Canary.Validate(); err != nil {
+			return fmt.Errorf("invalid strategy.canary: %s", err)
+		}
+	}
+	if ds.RestartPolicy != Always && ds.RestartPolicy != OnFailure && ds.RestartPolicy != Never {
+		return fmt.Errorf("invalid restartPolicy: %s", ds.RestartPolicy)
+	}
+	if err := ds.LivenessProbe.Validate(); err != nil {
+		return fmt.Errorf("invalid livenessProbe: %s", err)
+	}
+	if ds.ReadinessProbe != nil {
+		if err := ds.ReadinessProbe.Validate(); err != nil {
+			return fmt.Errorf("invalid readinessProbe: %s", err)
+		}
+	}
+	if ds.StartupProbe != nil {
+		if err := ds.StartupProbe.Validate(); err != nil {
+			return fmt.Errorf("invalid startupProbe: %s", err)
+		}
+	}
+	var names []string
+	for _, p := range ds.Ports {
+		if !portNamePattern.MatchString(p.Name) {
+			return fmt.Errorf("invalid port name '%s': must consist of lower case letters, digits and '-'", p.Name)
+		}
+		if slices.Contains(names, p.Name) {
+			return fmt.Errorf("port name '%s' is duplicated", p.Name)
+		}
+		names = append(names, p.Name)
+	}
+	var proxyPorts []int
+	for _, p := range ds.Proxy {
+		if err := p.Validate(); err != nil {
+			return fmt.Errorf("invalid proxy: %s", err)
+		}
+		// the relative paths would be resolved against the directory of Yetis.
+		if p.TLS != nil && ds.Workdir == "" && (!filepath.IsAbs(p.TLS.CertFile) || !filepath.IsAbs(p.TLS.KeyFile)) {
+			return fmt.Errorf("invalid proxy: tls certFile and keyFile must be absolute without workdir")
+		}
+		if p.Port == 0 && len(ds.Proxy) > 1 {
+			return fmt.Errorf("invalid proxy: port is required")
+		}
+		if slices.Contains(proxyPorts, p.Port) {
+			return fmt.Errorf("invalid proxy: port %d is duplicated", p.Port)
+		}
+		proxyPorts = append(proxyPorts, p.Port)
+		if p.TargetPort != "" && !slices.Contains(names, p.TargetPort) {
+			return fmt.Errorf("invalid proxy: targetPort '%s' isn't in ports", p.TargetPort)
+		}
+	}
+	if ds.Route != nil {
+		if err := ds.Route.Validate(); err != nil {
+			return fmt.Errorf("invalid route: %s", err)
+		}
+		if ds.Route.TargetPort != "" && !slices.Contains(names, ds.Route.TargetPort) {
+			return fmt.Errorf("invalid route: targetPort '%s' isn't in ports", ds.Route.TargetPort)
+		}
+	}
+	if ds.Replicas < 0 {
+		return fmt.Errorf("replicas can't be negative")
+	}
+	if ds.Replicas > 1 && (ds.isFixedPort(ds.LivenessProbe.Port()) || ds.isFixedPort(probePort(ds.ReadinessProbe)) || ds.isFixedPort(probePort(ds.StartupProbe))) {
+		return fmt.Errorf("probe port can't be specified with replicas, each replica gets its own $YETIS_PORT")
+	}
 
 	return nil
 }
@@ -65,21 +185,52 @@ func (ds DeploymentSpec) Kind() Kind {
 }
 
 func (ds DeploymentSpec) WithDefaults() Spec {
-	if ds.LivenessProbe.InitialDelaySeconds == 0 {
-		ds.LivenessProbe.InitialDelaySeconds = 10
-	}
-	if ds.LivenessProbe.PeriodSeconds == 0 {
-		ds.LivenessProbe.PeriodSeconds = 10
-	}
-	if ds.LivenessProbe.FailureThreshold == 0 {
-		ds.LivenessProbe.FailureThreshold = 3
+	ds.LivenessProbe = ds.LivenessProbe.WithDefaults()
+	if ds.ReadinessProbe != nil {
+		p := ds.ReadinessProbe.WithDefaults()
+		ds.ReadinessProbe = &p
 	}
-	if ds.LivenessProbe.SuccessThreshold == 0 {
-		ds.LivenessProbe.SuccessThreshold = 1
+	if ds.StartupProbe != nil {
+		p := ds.StartupProbe.WithDefaults()
+		ds.StartupProbe = &p
 	}
 	if ds.Strategy.Type == "" {
 		ds.Strategy.Type = Recreate
 	}
+	if ds.Strategy.Type == Canary {
+		// the spec is copied by value, the canary must not be shared.
+		c := CanaryStrategy{}
+		if ds.Strategy.Canary != nil {
+			c = *ds.Strategy.Canary
+		}
+		c = c.WithDefaults()
+		ds.Strategy.Canary = &c
+	}
+	if ds.RestartPolicy == "" {
+		ds.RestartPolicy = Always
+	}
+	if ds.Replicas == 0 {
+		ds.Replicas = 1
+	}
+	// the spec is copied by value, the proxies must not be shared.
+	ds.Proxy = slices.Clone(ds.Proxy)
+	for i, p := range ds.Proxy {
+		if p.Port > 0 && p.Protocol == "" {
+			ds.Proxy[i].Protocol = TCPProtocol
+		}
+		if p.TLS != nil && ds.Workdir != "" {
+			ds.Proxy[i].TLS = &TLS{CertFile: inDir(ds.Workdir, p.TLS.CertFile), KeyFile: inDir(ds.Workdir, p.TLS.KeyFile)}
+		}
+	}
+	if ds.Route != nil && ds.Route.Path == "" {
+		r := *ds.Route
+		r.Path = "/"
+		ds.Route = &r
+	}
+	// There's no connection to open to a UDP port, the process is checked by the port it binds.
+	if len(ds.Proxy) > 0 && ds.Proxy[0].Protocol == UDPProtocol && !ds.LivenessProbe.IsSet() && ds.LivenessProbe.Port() == 0 {
+		ds.LivenessProbe.UdpSocket = &UdpSocket{}
+	}
 	return ds
 }
 
@@ -91,6 +242,77 @@ func (ds DeploymentSpec) YetisPort() int {
 	return port
 }
 
+// NamedPort returns the port assigned to the name from ports, the empty name is $YETIS_PORT.
+func (ds DeploymentSpec) NamedPort(name string) int {
+	if name == "" {
+		return ds.YetisPort()
+	}
+	port, err := strconv.Atoi(ds.GetEnv(PortEnv(name)))
+	if err != nil {
+		return 0
+	}
+	return port
+}
+
+// IsYetisPort returns true if the port is $YETIS_PORT or one of the named ports.
+func (ds DeploymentSpec) IsYetisPort(port int) bool {
+	if port == ds.YetisPort() {
+		return true
+	}
+	for _, p := range ds.Ports {
+		if port == ds.NamedPort(p.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// ProxyPorts returns the ports the proxies forward from.
+func (ds DeploymentSpec) ProxyPorts() []int {
+	var ports []int
+	for _, p := range ds.Proxy {
+		if p.Port > 0 {
+			ports = append(ports, p.Port)
+		}
+	}
+	return ports
+}
+
+// ProxyOf returns the proxy forwarding from the port.
+func (ds DeploymentSpec) ProxyOf(port int) (Proxy, bool) {
+	for _, p := range ds.Proxy {
+		if p.Port == port {
+			return p, true
+		}
+	}
+	return Proxy{}, false
+}
+
+// PreviewProxy returns the proxy of strategy.previewPort. It forwards like the first proxy or to the target of the route.
+func (ds DeploymentSpec) PreviewProxy() Proxy {
+	if len(ds.Proxy) > 0 {
+		p := ds.Proxy[0]
+		p.Port = ds.Strategy.PreviewPort
+		return p
+	}
+	p := Proxy{Port: ds.Strategy.PreviewPort, Protocol: TCPProtocol}
+	if ds.Route != nil {
+		p.TargetPort = ds.Route.TargetPort
+	}
+	return p
+}
+
+// DefaultProbePort returns the port the probes check if they don't specify one: the target of the first proxy, of the route or $YETIS_PORT.
+func (ds DeploymentSpec) DefaultProbePort() int {
+	if len(ds.Proxy) > 0 {
+		return ds.NamedPort(ds.Proxy[0].TargetPort)
+	}
+	if ds.Route != nil {
+		return ds.NamedPort(ds.Route.TargetPort)
+	}
+	return ds.YetisPort()
+}
+
 func (ds DeploymentSpec) GetEnv(name string) string {
 	for _, envVar := range ds.Env {
 		if envVar.Name == name {
@@ -101,21 +323,177 @@ func (ds DeploymentSpec) GetEnv(name string) string {
 }
 
 type Probe struct {
-	TcpSocket           TcpSocket `yaml:"tcpSocket"`
-	InitialDelaySeconds float64   `yaml:"initialDelaySeconds"`
-	PeriodSeconds       float64   `yaml:"periodSeconds"`
-	FailureThreshold    int       `yaml:"failureThreshold"`
-	SuccessThreshold    int       `yaml:"successThreshold"`
+	TcpSocket           TcpSocket  `yaml:"tcpSocket"`
+	UdpSocket           *UdpSocket `yaml:"udpSocket"`
+	HttpGet             HttpGet    `yaml:"httpGet"`
+	Exec                Exec       `yaml:"exec"`
+	InitialDelaySeconds float64    `yaml:"initialDelaySeconds"`
+	PeriodSeconds       float64    `yaml:"periodSeconds"`
+	FailureThreshold    int        `yaml:"failureThreshold"`
+	SuccessThreshold    int        `yaml:"successThreshold"`
 }
 
 type TcpSocket struct {
+	Host string // e.g. ::1. Defaults to the loopback of IPv4, then of IPv6.
 	Port int
 }
 
+// UdpSocket probe succeeds if the port is bound. Without the port it defaults to $YETIS_PORT.
+type UdpSocket struct {
+	Port int
+}
+
+// HttpGet probe succeeds if the response status is within [MinStatus, MaxStatus].
+type HttpGet struct {
+	Path        string
+	Host        string // e.g. ::1. Defaults to the loopback of IPv4, then of IPv6.
+	Port        int
+	Scheme      string       // HTTP or HTTPS. Defaults to HTTP.
+	HttpHeaders []HttpHeader `yaml:"httpHeaders"`
+	MinStatus   int          `yaml:"minStatus"` // Defaults to 200
+	MaxStatus   int          `yaml:"maxStatus"` // Defaults to 399
+}
+
+type HttpHeader struct {
+	Name  string
+	Value string
+}
+
+func (h HttpGet) IsSet() bool {
+	return h.Path != ""
+}
+
+// Exec probe runs the command in the deployment's workdir with its env. Exit code 0 means healthy.
+type Exec struct {
+	Command        string
+	TimeoutSeconds float64 `yaml:"timeoutSeconds"` // Defaults to 1
+}
+
+func (e Exec) IsSet() bool {
+	return e.Command != ""
+}
+
+func (e Exec) TimeoutDuration() time.Duration {
+	return time.Millisecond * time.Duration(e.TimeoutSeconds*1000)
+}
+
+func (p Probe) WithDefaults() Probe {
+	if p.InitialDelaySeconds == 0 {
+		p.InitialDelaySeconds = 10
+	}
+	if p.PeriodSeconds == 0 {
+		p.PeriodSeconds = 10
+	}
+	if p.FailureThreshold == 0 {
+		p.FailureThreshold = 3
+	}
+	if p.SuccessThreshold == 0 {
+		p.SuccessThreshold = 1
+	}
+	if p.HttpGet.IsSet() {
+		if p.HttpGet.Scheme == "" {
+			p.HttpGet.Scheme = "HTTP"
+		}
+		if p.HttpGet.MinStatus == 0 {
+			p.HttpGet.MinStatus = 200
+		}
+		if p.HttpGet.MaxStatus == 0 {
+			p.HttpGet.MaxStatus = 399
+		}
+	}
+	if p.Exec.IsSet() && p.Exec.TimeoutSeconds == 0 {
+		p.Exec.TimeoutSeconds = 1
+	}
+	return p
+}
+
+func (p Probe) Validate() error {
+	var types int
+	if p.TcpSocket.Port > 0 {
+		types++
+	}
+	if p.UdpSocket != nil {
+		types++
+	}
+	if p.HttpGet.IsSet() {
+		types++
+	}
+	if p.Exec.IsSet() {
+		types++
+	}
+	if types > 1 {
+		return fmt.Errorf("only one of tcpSocket, udpSocket, httpGet or exec can be specified")
+	}
+	if p.Exec.TimeoutSeconds < 0 {
+		return fmt.Errorf("exec.timeoutSeconds can't be negative")
+	}
+	if p.HttpGet.IsSet() {
+		if !strings.HasPrefix(p.HttpGet.Path, "/") {
+			return fmt.Errorf("httpGet.path must start with '/'")
+		}
+		if s := strings.ToUpper(p.HttpGet.Scheme); s != "" && s != "HTTP" && s != "HTTPS" {
+			return fmt.Errorf("httpGet.scheme must be HTTP or HTTPS, got %s", p.HttpGet.Scheme)
+		}
+		if p.HttpGet.MinStatus > p.HttpGet.MaxStatus && p.HttpGet.MaxStatus != 0 {
+			return fmt.Errorf("httpGet.minStatus can't be greater than httpGet.maxStatus")
+		}
+	}
+	return nil
+}
+
+// IsSet returns false if the probe doesn't check anything.
+func (p Probe) IsSet() bool {
+	return p.TcpSocket.Port > 0 || p.UdpSocket != nil && p.UdpSocket.Port > 0 || p.HttpGet.IsSet() || p.Exec.IsSet()
+}
+
+// Port returns the port the probe checks.
 func (p Probe) Port() int {
+	if p.HttpGet.IsSet() {
+		return p.HttpGet.Port
+	}
+	if p.UdpSocket != nil {
+		return p.UdpSocket.Port
+	}
 	return p.TcpSocket.Port
 }
 
+// Host returns the host the probe checks, empty means both loopbacks.
+func (p Probe) Host() string {
+	if p.HttpGet.IsSet() {
+		return p.HttpGet.Host
+	}
+	return p.TcpSocket.Host
+}
+
+// isFixedPort returns true if the port is specified by the user, not assigned by Yetis.
+func (ds DeploymentSpec) isFixedPort(port int) bool {
+	return port > 0 && !ds.IsYetisPort(port)
+}
+
+func probePort(p *Probe) int {
+	if p == nil {
+		return 0
+	}
+	return p.Port()
+}
+
+// WithPort returns a copy of the probe checking the given port.
+// Exec probe doesn't check any port and stays the same.
+func (p Probe) WithPort(port int) Probe {
+	if p.Exec.IsSet() {
+		return p
+	}
+	switch {
+	case p.HttpGet.IsSet():
+		p.HttpGet.Port = port
+	case p.UdpSocket != nil:
+		p.UdpSocket = &UdpSocket{Port: port}
+	default:
+		p.TcpSocket.Port = port
+	}
+	return p
+}
+
 func (p Probe) InitialDelayDuration() time.Duration {
 	return time.Millisecond * time.Duration(p.InitialDelaySeconds*1000)
 }
@@ -130,10 +508,204 @@ type EnvVar struct {
 }
 type DeploymentStrategy struct {
 	Type StrategyType
+	// How long the replica taken out of the proxy keeps serving its established connections before the termination.
+	// Zero terminates it right away.
+	DrainSeconds float64 `yaml:"drainSeconds"`
+	// RollingUpdate only. Terminates the new instance if it isn't healthy and rolls the replaced replicas back to the previous spec.
+	RollbackOnFailure bool `yaml:"rollbackOnFailure"`
+	// BlueGreen only. Forwards to the new instances until they're promoted, while proxy.port stays on the old ones.
+	PreviewPort int `yaml:"previewPort"`
+	// Canary only. How the new instances take over proxy.port.
+	Canary *CanaryStrategy
+}
+
+// CanaryStrategy forwards a share of the connections of proxy.port to the new instances and raises it step by step
+// while they stay healthy. The old instances are deleted once the share reaches 100.
+type CanaryStrategy struct {
+	// The percentage of the connections the new instances get at first. Defaults to 10.
+	Weight int
+	// Added to the weight every stepSeconds. Defaults to 10.
+	StepWeight int `yaml:"stepWeight"`
+	// Defaults to 60.
+	StepSeconds float64 `yaml:"stepSeconds"`
+	// The percentage of the failed probes of the new instances during a step which aborts the canary.
+	// Defaults to zero, any failed probe aborts it.
+	MaxFailureRate float64 `yaml:"maxFailureRate"`
+}
+
+func (c CanaryStrategy) WithDefaults() CanaryStrategy {
+	if c.Weight == 0 {
+		c.Weight = 10
+	}
+	if c.StepWeight == 0 {
+		c.StepWeight = 10
+	}
+	if c.StepSeconds == 0 {
+		c.StepSeconds = 60
+	}
+	return c
+}
+
+func (c *CanaryStrategy) Validate() error {
+	if c == nil {
+		return nil
+	}
+	if c.Weight < 0 || c.Weight > 100 {
+		return fmt.Errorf("weight must be between 0 and 100")
+	}
+	if c.StepWeight < 0 {
+		return fmt.Errorf("stepWeight can't be negative")
+	}
+	if c.StepDuration() <= 0 {
+		return fmt.Errorf("stepSeconds must be at least 1ms")
+	}
+	if c.MaxFailureRate < 0 || c.MaxFailureRate > 100 {
+		return fmt.Errorf("maxFailureRate must be between 0 and 100")
+	}
+	return nil
+}
+
+func (c CanaryStrategy) StepDuration() time.Duration {
+	return time.Millisecond * time.Duration(c.StepSeconds*1000)
+}
+
+func (s DeploymentStrategy) DrainDuration() time.Duration {
+	return time.Millisecond * time.Duration(s.DrainSeconds*1000)
+}
+
+type ProxyProtocol string
+
+const (
+	TCPProtocol ProxyProtocol = "tcp"
+	UDPProtocol ProxyProtocol = "udp"
+	// BothProtocols forwards TCP and UDP of the same port.
+	BothProtocols ProxyProtocol = "both"
+)
+
+// Port is assigned by Yetis on every start of the process.
+type Port struct {
+	Name string // e.g. admin is passed as YETIS_PORT_ADMIN
+}
+
+// The name tags the proxy rules, e.g. it's quoted in the comment of the nft rule.
+var deploymentNamePattern = regexp.MustCompile(`^[A-Za-z0-9._@-]+$`)
+
+var portNamePattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+// PortEnv returns the env var of the named port, e.g. grpc-web is YETIS_PORT_GRPC_WEB.
+func PortEnv(name string) string {
+	return "YETIS_PORT_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
 }
 
 type Proxy struct {
 	Port int
+	// The name of the port from ports to forward to. Defaults to $YETIS_PORT.
+	TargetPort string `yaml:"targetPort"`
+	// Defaults to tcp.
+	Protocol ProxyProtocol
+	// Expose forwards the connections coming from the network too, not only the ones from the host.
+	Expose *Expose
+	// TLS terminates TLS on the port and forwards the plaintext. Forwarded by the userspace proxy whatever the backend is.
+	TLS *TLS `yaml:"tls"`
+}
+
+// TLS certificate and key in PEM. They are reloaded when the files change. Relative paths are within workdir.
+type TLS struct {
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+}
+
+// Expose optionally limits the forwarded connections from the network.
+type Expose struct {
+	Interface string // e.g. eth0
+	Source    string // CIDR e.g. 10.0.0.0/8
+}
+
+// UnmarshalJSON allows 'expose: true' for the connections from any interface and source.
+func (e *Expose) UnmarshalJSON(data []byte) error {
+	switch string(data) {
+	case "true":
+		*e = Expose{}
+		return nil
+	case "false":
+		return fmt.Errorf("expose can be true or an object, remove it to forward only the connections from the host")
+	}
+	type plain Expose
+	return json.Unmarshal(data, (*plain)(e))
+}
+
+// Proxies is the list of the ports forwarded to the deployment.
+type Proxies []Proxy
+
+// UnmarshalJSON allows a single proxy object, the way it was configured before the list.
+func (p *Proxies) UnmarshalJSON(data []byte) error {
+	if !strings.HasPrefix(strings.TrimSpace(string(data)), "{") {
+		return json.Unmarshal(data, (*[]Proxy)(p))
+	}
+	var single Proxy
+	err := json.Unmarshal(data, &single)
+	if err != nil {
+		return err
+	}
+	*p = nil
+	if single.Port > 0 || single.Expose != nil || single.Protocol != "" || single.TargetPort != "" {
+		*p = Proxies{single}
+	}
+	return nil
+}
+
+func (p Proxy) Validate() error {
+	if p.Protocol != "" && p.Protocol != TCPProtocol && p.Protocol != UDPProtocol && p.Protocol != BothProtocols {
+		return fmt.Errorf("protocol must be tcp, udp or both, got %s", p.Protocol)
+	}
+	if p.TLS != nil {
+		if p.TLS.CertFile == "" || p.TLS.KeyFile == "" {
+			return fmt.Errorf("tls requires certFile and keyFile")
+		}
+		if p.Protocol != "" && p.Protocol != TCPProtocol {
+			return fmt.Errorf("tls requires tcp protocol")
+		}
+		if p.Port == 0 {
+			return fmt.Errorf("tls requires the port")
+		}
+	}
+	if p.Expose == nil {
+		return nil
+	}
+	if p.Port == 0 {
+		return fmt.Errorf("expose requires the port")
+	}
+	if p.Expose.Source != "" {
+		if _, _, err := net.ParseCIDR(p.Expose.Source); err != nil {
+			return fmt.Errorf("source must be a CIDR e.g. 10.0.0.0/8: %s", err)
+		}
+	}
+	return nil
+}
+
+func inDir(dir, path string) string {
+	if path == "" || filepath.IsAbs(path) {
+		return path
+	}
+	return filepath.Join(dir, path)
+}
+
+// Route sends the requests of the host and the path prefix to the deployment.
+type Route struct {
+	Host string // e.g. api.example.com. Empty matches any host.
+	Path string // The prefix of the path. Defaults to /
+	// The name of the port from ports to route to. Defaults to $YETIS_PORT.
+	TargetPort string `yaml:"targetPort"`
+}
+
+func (r Route) Validate() error {
+	if r.Path != "" && !strings.HasPrefix(r.Path, "/") {
+		return fmt.Errorf("path must start with '/'")
+	}
+	if strings.ContainsAny(r.Host, "/ ") {
+		return fmt.Errorf("host must be a domain name e.g. api.example.com, got %s", r.Host)
+	}
+	return nil
 }
 
 func ReadConfigs(path string) ([]Config, error) {
@@ -170,8 +742,8 @@ func setEnvVars(configs []Config) []Config {
 			spec := config.Spec.(DeploymentSpec)
 			var newEnvs []EnvVar
 			for _, envVar := range spec.Env {
-				if strings.HasPrefix(envVar.Value, "$") && len(envVar.Value) > 1 && envVar.Value != "$YETIS_PORT" {
-					// $YETIS_PORT is set on the server.
+				if strings.HasPrefix(envVar.Value, "$") && len(envVar.Value) > 1 && envVar.Value != "$YETIS_PORT" && !strings.HasPrefix(envVar.Value, "$YETIS_PORT_") {
+					// $YETIS_PORT and the named ports are set on the server.
 					envVal := os.Getenv(envVar.Value[1:])
 					if envVal != "" {
 						envVar.Value = envVal
@@ -2,6 +2,7 @@ package common
 
 import (
 	"bytes"
+	"encoding/json"
 	"testing"
 )
 
@@ -87,9 +88,284 @@ func TestConfigDefault(t *testing.T) {
 	}
 }
 
+func TestProbeValidate(t *testing.T) {
+	type testCase struct {
+		P     Probe
+		Valid bool
+	}
+	var cases = []testCase{
+		{P: Probe{}, Valid: true},
+		{P: Probe{HttpGet: HttpGet{Path: "/healthz"}}, Valid: true},
+		{P: Probe{HttpGet: HttpGet{Path: "/healthz", Scheme: "https"}}, Valid: true},
+		{P: Probe{HttpGet: HttpGet{Path: "healthz"}}, Valid: false},
+		{P: Probe{HttpGet: HttpGet{Path: "/healthz", Scheme: "ftp"}}, Valid: false},
+		{P: Probe{HttpGet: HttpGet{Path: "/healthz", MinStatus: 300, MaxStatus: 200}}, Valid: false},
+		{P: Probe{HttpGet: HttpGet{Path: "/healthz"}, TcpSocket: TcpSocket{Port: 8080}}, Valid: false},
+		{P: Probe{Exec: Exec{Command: "pgrep worker"}}, Valid: true},
+		{P: Probe{Exec: Exec{Command: "pgrep worker"}, HttpGet: HttpGet{Path: "/healthz"}}, Valid: false},
+		{P: Probe{Exec: Exec{Command: "pgrep worker", TimeoutSeconds: -1}}, Valid: false},
+	}
+	for _, c := range cases {
+		err := c.P.Validate()
+		if (err == nil) != c.Valid {
+			t.Errorf("probe %+v: expected valid=%t, got %v", c.P, c.Valid, err)
+		}
+	}
+}
+
+func TestConfigDefault_HttpGet(t *testing.T) {
+	ds := DeploymentSpec{LivenessProbe: Probe{HttpGet: HttpGet{Path: "/healthz"}}}.WithDefaults().(DeploymentSpec)
+	assert(t, ds.LivenessProbe.HttpGet.Scheme, "HTTP")
+	assert(t, ds.LivenessProbe.HttpGet.MinStatus, 200)
+	assert(t, ds.LivenessProbe.HttpGet.MaxStatus, 399)
+	assert(t, ds.LivenessProbe.WithPort(8080).Port(), 8080)
+	assert(t, ds.LivenessProbe.WithPort(8080).TcpSocket.Port, 0)
+}
+
+func TestConfigDefault_ReadinessAndStartup(t *testing.T) {
+	readiness := Probe{PeriodSeconds: 1}
+	ds := DeploymentSpec{ReadinessProbe: &readiness}.WithDefaults().(DeploymentSpec)
+	assert(t, ds.ReadinessProbe.PeriodSeconds, 1)
+	assert(t, ds.ReadinessProbe.FailureThreshold, 3)
+	assert(t, readiness.FailureThreshold, 0)
+	assert(t, ds.StartupProbe == nil, true)
+}
+
+func TestConfigDefault_Exec(t *testing.T) {
+	ds := DeploymentSpec{LivenessProbe: Probe{Exec: Exec{Command: "pgrep worker"}}}.WithDefaults().(DeploymentSpec)
+	assert(t, ds.LivenessProbe.Exec.TimeoutSeconds, 1)
+	assert(t, ds.LivenessProbe.WithPort(8080).Port(), 0)
+}
+
 func assert[T comparable](t *testing.T, got, want T) {
 	t.Helper()
 	if got != want {
 		t.Errorf("got %v, wanted %v", got, want)
 	}
 }
+
+func TestConfigValidate_Replicas(t *testing.T) {
+	ds := DeploymentSpec{Name: "a", Cmd: "sleep 1"}.WithDefaults().(DeploymentSpec)
+	assert(t, ds.Replicas, 1)
+	ds.Replicas = 3
+	assert(t, ds.Validate(), nil)
+	ds.LivenessProbe.TcpSocket.Port = 8080
+	if ds.Validate() == nil {
+		t.Errorf("expected probe port to be invalid with replicas")
+	}
+	// assigned by Yetis
+	ds.Env = []EnvVar{{Name: "YETIS_PORT", Value: "8080"}}
+	assert(t, ds.Validate(), nil)
+}
+
+func TestConfigValidate_Name(t *testing.T) {
+	for _, name := range []string{"hello-world", "api_v2.1", "Web@blue"} {
+		assert(t, DeploymentSpec{Name: name, Cmd: "sleep 1"}.WithDefaults().Validate(), nil)
+	}
+	for _, name := range []string{`a"; flush ruleset; "`, "a\nb", "a b", "a/b"} {
+		if (DeploymentSpec{Name: name, Cmd: "sleep 1"}).WithDefaults().Validate() == nil {
+			t.Errorf("expected name %q to be invalid", name)
+		}
+	}
+}
+
+func TestConfigUnmarshal_Expose(t *testing.T) {
+	const c = `
+spec:
+  cmd: npm start
+  proxy:
+    port: 8080
+    expose: true
+---
+spec:
+  cmd: npm start
+  proxy:
+    port: 8081
+    expose:
+      interface: eth0
+      source: 10.0.0.0/8
+`
+	configs, err := unmarshal(bytes.NewBuffer([]byte(c)))
+	if err != nil {
+		t.Fatalf("Unmarshal error: %s", err)
+	}
+	first := configs[0].Spec.(DeploymentSpec)
+	if first.Proxy[0].Expose == nil || *first.Proxy[0].Expose != (Expose{}) {
+		t.Errorf("expected exposed to all, got %v", first.Proxy[0].Expose)
+	}
+	second := configs[1].Spec.(DeploymentSpec)
+	assert(t, *second.Proxy[0].Expose, Expose{Interface: "eth0", Source: "10.0.0.0/8"})
+	assert(t, second.Proxy[0].Validate(), nil)
+
+	second.Proxy[0].Expose.Source = "10.0.0.1"
+	if second.Proxy[0].Validate() == nil {
+		t.Errorf("expected source to be invalid")
+	}
+	if (Proxy{Expose: &Expose{}}).Validate() == nil {
+		t.Errorf("expected expose without port to be invalid")
+	}
+}
+
+func TestConfigDefault_UDP(t *testing.T) {
+	ds := DeploymentSpec{Name: "dns", Cmd: "dnsmasq", Proxy: Proxies{{Port: 5353, Protocol: UDPProtocol}}}.WithDefaults().(DeploymentSpec)
+	if ds.LivenessProbe.UdpSocket == nil {
+		t.Fatal("udp deployment should be checked by the bound port")
+	}
+	assert(t, ds.LivenessProbe.WithPort(40001).Port(), 40001)
+	assert(t, ds.LivenessProbe.Port(), 0)
+	assert(t, ds.Validate(), nil)
+
+	ds = DeploymentSpec{Name: "web", Cmd: "npm start", Proxy: Proxies{{Port: 8080}}}.WithDefaults().(DeploymentSpec)
+	assert(t, ds.Proxy[0].Protocol, TCPProtocol)
+	if ds.LivenessProbe.UdpSocket != nil {
+		t.Error("tcp deployment should be checked by tcpSocket")
+	}
+	ds.Proxy[0].Protocol = "sctp"
+	if ds.Validate() == nil {
+		t.Error("expected protocol to be invalid")
+	}
+}
+
+func TestConfigUnmarshal_NamedPorts(t *testing.T) {
+	const c = `
+spec:
+  cmd: npm start
+  ports:
+    - name: admin
+    - name: grpc-web
+  proxy:
+    - port: 8080
+    - port: 9090
+      targetPort: admin
+`
+	configs, err := unmarshal(bytes.NewBuffer([]byte(c)))
+	if err != nil {
+		t.Fatalf("Unmarshal error: %s", err)
+	}
+	ds := configs[0].Spec.(DeploymentSpec).WithDefaults().(DeploymentSpec)
+	ds.Name = "web"
+	assert(t, ds.Validate(), nil)
+	assert(t, len(ds.Ports), 2)
+	assert(t, PortEnv(ds.Ports[1].Name), "YETIS_PORT_GRPC_WEB")
+	assert(t, len(ds.ProxyPorts()), 2)
+	assert(t, ds.Proxy[1].TargetPort, "admin")
+	assert(t, ds.Proxy[1].Protocol, TCPProtocol)
+
+	ds.Env = []EnvVar{{Name: "YETIS_PORT", Value: "40001"}, {Name: "YETIS_PORT_ADMIN", Value: "40002"}}
+	assert(t, ds.NamedPort(""), 40001)
+	assert(t, ds.NamedPort("admin"), 40002)
+	assert(t, ds.isFixedPort(40002), false)
+
+	ds.Proxy[1].TargetPort = "metrics"
+	if ds.Validate() == nil {
+		t.Error("expected unknown targetPort to be invalid")
+	}
+	ds.Proxy[1] = Proxy{Port: 8080}
+	if ds.Validate() == nil {
+		t.Error("expected duplicated proxy port to be invalid")
+	}
+	ds.Proxy = nil
+	ds.Ports = []Port{{Name: "Admin"}}
+	if ds.Validate() == nil {
+		t.Error("expected upper case port name to be invalid")
+	}
+}
+
+func TestConfigUnmarshal_SingleProxy(t *testing.T) {
+	var p Proxies
+	assert(t, json.Unmarshal([]byte(`{"port": 8080}`), &p), nil)
+	assert(t, len(p), 1)
+	assert(t, p[0].Port, 8080)
+	assert(t, json.Unmarshal([]byte(`{}`), &p), nil)
+	assert(t, len(p), 0)
+}
+
+func TestConfig_Route(t *testing.T) {
+	ds := DeploymentSpec{Name: "api", Cmd: "npm start", Route: &Route{Host: "api.example.com"}}.WithDefaults().(DeploymentSpec)
+	assert(t, ds.Validate(), nil)
+	assert(t, ds.Route.Path, "/")
+	ds.Route.Path = "api"
+	if ds.Validate() == nil {
+		t.Error("expected path without '/' to be invalid")
+	}
+	ds.Route = &Route{TargetPort: "admin"}
+	if ds.Validate() == nil {
+		t.Error("expected unknown targetPort to be invalid")
+	}
+}
+
+func TestConfig_TLS(t *testing.T) {
+	ds := DeploymentSpec{Name: "web", Cmd: "npm start", Workdir: "/srv/web", Proxy: Proxies{{Port: 8443, TLS: &TLS{CertFile: "cert.pem", KeyFile: "/etc/ssl/key.pem"}}}}.WithDefaults().(DeploymentSpec)
+	assert(t, ds.Validate(), nil)
+	assert(t, *ds.Proxy[0].TLS, TLS{CertFile: "/srv/web/cert.pem", KeyFile: "/etc/ssl/key.pem"})
+	ds.Proxy[0].Protocol = UDPProtocol
+	if ds.Validate() == nil {
+		t.Error("expected tls with udp to be invalid")
+	}
+	ds.Proxy[0] = Proxy{Port: 8443, TLS: &TLS{CertFile: "cert.pem"}}
+	if ds.Validate() == nil {
+		t.Error("expected tls without key to be invalid")
+	}
+	ds.Workdir = ""
+	ds.Proxy[0] = Proxy{Port: 8443, TLS: &TLS{CertFile: "cert.pem", KeyFile: "/etc/ssl/key.pem"}}
+	if ds.Validate() == nil {
+		t.Error("expected relative tls paths without workdir to be invalid")
+	}
+}
+
+func TestConfigValidate_RollbackOnFailure(t *testing.T) {
+	ds := DeploymentSpec{Name: "web", Cmd: "npm start", Proxy: Proxies{{Port: 8080}}, Strategy: DeploymentStrategy{Type: RollingUpdate, RollbackOnFailure: true}}.WithDefaults().(DeploymentSpec)
+	assert(t, ds.Validate(), nil)
+	ds.Strategy.Type = Recreate
+	if ds.Validate() == nil {
+		t.Error("expected rollbackOnFailure with Recreate to be invalid")
+	}
+}
+
+func TestConfigValidate_BlueGreen(t *testing.T) {
+	ds := DeploymentSpec{Name: "web", Cmd: "npm start", Proxy: Proxies{{Port: 8080, TargetPort: "http"}}, Ports: []Port{{Name: "http"}}, Strategy: DeploymentStrategy{Type: BlueGreen, PreviewPort: 8081}}.WithDefaults().(DeploymentSpec)
+	assert(t, ds.Validate(), nil)
+	assert(t, ds.PreviewProxy(), Proxy{Port: 8081, TargetPort: "http", Protocol: TCPProtocol})
+	ds.Strategy.PreviewPort = 8080
+	if ds.Validate() == nil {
+		t.Error("expected previewPort equal to proxy port to be invalid")
+	}
+	ds.Strategy.PreviewPort = 0
+	if ds.Validate() == nil {
+		t.Error("expected BlueGreen without previewPort to be invalid")
+	}
+	ds.Strategy = DeploymentStrategy{Type: RollingUpdate, PreviewPort: 8081}
+	if ds.Validate() == nil {
+		t.Error("expected previewPort with RollingUpdate to be invalid")
+	}
+}
+
+func TestConfigValidate_Canary(t *testing.T) {
+	ds := DeploymentSpec{Name: "web", Cmd: "npm start", Proxy: Proxies{{Port: 8080}}, Strategy: DeploymentStrategy{Type: Canary}}.WithDefaults().(DeploymentSpec)
+	assert(t, ds.Validate(), nil)
+	assert(t, *ds.Strategy.Canary, CanaryStrategy{Weight: 10, StepWeight: 10, StepSeconds: 60})
+	ds.Strategy.Canary.Weight = 120
+	if ds.Validate() == nil {
+		t.Error("expected weight above 100 to be invalid")
+	}
+	ds.Strategy.Canary.Weight = 10
+	ds.Strategy.Canary.StepSeconds = 0.0005
+	if ds.Validate() == nil {
+		t.Error("expected stepSeconds below 1ms to be invalid")
+	}
+	ds.Strategy.Canary.StepSeconds = 60
+	ds.Route = &Route{Path: "/"}
+	if ds.Validate() == nil {
+		t.Error("expected Canary with route to be invalid")
+	}
+	ds.Route = nil
+	ds.Proxy = nil
+	if ds.Validate() == nil {
+		t.Error("expected Canary without proxy.port to be invalid")
+	}
+	ds.Proxy = Proxies{{Port: 8080}}
+	ds.Strategy.Type = RollingUpdate
+	if ds.Validate() == nil {
+		t.Error("expected strategy.canary with RollingUpdate to be invalid")
+	}
+}
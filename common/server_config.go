@@ -6,19 +6,78 @@ import (
 	"log"
 	"net/smtp"
 	"os"
+	"path/filepath"
 	"reflect"
 	yaml "sigs.k8s.io/yaml/goyaml.v2"
 )
 
 type YetisConfig struct {
-	Logdir   string
+	Logdir string
+	// Directory of the database storing the deployments.
+	Datadir  string
 	Alerting Alerting
+	Proxy    ProxyConfig
+}
+
+type ProxyBackend string
+
+const (
+	// Picks the backend the host supports.
+	AutoBackend ProxyBackend = "auto"
+	// Forwards with iptables rules, needs root.
+	IptablesBackend ProxyBackend = "iptables"
+	// Forwards with the rules in the yetis table of nftables, needs root.
+	NftablesBackend ProxyBackend = "nftables"
+	// Yetis listens on the proxy port and forwards the connections itself.
+	UserspaceBackend ProxyBackend = "userspace"
+)
+
+type ProxyConfig struct {
+	// Defaults to auto.
+	Backend ProxyBackend
+	Http    HttpProxyConfig
+}
+
+// HttpProxyConfig configures the HTTP listener routing the requests to the deployments with route.
+type HttpProxyConfig struct {
+	// Zero disables the HTTP proxy.
+	Port int
+	// The HTML file returned with 503 status when the route has no ready replica.
+	ErrorPage string `yaml:"errorPage"`
+	// Defaults to yetis-access.log in logdir.
+	AccessLog string `yaml:"accessLog"`
+}
+
+func (pc ProxyConfig) Validate() error {
+	switch pc.Backend {
+	case "", AutoBackend, IptablesBackend, NftablesBackend, UserspaceBackend:
+	default:
+		return fmt.Errorf("proxy: backend must be auto, iptables, nftables or userspace, got %s", pc.Backend)
+	}
+	if pc.Http.Port < 0 || pc.Http.Port > 65535 {
+		return fmt.Errorf("proxy: http.port must be within 0-65535, got %d", pc.Http.Port)
+	}
+	return nil
 }
 
 func (yc YetisConfig) WithDefaults() YetisConfig {
 	if yc.Logdir == "" {
 		yc.Logdir = "/tmp"
 	}
+	if yc.Datadir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			yc.Datadir = "/tmp/yetis"
+		} else {
+			yc.Datadir = filepath.Join(home, ".yetis")
+		}
+	}
+	if yc.Proxy.Backend == "" {
+		yc.Proxy.Backend = AutoBackend
+	}
+	if yc.Proxy.Http.Port > 0 && yc.Proxy.Http.AccessLog == "" {
+		yc.Proxy.Http.AccessLog = filepath.Join(yc.Logdir, "yetis-access.log")
+	}
 	return yc
 }
 
@@ -93,5 +152,9 @@ func readServerConfig(f io.Reader) YetisConfig {
 			log.Fatalf("Mail validation failed: %s", err)
 		}
 	}
+	err = c.Proxy.Validate()
+	if err != nil {
+		log.Fatalf("Proxy validation failed: %s", err)
+	}
 	return c
 }
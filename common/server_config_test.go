@@ -8,6 +8,7 @@ import (
 func TestYetisConfig(t *testing.T) {
 	in := `
 logdir: /tmp # yetis.log will be stored in there. Defaults to /tmp
+datadir: /var/lib/yetis
 alerting:
   mail: # add SMPT creds of your smpt server for alerting
     host: smtp.host.com
@@ -17,12 +18,23 @@ alerting:
       - yourmail@mail.com
     username: authUser
     password: authPass
+proxy:
+  backend: userspace
+  http:
+    port: 8000
+    errorPage: /etc/yetis/503.html
 `
 
 	res := readServerConfig(bytes.NewBufferString(in))
 	if res.Logdir != "/tmp" || res.Alerting.Mail.Host != "smtp.host.com" || len(res.Alerting.Mail.To) != 1 {
 		t.Fatal("Wrong config:", res)
 	}
+	assert(t, res.Datadir, "/var/lib/yetis")
+	assert(t, res.Proxy.Backend, UserspaceBackend)
+	assert(t, YetisConfig{}.WithDefaults().Proxy.Backend, AutoBackend)
+	assert(t, res.Proxy.Http.Port, 8000)
+	assert(t, res.Proxy.Http.ErrorPage, "/etc/yetis/503.html")
+	assert(t, res.WithDefaults().Proxy.Http.AccessLog, "/tmp/yetis-access.log")
 	assert(t, res.Alerting.Mail.Validate(), nil)
 }
 
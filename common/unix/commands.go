@@ -219,3 +219,230 @@ func IsExecutable(filepath string) bool {
 
 	return info.Mode()&0111 != 0
 }
+
+// OOMKillCounter returns the file counting the processes killed by OOM killer in the cgroup of the process.
+// It's resolved while the process runs, /proc doesn't have it after the exit.
+func OOMKillCounter(pid int) (string, error) {
+	cgroups, err := os.ReadFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(cgroups), "\n") {
+		parts := strings.SplitN(line, ":", 3)
+		if len(parts) != 3 {
+			continue
+		}
+		var file string
+		switch {
+		case parts[0] == "0" && parts[1] == "":
+			// cgroup v2
+			file = filepath.Join("/sys/fs/cgroup", parts[2], "memory.events")
+		case parts[1] == "memory":
+			// cgroup v1
+			file = filepath.Join("/sys/fs/cgroup/memory", parts[2], "memory.oom_control")
+		default:
+			continue
+		}
+		if _, err := OOMKillCount(file); err == nil {
+			return file, nil
+		}
+	}
+	return "", fmt.Errorf("oom_kill counter not found")
+}
+
+// OOMKillCount reads the counter of OOMKillCounter.
+func OOMKillCount(file string) (int, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return 0, err
+	}
+	count, ok := parseOOMKill(string(content))
+	if !ok {
+		return 0, fmt.Errorf("oom_kill counter not found in %s", file)
+	}
+	return count, nil
+}
+
+func parseOOMKill(content string) (int, bool) {
+	for _, line := range strings.Split(content, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "oom_kill" {
+			count, err := strconv.Atoi(fields[1])
+			return count, err == nil
+		}
+	}
+	return 0, false
+}
+
+// ProcessStartTime returns the start time of the process in clock ticks after the system boot.
+// Together with pid, it identifies the process, because pids are reused.
+func ProcessStartTime(pid int) (uint64, error) {
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+	return parseStartTime(string(stat))
+}
+
+func parseStartTime(stat string) (uint64, error) {
+	// The second field is the command name in parentheses, it can contain spaces.
+	idx := strings.LastIndex(stat, ")")
+	if idx < 0 {
+		return 0, fmt.Errorf("invalid stat format")
+	}
+	// The fields after the command name start from the third one, starttime is the 22nd.
+	fields := strings.Fields(stat[idx+1:])
+	if len(fields) < 20 {
+		return 0, fmt.Errorf("invalid stat format")
+	}
+	return strconv.ParseUint(fields[19], 10, 64)
+}
+
+// ProcessCmdline returns the command line of the process with the arguments separated by spaces.
+func ProcessCmdline(pid int) (string, error) {
+	cmdline, err := os.ReadFile(fmt.Sprintf("/proc/%d/cmdline", pid))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(strings.ReplaceAll(string(cmdline), "\x00", " ")), nil
+}
+
+// IsUDPPortBound returns true if a process of the session of the pid has a socket bound to the UDP port on any address of IPv4 or IPv6.
+// The socket of another process on the port doesn't count, the deployment runs in its own session.
+// Unlike binding the port to check it, reading /proc doesn't steal the port from the process.
+func IsUDPPortBound(pid, port int) (bool, error) {
+	inodes := map[string]bool{}
+	content, err := os.ReadFile("/proc/net/udp")
+	if err != nil {
+		return false, err
+	}
+	socketInodes(string(content), port, inodes)
+	content, err = os.ReadFile("/proc/net/udp6")
+	if err == nil {
+		// the host without IPv6 doesn't have the file.
+		socketInodes(string(content), port, inodes)
+	}
+	if len(inodes) == 0 {
+		return false, nil
+	}
+	sid, err := xunix.Getsid(pid)
+	if err != nil {
+		return false, err
+	}
+	procs, err := os.ReadDir("/proc")
+	if err != nil {
+		return false, err
+	}
+	for _, proc := range procs {
+		p, err := strconv.Atoi(proc.Name())
+		if err != nil || processSession(p) != sid {
+			continue
+		}
+		fds, err := os.ReadDir(fmt.Sprintf("/proc/%d/fd", p))
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			link, err := os.Readlink(fmt.Sprintf("/proc/%d/fd/%s", p, fd.Name()))
+			if err == nil && inodes[link] {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// socketInodes adds the sockets bound to the port to the inodes the way /proc/PID/fd links them, e.g. socket:[12345]
+// The inode is the tenth field of /proc/net/udp format.
+func socketInodes(content string, port int, inodes map[string]bool) {
+	for _, line := range strings.Split(content, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 10 && localPort(fields) == port {
+			inodes["socket:["+fields[9]+"]"] = true
+		}
+	}
+}
+
+// processSession returns the session id of the process, -1 if it's gone.
+func processSession(pid int) int {
+	stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return -1
+	}
+	// The fields after the command name start from the third one, session is the sixth.
+	idx := strings.LastIndex(string(stat), ")")
+	if idx < 0 {
+		return -1
+	}
+	fields := strings.Fields(string(stat)[idx+1:])
+	if len(fields) < 4 {
+		return -1
+	}
+	sid, err := strconv.Atoi(fields[3])
+	if err != nil {
+		return -1
+	}
+	return sid
+}
+
+// IsUDP4PortBound returns true if a socket is bound to the UDP port on an IPv4 address.
+func IsUDP4PortBound(port int) (bool, error) {
+	content, err := os.ReadFile("/proc/net/udp")
+	if err != nil {
+		return false, err
+	}
+	return hasLocalPort(string(content), port), nil
+}
+
+// hasLocalPort parses /proc/net/udp format, the local address is the second field e.g. 0100007F:0035
+func hasLocalPort(content string, port int) bool {
+	for _, line := range strings.Split(content, "\n") {
+		if localPort(strings.Fields(line)) == port {
+			return true
+		}
+	}
+	return false
+}
+
+// CountEstablished returns the number of the established TCP connections accepted on the port, of both IPv4 and IPv6.
+func CountEstablished(port int) (int, error) {
+	content, err := os.ReadFile("/proc/net/tcp")
+	if err != nil {
+		return 0, err
+	}
+	count := countEstablished(string(content), port)
+	content, err = os.ReadFile("/proc/net/tcp6")
+	if err == nil {
+		// the host without IPv6 doesn't have the file.
+		count += countEstablished(string(content), port)
+	}
+	return count, nil
+}
+
+// countEstablished parses /proc/net/tcp format, the state is the fourth field, 01 is ESTABLISHED.
+func countEstablished(content string, port int) int {
+	var count int
+	for _, line := range strings.Split(content, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 4 && fields[3] == "01" && localPort(fields) == port {
+			count++
+		}
+	}
+	return count
+}
+
+// localPort returns the port of the local address of the /proc/net line, zero for the header.
+func localPort(fields []string) int {
+	if len(fields) < 2 {
+		return 0
+	}
+	idx := strings.LastIndex(fields[1], ":")
+	if idx < 0 {
+		return 0
+	}
+	p, err := strconv.ParseInt(fields[1][idx+1:], 16, 32)
+	if err != nil {
+		return 0
+	}
+	return int(p)
+}
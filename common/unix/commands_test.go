@@ -4,10 +4,12 @@ import (
 	"bytes"
 	"context"
 	"github.com/glossd/yetis/common"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"strconv"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -40,7 +42,8 @@ func TestTerminateProcess(t *testing.T) {
 	}
 	pid := cmd.Process.Pid
 
-	ctx, _ := context.WithTimeout(context.Background(), 2*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
 	err = TerminateProcess(ctx, cmd.Process.Pid)
 	if err != nil {
 		t.Fatalf("failed to terminated the process: %s", err)
@@ -145,3 +148,116 @@ func TestIsExecutable(t *testing.T) {
 	assert(t, IsExecutable("../../build/yetis"), true)
 	assert(t, IsExecutable("./cat.txt"), false)
 }
+
+func TestParseOOMKill(t *testing.T) {
+	v2 := "low 0\nhigh 0\nmax 12\noom 2\noom_kill 2\noom_group_kill 0\n"
+	count, ok := parseOOMKill(v2)
+	if !ok || count != 2 {
+		t.Errorf("v2: expected 2, got %d, %t", count, ok)
+	}
+	v1 := "oom_kill_disable 0\nunder_oom 0\noom_kill 5\n"
+	count, ok = parseOOMKill(v1)
+	if !ok || count != 5 {
+		t.Errorf("v1: expected 5, got %d, %t", count, ok)
+	}
+	_, ok = parseOOMKill("oom_kill_disable 0\n")
+	if ok {
+		t.Errorf("expected no counter")
+	}
+}
+
+func TestOOMKillCounter(t *testing.T) {
+	file, err := OOMKillCounter(os.Getpid())
+	if err != nil {
+		t.Skip("no oom_kill counter in the cgroup:", err)
+	}
+	_, err = OOMKillCount(file)
+	assert(t, err, nil)
+	_, err = OOMKillCounter(-1)
+	if err == nil {
+		t.Error("expected no cgroup of the missing process")
+	}
+}
+
+func TestProcessCmdline(t *testing.T) {
+	cmd := exec.Command("sleep", "0.2")
+	assert(t, cmd.Start(), nil)
+	defer cmd.Wait()
+	// right after the fork the child has the cmdline of the test until it executes sleep.
+	var cmdline string
+	var err error
+	for i := 0; i < 20; i++ {
+		cmdline, err = ProcessCmdline(cmd.Process.Pid)
+		if err == nil && cmdline == "sleep 0.2" {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert(t, err, nil)
+	assert(t, cmdline, "sleep 0.2")
+}
+
+func TestParseStartTime(t *testing.T) {
+	stat := "1234 (my (weird) cmd) S 1 1234 1234 0 -1 4194560 100 0 0 0 1 2 0 0 20 0 1 0 987654 10000000 200 18446744073709551615"
+	start, err := parseStartTime(stat)
+	assert(t, err, nil)
+	assert(t, start, uint64(987654))
+
+	_, err = parseStartTime("1234 (cmd) S 1")
+	if err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestIsUDPPortBound(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	bound, err := IsUDPPortBound(os.Getpid(), port)
+	if err != nil || !bound {
+		t.Errorf("port %d should be bound, err: %v", port, err)
+	}
+	// the socket of another session doesn't count
+	cmd := exec.Command("sleep", "10")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	assert(t, cmd.Start(), nil)
+	defer cmd.Process.Kill()
+	bound, _ = IsUDPPortBound(cmd.Process.Pid, port)
+	if bound {
+		t.Errorf("port %d isn't bound by the other session", port)
+	}
+	conn.Close()
+	bound, _ = IsUDPPortBound(os.Getpid(), port)
+	if bound {
+		t.Errorf("port %d should be free", port)
+	}
+}
+
+func TestCountEstablished(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	port := l.Addr().(*net.TCPAddr).Port
+	count, err := CountEstablished(port)
+	if err != nil || count != 0 {
+		t.Fatalf("listening socket isn't a connection, got %d, err: %v", count, err)
+	}
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	count, _ = CountEstablished(port)
+	if count != 1 {
+		t.Errorf("expected one connection, got %d", count)
+	}
+	client.Close()
+	server.Close()
+}
@@ -3,8 +3,8 @@ package common
 import (
 	"context"
 	"errors"
-	"fmt"
 	"net"
+	"strconv"
 	"time"
 )
 
@@ -13,17 +13,40 @@ func IsPortOpen(port int) bool {
 	return DialPort(port, time.Second) == nil
 }
 
+// LoopbackHosts are tried in order if the host isn't specified, the process can listen on either of them.
+var LoopbackHosts = []string{"127.0.0.1", "::1"}
+
 func DialPort(port int, timeout time.Duration) error {
-	address := fmt.Sprintf("127.0.0.1:%d", port)
-	conn, err := net.DialTimeout("tcp", address, timeout)
+	return DialHostPort("", port, timeout)
+}
 
-	if err != nil {
-		return err
+// DialHostPort tries to establish a TCP connection to the host, empty host tries LoopbackHosts at the same time within the timeout.
+func DialHostPort(host string, port int, timeout time.Duration) error {
+	hosts := []string{host}
+	if host == "" {
+		hosts = LoopbackHosts
 	}
-	if conn != nil {
-		conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	errs := make(chan error, len(hosts))
+	for _, h := range hosts {
+		go func() {
+			var d net.Dialer
+			conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(h, strconv.Itoa(port)))
+			if err == nil {
+				conn.Close()
+			}
+			errs <- err
+		}()
+	}
+	var err error
+	for range hosts {
+		err = <-errs
+		if err == nil {
+			return nil
+		}
 	}
-	return nil
+	return err
 }
 
 func IsPortOpenRetry(port int, period time.Duration, maxRestarts int) bool {
@@ -55,10 +78,11 @@ func IsPortCloseRetry(port int, period time.Duration, maxRestarts int) bool {
 }
 
 // GetFreePort asks the kernel for a free open port that is ready to use.
+// The port is reserved on all the addresses of both IPv4 and IPv6, so the process can listen on any of them.
 // https://gist.github.com/sevkin/96bdae9274465b2d09191384f86ef39d
 func GetFreePort() (port int, err error) {
 	var a *net.TCPAddr
-	if a, err = net.ResolveTCPAddr("tcp", "localhost:0"); err == nil {
+	if a, err = net.ResolveTCPAddr("tcp", ":0"); err == nil {
 		var l *net.TCPListener
 		if l, err = net.ListenTCP("tcp", a); err == nil {
 			defer l.Close()
@@ -69,7 +93,7 @@ func GetFreePort() (port int, err error) {
 }
 
 func MustGetFreePort() int {
-	a, err := net.ResolveTCPAddr("tcp", "localhost:0")
+	a, err := net.ResolveTCPAddr("tcp", ":0")
 	if err != nil {
 		panic("ResolveTCPAddr: " + err.Error())
 	}
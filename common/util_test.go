@@ -1,6 +1,10 @@
 package common
 
-import "testing"
+import (
+	"net"
+	"testing"
+	"time"
+)
 
 func TestGetFreePort(t *testing.T) {
 	p, err := GetFreePort()
@@ -9,3 +13,34 @@ func TestGetFreePort(t *testing.T) {
 		t.Errorf("port 0")
 	}
 }
+
+func TestDialPort_IPv6(t *testing.T) {
+	l, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skip("no IPv6 loopback")
+	}
+	defer l.Close()
+	port := l.Addr().(*net.TCPAddr).Port
+	assert(t, DialPort(port, time.Second), nil)
+	assert(t, DialHostPort("::1", port, time.Second), nil)
+	if DialHostPort("127.0.0.1", port, time.Second) == nil {
+		t.Errorf("IPv4 loopback shouldn't be open")
+	}
+}
+
+func TestDialPort_Concurrently(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert(t, err, nil)
+	defer l.Close()
+	port := l.Addr().(*net.TCPAddr).Port
+	prev := LoopbackHosts
+	// the unroutable address doesn't answer, it must not use up the timeout of the open one.
+	LoopbackHosts = []string{"10.255.255.1", "127.0.0.1"}
+	defer func() { LoopbackHosts = prev }()
+
+	start := time.Now()
+	assert(t, DialPort(port, 500*time.Millisecond), nil)
+	if time.Since(start) >= 500*time.Millisecond {
+		t.Errorf("expected the hosts to be dialed at the same time, took %s", time.Since(start))
+	}
+}
@@ -2,7 +2,10 @@ module github.com/glossd/yetis
 
 go 1.23
 
-require sigs.k8s.io/yaml v1.4.0
+require (
+	go.etcd.io/bbolt v1.3.11
+	sigs.k8s.io/yaml v1.4.0
+)
 
 require (
 	github.com/glossd/fetch v1.0.1 // indirect
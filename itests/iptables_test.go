@@ -8,6 +8,7 @@ import (
 	"github.com/glossd/yetis/common/unix"
 	"github.com/glossd/yetis/server"
 	"os"
+	"path/filepath"
 	"strconv"
 	"sync/atomic"
 	"syscall"
@@ -17,8 +18,7 @@ import (
 
 func TestProxyUpdatesWhenDeploymentRestartsOnLivenessFailure(t *testing.T) {
 	skipIfNotIptables(t)
-	go server.Run("")
-	t.Cleanup(server.Stop)
+	runServer(t, "")
 	// let the server start
 	time.Sleep(5 * time.Millisecond)
 
@@ -35,8 +35,8 @@ func TestProxyUpdatesWhenDeploymentRestartsOnLivenessFailure(t *testing.T) {
 	if !common.IsPortOpenRetry(dep.Spec.YetisPort(), 50*time.Millisecond, 20) {
 		t.Fatal("deployment port closed", dep.Spec.YetisPort())
 	}
-	if !common.IsPortOpenRetry(dep.Spec.Proxy.Port, 50*time.Millisecond, 20) {
-		t.Fatal("port forwarding closed", dep.Spec.Proxy.Port)
+	if !common.IsPortOpenRetry(dep.Spec.Proxy[0].Port, 50*time.Millisecond, 20) {
+		t.Fatal("port forwarding closed", dep.Spec.Proxy[0].Port)
 	}
 
 	checkOK := func() {
@@ -89,8 +89,7 @@ func TestProxyUpdatesWhenDeploymentRestartsOnLivenessFailure(t *testing.T) {
 
 func TestRestart_RollingUpdate_ZeroDowntime(t *testing.T) {
 	skipIfNotIptables(t)
-	go server.Run("")
-	t.Cleanup(server.Stop)
+	runServer(t, "")
 	// let the server start
 	time.Sleep(5 * time.Millisecond)
 
@@ -134,11 +133,12 @@ func TestRestart_RollingUpdate_ZeroDowntime(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	checkDeploymentRunning(t, "go-1")
-	secondDep, err := client.GetDeployment("go-1")
+	checkDeploymentRunning(t, "go")
+	secondDep, err := client.GetDeployment("go")
 	if err != nil {
 		t.Fatal(err)
 	}
+	assert(t, secondDep.Instance, "go@1")
 	if firstDep.Spec.YetisPort() == secondDep.Spec.YetisPort() {
 		t.Fatal("restarted on the same port")
 	}
@@ -148,8 +148,7 @@ func TestRestart_RollingUpdate_ZeroDowntime(t *testing.T) {
 
 func TestDeploymentRestartWithNewYetisPort(t *testing.T) {
 	skipIfNotIptables(t)
-	go server.Run("")
-	t.Cleanup(server.Stop)
+	runServer(t, "")
 	// let the server start
 	time.Sleep(5 * time.Millisecond)
 
@@ -191,8 +190,7 @@ func TestDeploymentRestartWithNewYetisPort(t *testing.T) {
 func TestRestartThroughApply_RollingUpdateStrategy(t *testing.T) {
 	skipIfNotIptables(t)
 
-	go server.Run("")
-	t.Cleanup(server.Stop)
+	runServer(t, "")
 	time.Sleep(time.Millisecond)
 	errs := client.Apply(pwd(t) + "/specs/app-port.yaml")
 	if len(errs) != 0 {
@@ -209,10 +207,11 @@ func TestRestartThroughApply_RollingUpdateStrategy(t *testing.T) {
 		t.Fatalf("apply errors: %v", errs)
 	}
 
-	checkDeploymentRunning(t, "go-1")
+	checkDeploymentRunning(t, "go")
 
-	secondDep, err := client.GetDeployment("go-1")
+	secondDep, err := client.GetDeployment("go")
 	assert(t, err, nil)
+	assert(t, secondDep.Instance, "go@1")
 	if firstDep.Spec.LivenessProbe.Port() == secondDep.Spec.LivenessProbe.Port() {
 		t.Error("ports supposed to be different")
 	}
@@ -232,6 +231,31 @@ func pwd(t *testing.T) string {
 	return fullPath
 }
 
+// runServer runs Yetis with its own datadir, the deployments kept by the shutdown of the previous test don't come back.
+func runServer(t *testing.T, configPath string) {
+	path := writeServerConfig(t, configPath)
+	go server.Run(path)
+	t.Cleanup(server.Stop)
+}
+
+func writeServerConfig(t *testing.T, configPath string) string {
+	var config []byte
+	if configPath != "" {
+		var err error
+		config, err = os.ReadFile(configPath)
+		if err != nil {
+			t.Fatalf("read config: %s", err)
+		}
+	}
+	config = append(config, "\ndatadir: "+t.TempDir()+"\n"...)
+	path := filepath.Join(t.TempDir(), "yetis.yaml")
+	err := os.WriteFile(path, config, 0644)
+	if err != nil {
+		t.Fatalf("write config: %s", err)
+	}
+	return path
+}
+
 func checkDeploymentRunning(t *testing.T, name string) {
 	forTimeout(t, 5*time.Second, func() bool {
 		dep, err := client.GetDeployment(name)
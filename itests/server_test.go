@@ -22,8 +22,7 @@ import (
 //	server_test.go:42: before first healthcheck: expected Pending status, got Running, restarts 0
 func TestLivenessRestart(t *testing.T) {
 	unix.KillByPort(server.YetisServerPort, true)
-	go server.Run("")
-	t.Cleanup(server.Stop)
+	runServer(t, "")
 	// let the server start
 	time.Sleep(time.Millisecond)
 
@@ -66,8 +65,7 @@ func TestLivenessRestart(t *testing.T) {
 	if err != nil {
 		t.Fatalf("failed to kill: %s", err)
 	}
-	checkSR("needs two heartbeat failures to restart", server.Running, 0)
-
+	// the exit of the process restarts it without waiting for the liveness probe.
 	forTimeout(t, 2*time.Second, func() bool {
 		d, err := client.GetDeployment("hello")
 		assert(t, err, nil)
@@ -82,8 +80,7 @@ func TestLivenessRestart(t *testing.T) {
 }
 
 func TestRestartThroughApply_RecreateStrategy(t *testing.T) {
-	go server.Run("")
-	t.Cleanup(server.Stop)
+	runServer(t, "")
 	time.Sleep(time.Millisecond)
 	errs := client.Apply(pwd(t) + "/specs/nc.yaml")
 	if len(errs) != 0 {
@@ -115,41 +112,54 @@ func TestRestartThroughApply_RecreateStrategy(t *testing.T) {
 	}
 }
 
-func TestShutdown_DeleteDeployments(t *testing.T) {
-	cmd := exec.Command("go", "run", "main.go", "run")
-	cmd.Dir = ".."
-	if cmd.Start() != nil {
-		t.Fatal("failed to start Yetis")
+func TestShutdown_TerminateDeployments(t *testing.T) {
+	config := writeServerConfig(t, "")
+	start := func() {
+		cmd := exec.Command("go", "run", "main.go", "run", "-f", config)
+		cmd.Dir = ".."
+		if cmd.Start() != nil {
+			t.Fatal("failed to start Yetis")
+		}
+		t.Cleanup(func() {
+			cmd.Process.Kill()
+		})
+		if !common.IsPortOpenRetry(server.YetisServerPort, 50*time.Millisecond, 30) {
+			t.Fatal("yetis server hasn't started")
+		}
 	}
-	t.Cleanup(func() {
-		cmd.Process.Kill()
-	})
-
-	if !common.IsPortOpenRetry(server.YetisServerPort, 50*time.Millisecond, 30) {
-		t.Fatal("yetis server hasn't started")
+	stop := func() {
+		client.ShutdownServer(time.Second, false)
+		if !common.IsPortCloseRetry(27000, 50*time.Millisecond, 10) {
+			t.Fatal("main should've stopped")
+		}
+		if !common.IsPortCloseRetry(server.YetisServerPort, 50*time.Millisecond, 10) {
+			t.Fatal("server should've stopped")
+		}
 	}
+
+	start()
 	errs := client.Apply(pwd(t) + "/specs/nc.yaml")
 	if len(errs) != 0 {
 		t.Fatalf("apply errors: %v", errs)
 	}
-
 	if !common.IsPortOpenRetry(27000, 50*time.Millisecond, 30) {
 		t.Fatal("main haven't started")
 	}
-	client.ShutdownServer(time.Second)
-	if !common.IsPortCloseRetry(27000, 50*time.Millisecond, 10) {
-		t.Fatal("main should've stopped")
-	}
-	if !common.IsPortCloseRetry(server.YetisServerPort, 50*time.Millisecond, 10) {
-		t.Fatal("server should've stopped")
+	stop()
+
+	// the deployment is kept for the next start
+	start()
+	if !common.IsPortOpenRetry(27000, 50*time.Millisecond, 30) {
+		t.Fatal("main should've been started again")
 	}
+	assert(t, client.DeleteDeployment("hello"), nil)
+	stop()
 }
 
 func TestDeleteAllDeploymentChildProcesses(t *testing.T) {
 	//unix.KillByPort(27000, true)
 	//unix.KillByPort(27001, true)
-	go server.Run("")
-	t.Cleanup(server.Stop)
+	runServer(t, "")
 	time.Sleep(time.Millisecond)
 	errs := client.Apply(pwd(t) + "/specs/subproc.yaml")
 	if len(errs) != 0 {
@@ -0,0 +1,60 @@
+package itests
+
+import (
+	"github.com/glossd/fetch"
+	"github.com/glossd/yetis/client"
+	"github.com/glossd/yetis/common"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUserspaceProxy_RollingUpdate_ZeroDowntime(t *testing.T) {
+	runServer(t, pwd(t)+"/specs/server-userspace.yaml")
+	// let the server start
+	time.Sleep(5 * time.Millisecond)
+
+	errs := client.Apply(pwd(t) + "/specs/main-rolling-update.yaml")
+	if len(errs) != 0 {
+		t.Fatalf("apply errors: %v", errs)
+	}
+	checkDeploymentRunning(t, "go")
+	if !common.IsPortOpenRetry(27000, 50*time.Millisecond, 50) {
+		t.Fatal("service port should be open")
+	}
+
+	var stop atomic.Bool
+	for i := 0; i < 3; i++ {
+		go func() {
+			for !stop.Load() {
+				res, err := fetch.Get[string]("http://localhost:27000/hello", fetch.Config{Timeout: 3 * time.Second})
+				if stop.Load() {
+					return
+				}
+				if err != nil {
+					t.Error("Worker "+strconv.Itoa(i), time.Now(), err)
+					continue
+				}
+				if res != "OK" {
+					t.Errorf("wrong response %v", res)
+				}
+			}
+		}()
+	}
+
+	err := client.Restart("go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkDeploymentRunning(t, "go")
+	dep, err := client.GetDeployment("go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dep.Instance != "go@1" {
+		t.Errorf("expected the new instance go@1, got %s", dep.Instance)
+	}
+	time.Sleep(time.Second)
+	stop.Store(true)
+}
@@ -54,7 +54,7 @@ func main() {
 			log.Fatalf("Unable to get current user: %s\n", err)
 		}
 		if currentUser.Username != "root" {
-			log.Println("Warning: not running as root, Yetis won't be to create a proxy")
+			log.Println("Warning: not running as root, Yetis will proxy with the userspace backend")
 		}
 		if len(args) == 2 {
 			client.StartBackground("")
@@ -67,16 +67,25 @@ func main() {
 
 		client.StartBackground(args[3])
 	case "shutdown":
-		if len(args) == 2 {
-			client.ShutdownServer(5 * time.Minute)
+		var keepProcesses bool
+		var shutdownArgs []string
+		for _, arg := range args[2:] {
+			if arg == "--keep-processes" {
+				keepProcesses = true
+			} else {
+				shutdownArgs = append(shutdownArgs, arg)
+			}
+		}
+		if len(shutdownArgs) == 0 {
+			client.ShutdownServer(5*time.Minute, keepProcesses)
 			return
 		}
-		secondsStr := args[2]
+		secondsStr := shutdownArgs[0]
 		seconds, err := strconv.Atoi(secondsStr)
 		if err != nil {
 			fmt.Println("second argument should be the timeout in seconds")
 		}
-		client.ShutdownServer(time.Duration(seconds) * time.Second)
+		client.ShutdownServer(time.Duration(seconds)*time.Second, keepProcesses)
 	case "get": // deprecated.
 		fallthrough
 	case "list": // is back in business
@@ -110,6 +119,10 @@ func main() {
 			needName()
 			return
 		}
+		if len(os.Args) > 3 && os.Args[3] == "--instances" {
+			client.DescribeInstances(os.Args[2])
+			return
+		}
 		client.DescribeDeployment(os.Args[2])
 	case "delete":
 		if len(os.Args) < 3 {
@@ -132,6 +145,64 @@ func main() {
 		}
 
 		client.Restart(os.Args[2])
+	case "scale":
+		if len(os.Args) != 5 || os.Args[3] != "--replicas" {
+			printFlags("scale NAME", Flag{Def: "--replicas N", Des: "the number of processes to run"})
+			return
+		}
+		replicas, err := strconv.Atoi(os.Args[4])
+		if err != nil {
+			fmt.Println("--replicas should be a number")
+			return
+		}
+		client.Scale(os.Args[2], replicas)
+	case "promote":
+		if len(os.Args) < 3 {
+			needName()
+			return
+		}
+		client.Promote(os.Args[2])
+	case "abort":
+		if len(os.Args) < 3 {
+			needName()
+			return
+		}
+		client.Abort(os.Args[2])
+	case "rollout":
+		if len(os.Args) < 4 {
+			fmt.Println("expected command 'rollout history|undo|status NAME'")
+			return
+		}
+		name := os.Args[3]
+		switch os.Args[2] {
+		case "history":
+			client.RolloutHistory(name)
+		case "status":
+			client.RolloutStatus(name)
+		case "undo":
+			var toRevision int
+			if len(os.Args) > 4 {
+				if len(os.Args) != 6 || os.Args[4] != "--to-revision" {
+					printFlags("rollout undo NAME", Flag{Def: "--to-revision N", Des: "the revision to roll back to, defaults to the previous one"})
+					return
+				}
+				n, err := strconv.Atoi(os.Args[5])
+				if err != nil || n < 1 {
+					fmt.Println("--to-revision should be a positive number")
+					return
+				}
+				toRevision = n
+			}
+			client.RolloutUndo(name, toRevision)
+		default:
+			fmt.Println("expected command 'rollout history|undo|status NAME'")
+		}
+	case "proxy":
+		if len(os.Args) < 3 || os.Args[2] != "reconcile" {
+			fmt.Println("expected command 'proxy reconcile'")
+			return
+		}
+		client.ReconcileProxy()
 	case "help":
 		printHelp()
 	default:
@@ -163,14 +234,24 @@ func printHelp() {
 Server Commands:
 	start [-f FILENAME]     start Yetis server
 	shutdown                terminate Yetis server
+	  --keep-processes      leave the processes running for the next start to adopt them
 	info                    print server status
 Resources Commands:
 	apply -f FILENAME       apply a process configuration from yaml file, creates new or restarts existing ones.
 	list [-w]               print a list the deployments
 	logs [-f] NAME          print the logs of the selected deployment 
 	describe NAME           print a detailed description of the selected deployment
+	  --instances           print the processes of all the replicas instead, including the old ones during RollingUpdate
 	delete NAME             delete and terminate the selected deployment
 	restart NAME            restart the selected deployment according to its strategy type 
+	scale NAME --replicas N start or delete replicas of the selected deployment without restarting the others
+	promote NAME            switch the proxy of the selected BlueGreen or Canary deployment to its new instances and terminate the old ones
+	abort NAME              terminate the preview or the canary of the selected deployment
+	rollout history NAME    print the applied revisions of the selected deployment
+	rollout undo NAME       restart the selected deployment with the previous revision according to its strategy type
+	  --to-revision N       roll back to the revision N instead
+	rollout status NAME     print the status of the last restart of the selected deployment
+	proxy reconcile         delete the stale proxy rules and repair the ones pointing at the wrong ports
 	help                    print the list of the commands
 `)
 }
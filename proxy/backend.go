@@ -0,0 +1,213 @@
+package proxy
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+)
+
+// Backend forwards the connections from the proxy port to the ports of the deployment.
+type Backend interface {
+	Name() string
+	// SetPortForwarding makes FromPort forward connections to ToPorts in round-robin, or by Weights if they're set.
+	// The forwarding belongs to the deployment with the name, the port of another deployment isn't touched.
+	// Empty ToPorts deletes the forwarding.
+	SetPortForwarding(f Forwarding) error
+	// List returns the forwardings of Yetis present on the host.
+	List() ([]Forwarding, error)
+}
+
+// LegacyCleaner is implemented by the backends which find the forwardings left by the older versions of Yetis.
+type LegacyCleaner interface {
+	// DeleteLegacy deletes the forwardings without the name of the deployment and returns them.
+	DeleteLegacy() ([]Forwarding, error)
+}
+
+// Forwarding is the port forwarding of a deployment.
+type Forwarding struct {
+	Name     string
+	FromPort int
+	ToPorts  []int
+	// Optional. The percentage of the connections each of ToPorts gets, positive and adding up to 100. Nil is round-robin.
+	Weights []int
+	// tcp, udp or both. Defaults to tcp.
+	Protocol string
+	// Without Expose only the connections from the host are forwarded.
+	Expose *Expose
+	// TLS is terminated by the userspace proxy, the plaintext is forwarded.
+	TLS *TLS
+}
+
+// TLS is the certificate and the key files in PEM.
+type TLS struct {
+	CertFile string
+	KeyFile  string
+}
+
+func (t *TLS) equal(o *TLS) bool {
+	if t == nil || o == nil {
+		return t == o
+	}
+	return *t == *o
+}
+
+var protocols = []string{"tcp", "udp"}
+
+// forwards tells if the forwarding is for the protocol.
+func (f Forwarding) forwards(protocol string) bool {
+	switch f.Protocol {
+	case "", "tcp":
+		return protocol == "tcp"
+	case "both":
+		return true
+	default:
+		return f.Protocol == protocol
+	}
+}
+
+// toPortsOf returns ToPorts if the forwarding is for the protocol.
+func (f Forwarding) toPortsOf(protocol string) []int {
+	if f.forwards(protocol) {
+		return f.ToPorts
+	}
+	return nil
+}
+
+// mergeProtocols joins the tcp and udp forwardings of the same port into one with both protocols.
+func mergeProtocols(fs []Forwarding) []Forwarding {
+	var res []Forwarding
+	for _, f := range fs {
+		idx := slices.IndexFunc(res, func(o Forwarding) bool {
+			return o.Name == f.Name && o.FromPort == f.FromPort && o.Protocol != f.Protocol && o.samePorts(f) && o.Expose.equal(f.Expose)
+		})
+		if idx >= 0 {
+			res[idx].Protocol = "both"
+			continue
+		}
+		res = append(res, f)
+	}
+	return res
+}
+
+// mergeExposed adds the exposed forwarding, it's merged with the one from the host if they point at the same ports.
+func mergeExposed(fs []Forwarding, exposed Forwarding) []Forwarding {
+	idx := slices.IndexFunc(fs, func(o Forwarding) bool {
+		return o.Name == exposed.Name && o.FromPort == exposed.FromPort && o.Protocol == exposed.Protocol && o.samePorts(exposed)
+	})
+	if idx < 0 {
+		return append(fs, exposed)
+	}
+	fs[idx].Expose = exposed.Expose
+	return fs
+}
+
+// Expose forwards the connections coming from the network, optionally limited to the interface and the source CIDR.
+type Expose struct {
+	Interface string
+	Source    string
+}
+
+func (f Forwarding) Equal(o Forwarding) bool {
+	return f.Name == o.Name && f.FromPort == o.FromPort && f.samePorts(o) && f.Expose.equal(o.Expose) && f.TLS.equal(o.TLS) &&
+		f.forwards("tcp") == o.forwards("tcp") && f.forwards("udp") == o.forwards("udp")
+}
+
+// samePorts tells if the forwardings split the connections between the same ports the same way.
+func (f Forwarding) samePorts(o Forwarding) bool {
+	return slices.Equal(f.ToPorts, o.ToPorts) && slices.Equal(f.Weights, o.Weights)
+}
+
+func (e *Expose) equal(o *Expose) bool {
+	if e == nil || o == nil {
+		return e == o
+	}
+	return e.Interface == o.Interface && normalizeCIDR(e.Source) == normalizeCIDR(o.Source)
+}
+
+func isIPv6CIDR(cidr string) bool {
+	ip, _, err := net.ParseCIDR(cidr)
+	return err == nil && ip.To4() == nil
+}
+
+// normalizeCIDR returns the CIDR the way iptables and nft print it, e.g. 10.1.2.3/8 becomes 10.0.0.0/8
+func normalizeCIDR(cidr string) string {
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return cidr
+	}
+	return ipNet.String()
+}
+
+var (
+	Iptables  Backend = iptables{}
+	Nftables  Backend = nftables{}
+	Userspace Backend = userspace{}
+)
+
+var backends = []Backend{Iptables, Nftables, Userspace}
+
+func BackendByName(name string) (Backend, bool) {
+	for _, b := range backends {
+		if b.Name() == name {
+			return b, true
+		}
+	}
+	return nil, false
+}
+
+// DetectBackend picks the backend the host supports.
+// Without root only userspace works. nftables is preferred if iptables is missing or is the nft shim.
+func DetectBackend() Backend {
+	if os.Geteuid() != 0 {
+		return Userspace
+	}
+	_, nftErr := exec.LookPath("nft")
+	_, iptErr := exec.LookPath("iptables")
+	if nftErr == nil && (iptErr != nil || isIptablesNftShim()) {
+		return Nftables
+	}
+	if iptErr == nil {
+		return Iptables
+	}
+	return Userspace
+}
+
+func isIptablesNftShim() bool {
+	out, err := exec.Command("iptables", "--version").Output()
+	return err == nil && strings.Contains(string(out), "nf_tables")
+}
+
+type iptables struct{}
+
+func (iptables) Name() string { return "iptables" }
+
+func (iptables) SetPortForwarding(f Forwarding) error {
+	return SetPortForwarding(f)
+}
+
+func (iptables) List() ([]Forwarding, error) {
+	return ListPortForwarding()
+}
+
+func (iptables) DeleteLegacy() ([]Forwarding, error) {
+	rules, err := deleteLegacyRules("iptables", 0)
+	var res []Forwarding
+	for _, r := range rules {
+		res = append(res, Forwarding{FromPort: r.FromPort, ToPorts: []int{r.ToPort}, Protocol: r.Protocol})
+	}
+	return res, err
+}
+
+type userspace struct{}
+
+func (userspace) Name() string { return "userspace" }
+
+func (userspace) SetPortForwarding(f Forwarding) error {
+	return SetUserspaceForwarding(f)
+}
+
+func (userspace) List() ([]Forwarding, error) {
+	return ListUserspaceForwarding(), nil
+}
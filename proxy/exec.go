@@ -2,96 +2,425 @@ package proxy
 
 import (
 	"fmt"
+	"log"
+	"math"
 	"os/exec"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 )
 
-var ErrRuleNotFound = fmt.Errorf("iptables rule not found")
+// Yetis keeps its rules in its own chains of the nat table: YETIS is jumped to from OUTPUT for the connections from the host,
+// YETIS-EXPOSE from PREROUTING for the ones from the network.
+// REDIRECT in PREROUTING sends to the address of the incoming interface, the apps bound only to the loopback don't get the exposed connections.
+// Each rule is tagged with the name of the deployment, the rules of other tools are never touched.
+// The same rules are programmed for IPv6 by ip6tables if it's installed.
+const (
+	iptablesChain       = "YETIS"
+	iptablesExposeChain = "YETIS-EXPOSE"
+)
 
-func CreatePortForwarding(fromPort, toPort int) error {
-	rules, err := listRules()
+// SetPortForwarding makes FromPort forward connections to ToPorts in round-robin, or by Weights if they're set.
+// The new rules are inserted before the old ones are deleted, so that no connection is refused.
+// Empty ToPorts deletes the forwarding.
+func SetPortForwarding(f Forwarding) error {
+	// the rules of the older versions of Yetis for the port would take the connections before the YETIS chain.
+	_, err := deleteLegacyRules("iptables", f.FromPort)
 	if err != nil {
 		return err
 	}
-	for _, rule := range strings.Split(rules, "\n") {
-		if strings.Contains(rule, strconv.Itoa(fromPort)) {
-			return fmt.Errorf("iptables already have port forwarding rule for %d port", fromPort)
+	for _, bin := range iptablesBins() {
+		for _, protocol := range protocols {
+			err := setChainForwarding(bin, iptablesChain, "OUTPUT", f.Name, protocol, f.FromPort, f.toPortsOf(protocol), f.Weights, []string{"-o", "lo"})
+			if err != nil {
+				return err
+			}
+			var exposedPorts []int
+			var match []string
+			// the source of one family doesn't match the connections of the other.
+			if f.Expose != nil && (f.Expose.Source == "" || isIPv6CIDR(f.Expose.Source) == (bin == "ip6tables")) {
+				exposedPorts = f.toPortsOf(protocol)
+				match = exposeMatch(*f.Expose)
+			}
+			err = setChainForwarding(bin, iptablesExposeChain, "PREROUTING", f.Name, protocol, f.FromPort, exposedPorts, f.Weights, match)
+			if err != nil {
+				return err
+			}
 		}
 	}
+	return nil
+}
 
-	// https://askubuntu.com/a/579540/915003
-	argStr := "-t nat -A OUTPUT " + portForwardRule(fromPort, toPort)
-	cmd := exec.Command("iptables", strings.Split(argStr, " ")...)
-	return cmd.Run()
+func iptablesBins() []string {
+	ip6tablesOnce.Do(func() {
+		if _, err := exec.LookPath("ip6tables"); err != nil {
+			return
+		}
+		// the binary is there without the nat table when the kernel has no ip6table_nat or IPv6 is disabled.
+		err := runIptables("ip6tables", "-t", "nat", "-L", "-n")
+		if err != nil {
+			log.Printf("IPv6 won't be forwarded, ip6tables has no nat table: %s\n", err)
+			return
+		}
+		ip6tablesNat = true
+	})
+	if ip6tablesNat {
+		return []string{"iptables", "ip6tables"}
+	}
+	return []string{"iptables"}
 }
 
-func DeletePortForwarding(fromPort, toPort int) error {
-	// https://stackoverflow.com/a/14521050/10160865
-	line, err := getLine(fromPort, toPort)
-	if err != nil {
-		return err
+var (
+	ip6tablesOnce sync.Once
+	ip6tablesNat  bool
+)
+
+func exposeMatch(e Expose) []string {
+	var match []string
+	if e.Interface != "" {
+		match = append(match, "-i", e.Interface)
+	}
+	if e.Source != "" {
+		match = append(match, "-s", normalizeCIDR(e.Source))
 	}
-	argStr := fmt.Sprintf("-t nat -D OUTPUT %d", line)
-	cmd := exec.Command("iptables", strings.Split(argStr, " ")...)
-	return cmd.Run()
+	return match
 }
 
-func UpdatePortForwarding(fromPort, oldToPort, newToPort int) error {
-	// https://stackoverflow.com/a/33468689/10160865
-	if oldToPort == newToPort {
+func setChainForwarding(bin, chain, from, name, protocol string, fromPort int, toPorts, weights []int, match []string) error {
+	if len(toPorts) == 0 && !chainExists(bin, chain) {
 		return nil
 	}
-	line, err := getLine(fromPort, oldToPort)
+	err := ensureChain(bin, chain, from)
 	if err != nil {
-		if err == ErrRuleNotFound {
-			err := CreatePortForwarding(fromPort, newToPort)
-			if err != nil {
-				return fmt.Errorf("rule was not found and failed to create it: %s", err)
+		return err
+	}
+	rules, err := listRules(bin, chain)
+	if err != nil {
+		return err
+	}
+	var lines []int
+	var current []iptablesRule
+	sameMatch := true
+	for _, r := range rules {
+		if r.FromPort != fromPort {
+			continue
+		}
+		if r.Name != name {
+			return fmt.Errorf("port %d is already forwarded by '%s'", fromPort, r.Name)
+		}
+		if r.Protocol != protocol {
+			continue
+		}
+		lines = append(lines, r.Line)
+		current = append(current, r)
+		sameMatch = sameMatch && slices.Equal(r.match(chain), match)
+	}
+	currentPorts, currentWeights := rulesPorts(current)
+	if slices.Equal(currentPorts, toPorts) && slices.Equal(currentWeights, weights) && sameMatch {
+		return nil
+	}
+	for i := len(toPorts) - 1; i >= 0; i-- {
+		args := append([]string{"-t", "nat", "-I", chain, "1"}, portForwardRule(match, protocol, name, fromPort, toPorts[i], statisticMatch(weights, i, len(toPorts)))...)
+		err := runIptables(bin, args...)
+		if err != nil {
+			return fmt.Errorf("failed to insert rule to %d port: %s", toPorts[i], err)
+		}
+	}
+	// delete from the bottom, so that the line numbers of the rest don't change.
+	for i := len(lines) - 1; i >= 0; i-- {
+		err := runIptables(bin, "-t", "nat", "-D", chain, strconv.Itoa(lines[i]+len(toPorts)))
+		if err != nil {
+			return fmt.Errorf("failed to delete old rule: %s", err)
+		}
+	}
+	return nil
+}
+
+// ListPortForwarding returns the tagged rules of the Yetis chains grouped by the deployment and the port.
+// The IPv6 forwardings are only returned if they differ from the IPv4 ones.
+func ListPortForwarding() ([]Forwarding, error) {
+	var res []Forwarding
+	for _, bin := range iptablesBins() {
+		forwardings, err := listForwardings(bin)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range forwardings {
+			if !slices.ContainsFunc(res, func(o Forwarding) bool {
+				return o.Name == f.Name && o.FromPort == f.FromPort && o.Protocol == f.Protocol && o.samePorts(f)
+			}) {
+				res = append(res, f)
 			}
-			return nil
 		}
-		return err
 	}
-	argStr := fmt.Sprintf("-t nat -R OUTPUT %d ", line) + portForwardRule(fromPort, newToPort)
-	cmd := exec.Command("iptables", strings.Split(argStr, " ")...)
-	return cmd.Run()
+	return mergeProtocols(res), nil
 }
 
-func getLine(fromPort, toPort int) (int, error) {
-	output, err := listRules()
-	if err != nil {
-		return 0, err
+func listForwardings(bin string) ([]Forwarding, error) {
+	var res []Forwarding
+	for _, chain := range []string{iptablesChain, iptablesExposeChain} {
+		if !chainExists(bin, chain) {
+			continue
+		}
+		rules, err := listRules(bin, chain)
+		if err != nil {
+			return nil, err
+		}
+		if chain == iptablesChain {
+			res = groupRules(rules, false)
+			continue
+		}
+		for _, f := range groupRules(rules, true) {
+			res = mergeExposed(res, f)
+		}
+	}
+	return res, nil
+}
+
+func groupRules(rules []iptablesRule, exposed bool) []Forwarding {
+	var res []Forwarding
+	var grouped [][]iptablesRule
+	for _, r := range rules {
+		idx := slices.IndexFunc(res, func(f Forwarding) bool {
+			return f.Name == r.Name && f.FromPort == r.FromPort && f.Protocol == r.Protocol
+		})
+		if idx < 0 {
+			f := Forwarding{Name: r.Name, FromPort: r.FromPort, Protocol: r.Protocol}
+			if exposed {
+				f.Expose = &Expose{Interface: r.Interface, Source: r.Source}
+			}
+			res = append(res, f)
+			grouped = append(grouped, nil)
+			idx = len(res) - 1
+		}
+		grouped[idx] = append(grouped[idx], r)
+	}
+	for i := range res {
+		res[i].ToPorts, res[i].Weights = rulesPorts(grouped[i])
 	}
-	return extractLine(output, fromPort, toPort)
+	return res
 }
 
-func listRules() (string, error) {
-	output, err := exec.Command("iptables", strings.Split("-t nat -L OUTPUT --line-numbers -n", " ")...).Output()
+// rulesPorts returns the ports of the rules of one port and the weights their probabilities add up to, nil if they take every nth connection.
+func rulesPorts(rules []iptablesRule) (ports, weights []int) {
+	weighted := slices.ContainsFunc(rules, func(r iptablesRule) bool { return r.Probability > 0 })
+	remaining := 100
+	for i, r := range rules {
+		ports = append(ports, r.ToPort)
+		if !weighted {
+			continue
+		}
+		w := remaining
+		if i < len(rules)-1 {
+			w = int(math.Round(r.Probability * float64(remaining)))
+		}
+		weights = append(weights, w)
+		remaining -= w
+	}
+	return ports, weights
+}
+
+func chainExists(bin, chain string) bool {
+	return runIptables(bin, "-t", "nat", "-L", chain, "-n") == nil
+}
+
+func ensureChain(bin, chain, from string) error {
+	if !chainExists(bin, chain) {
+		err := runIptables(bin, "-t", "nat", "-N", chain)
+		if err != nil {
+			return fmt.Errorf("failed to create %s chain: %s", chain, err)
+		}
+	}
+	// first, so that the rules appended by others don't take the connections before it.
+	if runIptables(bin, "-t", "nat", "-C", from, "-j", chain) != nil {
+		err := runIptables(bin, "-t", "nat", "-I", from, "1", "-j", chain)
+		if err != nil {
+			return fmt.Errorf("failed to jump to %s chain from %s: %s", chain, from, err)
+		}
+	}
+	return nil
+}
+
+type iptablesRule struct {
+	// Line number in the chain, starts from 1.
+	Line      int
+	Name      string
+	Protocol  string
+	FromPort  int
+	ToPort    int
+	Interface string
+	Source    string
+	Output    string
+	// Of the random statistic match, zero for the nth one.
+	Probability float64
+}
+
+// match returns the part of the rule limiting the connections, the way portForwardRule takes it.
+func (r iptablesRule) match(chain string) []string {
+	if chain == iptablesChain {
+		return []string{"-o", r.Output}
+	}
+	return exposeMatch(Expose{Interface: r.Interface, Source: r.Source})
+}
+
+func listRules(bin, chain string) ([]iptablesRule, error) {
+	output, err := exec.Command(bin, "-t", "nat", "-S", chain).Output()
 	if err != nil {
-		return "", fmt.Errorf("failed to list iptables rules: %s", err)
+		return nil, fmt.Errorf("failed to list %s rules: %s", bin, err)
 	}
-	return string(output), nil
+	return parseRules(string(output)), nil
 }
 
-func extractLine(output string, fromPort, toPort int) (int, error) {
-	lines := strings.Split(output, "\n")
+// parseRules parses the output of 'iptables -S', skipping the rules without the tag.
+func parseRules(output string) []iptablesRule {
+	var rules []iptablesRule
+	var line int
+	for _, spec := range strings.Split(output, "\n") {
+		fields := splitRule(spec)
+		if len(fields) == 0 || fields[0] != "-A" {
+			continue
+		}
+		line++
+		r := iptablesRule{
+			Line:      line,
+			Name:      fieldAfter(fields, "--comment"),
+			Protocol:  fieldAfter(fields, "-p"),
+			FromPort:  atoi(fieldAfter(fields, "--dport")),
+			ToPort:    atoi(fieldAfter(fields, "--to-ports")),
+			Interface: fieldAfter(fields, "-i"),
+			Source:    fieldAfter(fields, "-s"),
+			Output:    fieldAfter(fields, "-o"),
+		}
+		if fieldAfter(fields, "--mode") == "random" {
+			r.Probability, _ = strconv.ParseFloat(fieldAfter(fields, "--probability"), 64)
+		}
+		if r.Name == "" || r.FromPort == 0 || r.ToPort == 0 {
+			continue
+		}
+		rules = append(rules, r)
+	}
+	return rules
+}
 
-	fromPortStr := strconv.Itoa(fromPort)
-	toPortStr := strconv.Itoa(toPort)
-	for _, line := range lines {
-		if strings.Contains(line, fromPortStr) && strings.Contains(line, toPortStr) {
-			lexes := strings.Split(line, " ")
-			num, err := strconv.Atoi(lexes[0])
-			if err != nil {
-				return 0, fmt.Errorf("failed to extract line number from '%s'", line)
+// splitRule splits the rule printed by 'iptables -S' into the arguments.
+// The comment with spaces or quotes is printed in double quotes, escaping the quotes and the backslashes inside.
+func splitRule(spec string) []string {
+	var fields []string
+	var field strings.Builder
+	var inField, quoted, escaped bool
+	for _, c := range spec {
+		switch {
+		case escaped:
+			field.WriteRune(c)
+			escaped = false
+		case quoted && c == '\\':
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+			inField = true
+		case !quoted && (c == ' ' || c == '\t'):
+			if inField {
+				fields = append(fields, field.String())
+				field.Reset()
+				inField = false
 			}
-			return num, nil
+		default:
+			field.WriteRune(c)
+			inField = true
 		}
 	}
-	return 0, ErrRuleNotFound
+	if inField {
+		fields = append(fields, field.String())
+	}
+	return fields
 }
 
-func portForwardRule(fromPort, toPort int) string {
-	return fmt.Sprintf("-o lo -p tcp --dport %d -j REDIRECT --to-port %d", fromPort, toPort)
+// legacyRule is the untagged rule the versions of Yetis before the YETIS chain appended to OUTPUT, the way 'iptables -S' prints it.
+func legacyRule(fromPort, toPort int) []string {
+	return []string{"OUTPUT", "-o", "lo", "-p", "tcp", "-m", "tcp", "--dport", strconv.Itoa(fromPort), "-j", "REDIRECT", "--to-ports", strconv.Itoa(toPort)}
+}
+
+// parseLegacyRules finds the rules of legacyRule in the output of 'iptables -S OUTPUT'.
+func parseLegacyRules(output string) []iptablesRule {
+	var rules []iptablesRule
+	for _, spec := range strings.Split(output, "\n") {
+		fields := strings.Fields(spec)
+		if len(fields) == 0 || fields[0] != "-A" {
+			continue
+		}
+		r := iptablesRule{Protocol: "tcp", Output: "lo", FromPort: atoi(fieldAfter(fields, "--dport")), ToPort: atoi(fieldAfter(fields, "--to-ports"))}
+		if slices.Equal(fields[1:], legacyRule(r.FromPort, r.ToPort)) {
+			rules = append(rules, r)
+		}
+	}
+	return rules
+}
+
+// deleteLegacyRules deletes the rules of legacyRule from the port, zero deletes them from all the ports.
+func deleteLegacyRules(bin string, fromPort int) ([]iptablesRule, error) {
+	output, err := exec.Command(bin, "-t", "nat", "-S", "OUTPUT").Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s rules: %s", bin, err)
+	}
+	var deleted []iptablesRule
+	for _, r := range parseLegacyRules(string(output)) {
+		if fromPort != 0 && r.FromPort != fromPort {
+			continue
+		}
+		err := runIptables(bin, append([]string{"-t", "nat", "-D"}, legacyRule(r.FromPort, r.ToPort)...)...)
+		if err != nil {
+			return deleted, fmt.Errorf("failed to delete legacy rule of %d port: %s", r.FromPort, err)
+		}
+		deleted = append(deleted, r)
+	}
+	return deleted, nil
+}
+
+func fieldAfter(fields []string, flag string) string {
+	idx := slices.Index(fields, flag)
+	if idx < 0 || idx+1 >= len(fields) {
+		return ""
+	}
+	return fields[idx+1]
+}
+
+func atoi(s string) int {
+	n, _ := strconv.Atoi(s)
+	return n
+}
+
+// portForwardRule takes the connections the statistic match picks of the ones the rules above it didn't take.
+func portForwardRule(match []string, protocol, name string, fromPort, toPort int, statistic []string) []string {
+	rule := append(slices.Clone(match), "-p", protocol, "--dport", strconv.Itoa(fromPort))
+	rule = append(rule, statistic...)
+	return append(rule, "-m", "comment", "--comment", name, "-j", "REDIRECT", "--to-port", strconv.Itoa(toPort))
+}
+
+// statisticMatch returns the match of the ith of n rules. Without weights each rule takes every nth connection,
+// with them the rule takes its weight of the connections left by the rules above it.
+func statisticMatch(weights []int, i, n int) []string {
+	if weights == nil {
+		if n-i > 1 {
+			return []string{"-m", "statistic", "--mode", "nth", "--every", strconv.Itoa(n - i), "--packet", "0"}
+		}
+		return nil
+	}
+	var remaining int
+	for _, w := range weights[i:] {
+		remaining += w
+	}
+	if i == n-1 || weights[i] >= remaining {
+		return nil
+	}
+	probability := float64(weights[i]) / float64(remaining)
+	return []string{"-m", "statistic", "--mode", "random", "--probability", strconv.FormatFloat(probability, 'f', 5, 64)}
+}
+
+func runIptables(bin string, args ...string) error {
+	out, err := exec.Command(bin, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
 }
@@ -7,6 +7,8 @@ import (
 	"github.com/glossd/yetis/common"
 	"net/http"
 	"os"
+	"slices"
+	"strings"
 	"testing"
 	"time"
 )
@@ -31,7 +33,7 @@ func TestPortForwarding(t *testing.T) {
 		t.Fatal("target port should be open")
 	}
 
-	err := CreatePortForwarding(port, targetPort)
+	err := SetPortForwarding(Forwarding{Name: "hello", FromPort: port, ToPorts: []int{targetPort}})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -47,7 +49,12 @@ func TestPortForwarding(t *testing.T) {
 		t.Fatal("failed to proxy to http server")
 	}
 
-	err = DeletePortForwarding(port, targetPort)
+	err = SetPortForwarding(Forwarding{Name: "other", FromPort: port, ToPorts: []int{targetPort}})
+	if err == nil {
+		t.Fatal("the port of another deployment shouldn't be forwarded")
+	}
+
+	err = SetPortForwarding(Forwarding{Name: "hello", FromPort: port})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -71,7 +78,7 @@ func TestUpdatePortForwarding(t *testing.T) {
 	go http.ListenAndServe(fmt.Sprintf(":%d", secondServerPort), mux)
 	proxyPort := common.MustGetFreePort()
 
-	err := CreatePortForwarding(proxyPort, firstServerPort)
+	err := SetPortForwarding(Forwarding{Name: "hello", FromPort: proxyPort, ToPorts: []int{firstServerPort}})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -97,7 +104,7 @@ func TestUpdatePortForwarding(t *testing.T) {
 		}()
 	}
 
-	err = UpdatePortForwarding(proxyPort, firstServerPort, secondServerPort)
+	err = SetPortForwarding(Forwarding{Name: "hello", FromPort: proxyPort, ToPorts: []int{secondServerPort}})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -106,19 +113,145 @@ func TestUpdatePortForwarding(t *testing.T) {
 	time.Sleep(100 * time.Millisecond) // let the goroutines do the work
 }
 
-func TestExtractLineNumber(t *testing.T) {
-	output := `
-Chain OUTPUT (policy ACCEPT)
-num target     prot opt  source       destination
-1   REDIRECT   tcp  --   anywhere     anywhere          tcp dpt:1024 redir ports 8080
-`
-	num, err := extractLine(output, 1024, 8080)
+func TestSetPortForwarding(t *testing.T) {
+	skipIfNotIptables(t)
+	var servers []int
+	for i := 0; i < 3; i++ {
+		port := common.MustGetFreePort()
+		servers = append(servers, port)
+		mux := &http.ServeMux{}
+		mux.HandleFunc("/hello", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Connection", "close")
+			w.Write([]byte(fmt.Sprint(port)))
+		})
+		go http.ListenAndServe(fmt.Sprintf(":%d", port), mux)
+	}
+	proxyPort := common.MustGetFreePort()
+
+	err := SetPortForwarding(Forwarding{Name: "hello", FromPort: proxyPort, ToPorts: servers})
 	if err != nil {
 		t.Fatal(err)
 	}
-	if num != 1 {
-		t.Fatal("num mismatch")
+	defer SetPortForwarding(Forwarding{Name: "hello", FromPort: proxyPort})
+	if !common.IsPortOpenRetry(proxyPort, 10*time.Millisecond, 10) {
+		t.Fatal("proxy port is closed")
+	}
+	hits := map[string]int{}
+	for i := 0; i < 30; i++ {
+		res, err := fetch.Get[string](fmt.Sprintf("http://localhost:%d/hello", proxyPort))
+		if err != nil {
+			t.Fatal(err)
+		}
+		hits[res]++
+	}
+	if len(hits) != 3 {
+		t.Errorf("expected connections to be spread across all the servers, got %v", hits)
+	}
+
+	err = SetPortForwarding(Forwarding{Name: "hello", FromPort: proxyPort, ToPorts: servers[:1]})
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := fetch.Get[string](fmt.Sprintf("http://localhost:%d/hello", proxyPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res != fmt.Sprint(servers[0]) {
+		t.Errorf("expected only the first server, got %s", res)
+	}
+}
+
+func TestParseRules(t *testing.T) {
+	output := `-N YETIS
+-A YETIS -o lo -p tcp -m tcp --dport 8080 -m statistic --mode nth --every 2 --packet 0 -m comment --comment hello -j REDIRECT --to-ports 40001
+-A YETIS -o lo -p tcp -m tcp --dport 8080 -m comment --comment hello -j REDIRECT --to-ports 40002
+-A YETIS -o lo -p tcp -m tcp --dport 80 -j REDIRECT --to-ports 8080
+-A YETIS -o lo -p tcp -m tcp --dport 18000 -m comment --comment "world" -j REDIRECT --to-ports 80
+`
+	rules := parseRules(output)
+	want := []iptablesRule{
+		{Line: 1, Name: "hello", FromPort: 8080, ToPort: 40001, Output: "lo", Protocol: "tcp"},
+		{Line: 2, Name: "hello", FromPort: 8080, ToPort: 40002, Output: "lo", Protocol: "tcp"},
+		{Line: 4, Name: "world", FromPort: 18000, ToPort: 80, Output: "lo", Protocol: "tcp"},
 	}
+	if !slices.Equal(rules, want) {
+		t.Errorf("got %v, wanted %v", rules, want)
+	}
+	grouped := groupRules(rules, false)
+	assert(t, len(grouped), 2)
+	assert(t, grouped[0].Protocol, "tcp")
+	assert(t, slices.Equal(grouped[0].ToPorts, []int{40001, 40002}), true)
+	assert(t, grouped[1].Name, "world")
+	assert(t, slices.Equal(portForwardRule([]string{"-o", "lo"}, "tcp", "hello", 8080, 40001, nil), strings.Fields("-o lo -p tcp --dport 8080 -m comment --comment hello -j REDIRECT --to-port 40001")), true)
+}
+
+func TestParseRules_QuotedComment(t *testing.T) {
+	output := `-A YETIS -o lo -p tcp -m tcp --dport 8080 -m comment --comment "my app" -j REDIRECT --to-ports 40001
+-A YETIS -o lo -p tcp -m tcp --dport 8081 -m comment --comment "say \"hi\" \\o/" -j REDIRECT --to-ports 40002
+`
+	rules := parseRules(output)
+	assert(t, len(rules), 2)
+	assert(t, rules[0].Name, "my app")
+	assert(t, rules[0].ToPort, 40001)
+	assert(t, rules[1].Name, `say "hi" \o/`)
+	assert(t, rules[1].ToPort, 40002)
+}
+
+func TestParseRules_Weights(t *testing.T) {
+	output := `-N YETIS
+-A YETIS -o lo -p tcp -m tcp --dport 8080 -m statistic --mode random --probability 0.70000000019 -m comment --comment hello -j REDIRECT --to-ports 40001
+-A YETIS -o lo -p tcp -m tcp --dport 8080 -m statistic --mode random --probability 0.66666666651 -m comment --comment hello -j REDIRECT --to-ports 40002
+-A YETIS -o lo -p tcp -m tcp --dport 8080 -m comment --comment hello -j REDIRECT --to-ports 40003
+`
+	grouped := groupRules(parseRules(output), false)
+	assert(t, len(grouped), 1)
+	assert(t, slices.Equal(grouped[0].ToPorts, []int{40001, 40002, 40003}), true)
+	assert(t, slices.Equal(grouped[0].Weights, []int{70, 20, 10}), true)
+
+	weights := []int{70, 20, 10}
+	assert(t, slices.Equal(statisticMatch(weights, 0, 3), strings.Fields("-m statistic --mode random --probability 0.70000")), true)
+	assert(t, slices.Equal(statisticMatch(weights, 1, 3), strings.Fields("-m statistic --mode random --probability 0.66667")), true)
+	assert(t, len(statisticMatch(weights, 2, 3)), 0)
+	assert(t, slices.Equal(statisticMatch(nil, 0, 3), strings.Fields("-m statistic --mode nth --every 3 --packet 0")), true)
+}
+
+func TestParseRules_Expose(t *testing.T) {
+	output := `-N YETIS-EXPOSE
+-A YETIS-EXPOSE -s 10.0.0.0/8 -i eth0 -p tcp -m tcp --dport 8080 -m comment --comment hello -j REDIRECT --to-ports 40001
+`
+	rules := parseRules(output)
+	assert(t, len(rules), 1)
+	match := exposeMatch(Expose{Interface: "eth0", Source: "10.1.2.3/8"})
+	assert(t, slices.Equal(rules[0].match(iptablesExposeChain), match), true)
+	grouped := groupRules(rules, true)
+	assert(t, *grouped[0].Expose, Expose{Interface: "eth0", Source: "10.0.0.0/8"})
+	assert(t, slices.Equal(portForwardRule(match, "udp", "hello", 8080, 40001, nil), strings.Fields("-i eth0 -s 10.0.0.0/8 -p udp --dport 8080 -m comment --comment hello -j REDIRECT --to-port 40001")), true)
+}
+
+func TestParseLegacyRules(t *testing.T) {
+	output := `-P OUTPUT ACCEPT
+-A OUTPUT -o lo -p tcp -m tcp --dport 8080 -j REDIRECT --to-ports 40001
+-A OUTPUT -j YETIS
+-A OUTPUT -o lo -p tcp -m tcp --dport 9090 -m comment --comment other -j REDIRECT --to-ports 40002
+-A OUTPUT -o eth0 -p tcp -m tcp --dport 9091 -j REDIRECT --to-ports 40003
+`
+	rules := parseLegacyRules(output)
+	assert(t, len(rules), 1)
+	assert(t, rules[0].FromPort, 8080)
+	assert(t, rules[0].ToPort, 40001)
+}
+
+func TestMergeProtocols(t *testing.T) {
+	merged := mergeProtocols([]Forwarding{
+		{Name: "dns", FromPort: 53, ToPorts: []int{40001}, Protocol: "tcp"},
+		{Name: "dns", FromPort: 53, ToPorts: []int{40001}, Protocol: "udp"},
+		{Name: "metrics", FromPort: 8125, ToPorts: []int{40002}, Protocol: "udp"},
+	})
+	assert(t, len(merged), 2)
+	assert(t, merged[0].Protocol, "both")
+	assert(t, merged[1].Protocol, "udp")
+	assert(t, merged[0].Equal(Forwarding{Name: "dns", FromPort: 53, ToPorts: []int{40001}, Protocol: "both"}), true)
+	assert(t, merged[1].Equal(Forwarding{Name: "metrics", FromPort: 8125, ToPorts: []int{40002}}), false)
 }
 
 func skipIfNotIptables(t *testing.T) {
@@ -126,3 +259,10 @@ func skipIfNotIptables(t *testing.T) {
 		t.SkipNow()
 	}
 }
+
+func assert[T comparable](t *testing.T, got, want T) {
+	t.Helper()
+	if got != want {
+		t.Fatalf("got %v, wanted %v", got, want)
+	}
+}
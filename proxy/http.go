@@ -0,0 +1,287 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/glossd/yetis/common"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Route sends the HTTP requests of the host and the path prefix to ToPorts in round-robin.
+type Route struct {
+	// The deployment owning the route.
+	Name string
+	// Empty matches any host.
+	Host string
+	Path string
+	// Empty ToPorts responds with the error page.
+	ToPorts []int
+}
+
+func (r Route) Equal(o Route) bool {
+	return r.Name == o.Name && r.sameMatch(o) && slices.Equal(r.ToPorts, o.ToPorts)
+}
+
+func (r Route) sameMatch(o Route) bool {
+	return strings.EqualFold(r.Host, o.Host) && r.Path == o.Path
+}
+
+// matches tells if the request is for the host and the path is within the prefix, e.g. /api matches /api and /api/users, but not /apis.
+func (r Route) matches(host, path string) bool {
+	if r.Host != "" && !strings.EqualFold(r.Host, host) {
+		return false
+	}
+	return path == r.Path || strings.HasPrefix(path, strings.TrimSuffix(r.Path, "/")+"/")
+}
+
+const defaultErrorPage = "<html><body><h1>503 Service Unavailable</h1><p>No healthy backend is available.</p></body></html>\n"
+
+// HttpProxy is the HTTP listener of Yetis routing the requests to the deployments by the host and the path.
+type HttpProxy struct {
+	lock sync.RWMutex
+	// Sorted by the longest path, the routes of a host before the ones of any host.
+	routes    []*httpRoute
+	errorPage []byte
+	accessLog *log.Logger
+	proxy     *httputil.ReverseProxy
+	transport *http.Transport
+	server    *http.Server
+}
+
+type httpRoute struct {
+	Route
+	next atomic.Uint64
+}
+
+type routeKey struct{}
+
+// NewHttpProxy returns the proxy responding with the error page when the route has no backend. Nil errorPage is the default one.
+func NewHttpProxy(errorPage []byte, accessLog io.Writer) *HttpProxy {
+	if errorPage == nil {
+		errorPage = []byte(defaultErrorPage)
+	}
+	p := &HttpProxy{errorPage: errorPage, accessLog: log.New(accessLog, "", log.LstdFlags)}
+	p.transport = &http.Transport{
+		DialContext:         dialBackendContext,
+		MaxIdleConnsPerHost: 32,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	p.proxy = &httputil.ReverseProxy{
+		Rewrite: func(r *httputil.ProxyRequest) {
+			port := r.In.Context().Value(routeKey{}).(int)
+			r.SetURL(newBackendURL(port))
+			r.SetXForwarded()
+			r.Out.Host = r.In.Host
+		},
+		Transport: p.transport,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Printf("HTTP proxy failed to reach %s: %s\n", r.URL.Host, err)
+			p.writeErrorPage(w)
+		},
+	}
+	return p
+}
+
+// SetRoute adds or updates the route of the deployment. The host and the path of another deployment is an error.
+// The idle connections are closed when a backend is taken out, so that they don't keep it from draining.
+func (p *HttpProxy) SetRoute(r Route) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, o := range p.routes {
+		if o.Name != r.Name && o.sameMatch(r) {
+			return fmt.Errorf("route %s%s is already used by '%s'", r.Host, r.Path, o.Name)
+		}
+	}
+	r.ToPorts = slices.Clone(r.ToPorts)
+	idx := slices.IndexFunc(p.routes, func(o *httpRoute) bool { return o.Name == r.Name })
+	if idx >= 0 {
+		if slices.ContainsFunc(p.routes[idx].ToPorts, func(port int) bool { return !slices.Contains(r.ToPorts, port) }) {
+			defer p.transport.CloseIdleConnections()
+		}
+		p.routes[idx].Route = r
+	} else {
+		p.routes = append(p.routes, &httpRoute{Route: r})
+	}
+	slices.SortStableFunc(p.routes, func(a, b *httpRoute) int {
+		if len(a.Path) != len(b.Path) {
+			return len(b.Path) - len(a.Path)
+		}
+		if (a.Host == "") != (b.Host == "") {
+			if a.Host == "" {
+				return 1
+			}
+			return -1
+		}
+		return strings.Compare(a.Name, b.Name)
+	})
+	return nil
+}
+
+// DeleteRoute deletes the route of the deployment, its requests get 404.
+func (p *HttpProxy) DeleteRoute(name string) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.routes = slices.DeleteFunc(p.routes, func(r *httpRoute) bool { return r.Name == name })
+	p.transport.CloseIdleConnections()
+}
+
+func (p *HttpProxy) Routes() []Route {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	var res []Route
+	for _, r := range p.routes {
+		res = append(res, r.Route)
+	}
+	return res
+}
+
+// match returns the route of the request and the port of the backend picked in round-robin, zero if the route has no backend.
+func (p *HttpProxy) match(req *http.Request) (string, int, bool) {
+	host, _, err := net.SplitHostPort(req.Host)
+	if err != nil {
+		host = req.Host
+	}
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+	for _, r := range p.routes {
+		if !r.matches(host, req.URL.Path) {
+			continue
+		}
+		if len(r.ToPorts) == 0 {
+			return r.Name, 0, true
+		}
+		return r.Name, r.ToPorts[int(r.next.Add(1))%len(r.ToPorts)], true
+	}
+	return "", 0, false
+}
+
+func (p *HttpProxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	start := time.Now()
+	rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	name, port, ok := p.match(req)
+	switch {
+	case !ok:
+		http.NotFound(rec, req)
+	case port == 0:
+		p.writeErrorPage(rec)
+	default:
+		p.proxy.ServeHTTP(rec, req.WithContext(context.WithValue(req.Context(), routeKey{}, port)))
+	}
+	if name == "" {
+		name = "-"
+	}
+	p.accessLog.Printf("%s %s \"%s %s %s\" %d %d %s %s\n", remoteHost(req), req.Host, req.Method, req.URL.RequestURI(), req.Proto, rec.status, rec.size, time.Since(start).Round(time.Millisecond), name)
+}
+
+func (p *HttpProxy) writeErrorPage(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	_, _ = w.Write(p.errorPage)
+}
+
+// Listen starts serving the port on all the addresses. Non-blocking.
+func (p *HttpProxy) Listen(port int) error {
+	l, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+	if err != nil {
+		return fmt.Errorf("failed to listen on %d port: %s", port, err)
+	}
+	p.server = &http.Server{Handler: p, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		err := p.server.Serve(l)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("HTTP proxy stopped: %s\n", err)
+		}
+	}()
+	return nil
+}
+
+// Shutdown waits for the requests in flight until the context is done.
+func (p *HttpProxy) Shutdown(ctx context.Context) error {
+	if p.server == nil {
+		return nil
+	}
+	return p.server.Shutdown(ctx)
+}
+
+// The host of the URL is only for the logs, the backend is dialed on the loopback by dialBackendContext.
+func newBackendURL(port int) *url.URL {
+	return &url.URL{Scheme: "http", Host: net.JoinHostPort("localhost", strconv.Itoa(port))}
+}
+
+// dialBackendContext connects to the port on the loopback of IPv4, then of IPv6, whatever the host is.
+func dialBackendContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	d := net.Dialer{Timeout: backendDialTimeout}
+	for _, host := range common.LoopbackHosts {
+		var conn net.Conn
+		conn, err = d.DialContext(ctx, network, net.JoinHostPort(host, port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+func remoteHost(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// statusRecorder keeps the status and the size of the response for the access log.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(b)
+	r.size += n
+	return n, err
+}
+
+// Flush lets the streamed responses through.
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack lets the upgraded connections, e.g. websockets, through.
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("%T doesn't support hijacking", r.ResponseWriter)
+	}
+	r.status = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
+
+// Unwrap lets http.ResponseController reach the original writer.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -0,0 +1,175 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/glossd/yetis/common"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHttpProxy(t *testing.T) {
+	var servers []int
+	for i := 0; i < 3; i++ {
+		port := common.MustGetFreePort()
+		servers = append(servers, port)
+		go http.ListenAndServe(fmt.Sprintf(":%d", port), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(strconv.Itoa(port) + " " + r.Host + r.URL.Path))
+		}))
+	}
+	if !common.IsPortOpenRetry(servers[2], 10*time.Millisecond, 10) {
+		t.Fatal("server hasn't started")
+	}
+
+	var accessLog bytes.Buffer
+	p := NewHttpProxy([]byte("down"), &accessLog)
+	mustSet := func(r Route) {
+		t.Helper()
+		if err := p.SetRoute(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mustSet(Route{Name: "web", Path: "/", ToPorts: servers[:2]})
+	mustSet(Route{Name: "api", Host: "api.example.com", Path: "/v1", ToPorts: servers[2:]})
+	mustSet(Route{Name: "docs", Path: "/docs"})
+
+	get := func(host, path string) (int, string) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "http://"+host+path, nil)
+		w := httptest.NewRecorder()
+		p.ServeHTTP(w, req)
+		body, _ := io.ReadAll(w.Result().Body)
+		return w.Code, string(body)
+	}
+
+	hits := map[string]int{}
+	for i := 0; i < 4; i++ {
+		code, body := get("example.com", "/hello")
+		if code != http.StatusOK {
+			t.Fatalf("expected 200, got %d %s", code, body)
+		}
+		hits[strings.Fields(body)[0]]++
+	}
+	if hits[strconv.Itoa(servers[0])] != 2 || hits[strconv.Itoa(servers[1])] != 2 {
+		t.Errorf("expected round-robin, got %v", hits)
+	}
+
+	code, body := get("api.example.com:8000", "/v1/users")
+	assert(t, code, http.StatusOK)
+	// the host is passed to the backend
+	assert(t, body, strconv.Itoa(servers[2])+" api.example.com:8000/v1/users")
+	// not within the prefix
+	_, body = get("api.example.com", "/v10")
+	if strings.HasPrefix(body, strconv.Itoa(servers[2])) {
+		t.Errorf("/v10 shouldn't match /v1 route")
+	}
+
+	code, body = get("example.com", "/docs/intro")
+	assert(t, code, http.StatusServiceUnavailable)
+	assert(t, body, "down")
+
+	err := p.SetRoute(Route{Name: "other", Host: "API.example.com", Path: "/v1"})
+	if err == nil {
+		t.Error("the route of another deployment shouldn't be taken")
+	}
+
+	p.DeleteRoute("web")
+	code, _ = get("example.com", "/hello")
+	assert(t, code, http.StatusNotFound)
+
+	// the backend is down
+	mustSet(Route{Name: "docs", Path: "/docs", ToPorts: []int{common.MustGetFreePort()}})
+	code, _ = get("example.com", "/docs")
+	assert(t, code, http.StatusServiceUnavailable)
+
+	if !strings.Contains(accessLog.String(), `"GET /v1/users HTTP/1.1" 200`) || !strings.Contains(accessLog.String(), "api\n") {
+		t.Errorf("access log is missing the request: %s", accessLog.String())
+	}
+}
+
+func TestHttpProxy_Upgrade(t *testing.T) {
+	backendPort := common.MustGetFreePort()
+	go http.ListenAndServe(fmt.Sprintf(":%d", backendPort), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n")
+		rw.Flush()
+		line, _ := rw.ReadString('\n')
+		rw.WriteString(line)
+		rw.Flush()
+	}))
+	if !common.IsPortOpenRetry(backendPort, 10*time.Millisecond, 10) {
+		t.Fatal("server hasn't started")
+	}
+	p := NewHttpProxy(nil, io.Discard)
+	if err := p.SetRoute(Route{Name: "ws", Path: "/", ToPorts: []int{backendPort}}); err != nil {
+		t.Fatal(err)
+	}
+	proxyPort := common.MustGetFreePort()
+	if err := p.Listen(proxyPort); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown(context.Background())
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", proxyPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprint(conn, "GET /ws HTTP/1.1\r\nHost: example.com\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n")
+	r := bufio.NewReader(conn)
+	res, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert(t, res.StatusCode, http.StatusSwitchingProtocols)
+	fmt.Fprint(conn, "ping\n")
+	line, err := r.ReadString('\n')
+	assert(t, err, nil)
+	assert(t, line, "ping\n")
+}
+
+func TestHttpProxy_CloseIdleOnRouteChange(t *testing.T) {
+	closed := make(chan bool, 1)
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	backend.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			closed <- true
+		}
+	}
+	backend.Start()
+	defer backend.Close()
+	backendPort := backend.Listener.Addr().(*net.TCPAddr).Port
+
+	p := NewHttpProxy(nil, io.Discard)
+	if err := p.SetRoute(Route{Name: "web", Path: "/", ToPorts: []int{backendPort}}); err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://example.com/", nil))
+	assert(t, w.Code, http.StatusOK)
+
+	// the backend is taken out, its idle keep-alive connection is closed.
+	if err := p.SetRoute(Route{Name: "web", Path: "/"}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Error("expected the idle connection to the old backend to be closed")
+	}
+}
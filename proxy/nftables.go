@@ -0,0 +1,324 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// Yetis owns the table, the rules of other tools are never touched.
+// The output chain forwards the connections from the host, the prerouting one the exposed connections from the network.
+// The inet table handles both IPv4 and IPv6.
+const (
+	nftFamily      = "inet"
+	nftTable       = "yetis"
+	nftChain       = "output"
+	nftExposeChain = "prerouting"
+)
+
+const nftSetup = "add table " + nftFamily + " " + nftTable + "\n" +
+	"add chain " + nftFamily + " " + nftTable + " " + nftChain + " { type nat hook output priority -100 ; }\n" +
+	"add chain " + nftFamily + " " + nftTable + " " + nftExposeChain + " { type nat hook prerouting priority -100 ; }\n"
+
+type nftables struct{}
+
+func (nftables) Name() string { return "nftables" }
+
+// SetPortForwarding keeps one rule per port and protocol in each chain, all of them are replaced atomically in one script.
+func (nftables) SetPortForwarding(f Forwarding) error {
+	// the name is quoted in the comment of the rule.
+	if strings.ContainsAny(f.Name, "\"\\\n\r") {
+		return fmt.Errorf("nft can't quote the name '%s' in the comment", f.Name)
+	}
+	var script string
+	for _, protocol := range protocols {
+		s, err := nftChainScript(nftChain, f.Name, protocol, f.FromPort, f.toPortsOf(protocol), f.Weights, `oif "lo" `)
+		if err != nil {
+			return err
+		}
+		var exposedPorts []int
+		var match string
+		if f.Expose != nil {
+			exposedPorts = f.toPortsOf(protocol)
+			match = nftExposeMatch(*f.Expose)
+		}
+		exposeScript, err := nftChainScript(nftExposeChain, f.Name, protocol, f.FromPort, exposedPorts, f.Weights, match)
+		if err != nil {
+			return err
+		}
+		script += s + exposeScript
+	}
+	if script == "" {
+		return nil
+	}
+	return runNft(nftSetup + script)
+}
+
+// nftChainScript returns the command adding, replacing or deleting the rule of the port in the chain.
+func nftChainScript(chain, name, protocol string, fromPort int, toPorts, weights []int, match string) (string, error) {
+	rule, found, err := findNftRule(chain, name, protocol, fromPort)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case len(toPorts) == 0 && !found:
+		return "", nil
+	case len(toPorts) == 0:
+		return fmt.Sprintf("delete rule %s %s %s handle %d\n", nftFamily, nftTable, chain, rule.Handle), nil
+	case found:
+		return fmt.Sprintf("replace rule %s %s %s handle %d %s\n", nftFamily, nftTable, chain, rule.Handle, match+nftRule(name, protocol, fromPort, toPorts, weights)), nil
+	default:
+		return fmt.Sprintf("add rule %s %s %s %s\n", nftFamily, nftTable, chain, match+nftRule(name, protocol, fromPort, toPorts, weights)), nil
+	}
+}
+
+func nftExposeMatch(e Expose) string {
+	var match string
+	if e.Interface != "" {
+		match += fmt.Sprintf(`iifname "%s" `, e.Interface)
+	}
+	if e.Source != "" {
+		family := "ip"
+		if isIPv6CIDR(e.Source) {
+			family = "ip6"
+		}
+		match += fmt.Sprintf("%s saddr %s ", family, normalizeCIDR(e.Source))
+	}
+	return match
+}
+
+// The comment of the rule is the name of the deployment.
+// The weights map the ranges of a random number out of 100 to the ports.
+func nftRule(name, protocol string, fromPort int, toPorts, weights []int) string {
+	to := strconv.Itoa(toPorts[0])
+	if weights != nil {
+		var elems []string
+		var from int
+		for i, p := range toPorts {
+			elems = append(elems, fmt.Sprintf("%d-%d : %d", from, from+weights[i]-1, p))
+			from += weights[i]
+		}
+		to = fmt.Sprintf("numgen random mod 100 map { %s }", strings.Join(elems, ", "))
+	} else if len(toPorts) > 1 {
+		var elems []string
+		for i, p := range toPorts {
+			elems = append(elems, fmt.Sprintf("%d : %d", i, p))
+		}
+		to = fmt.Sprintf("numgen inc mod %d map { %s }", len(toPorts), strings.Join(elems, ", "))
+	}
+	return fmt.Sprintf(`%s dport %d redirect to : %s comment "%s"`, protocol, fromPort, to, name)
+}
+
+func (nftables) List() ([]Forwarding, error) {
+	var res []Forwarding
+	for _, chain := range []string{nftChain, nftExposeChain} {
+		out, err := exec.Command("nft", "-j", "-a", "list", "chain", nftFamily, nftTable, chain).Output()
+		if err != nil {
+			// no table, no rules
+			continue
+		}
+		rules, err := parseNftRules(out)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range rules {
+			if r.Comment == "" || r.dport() == 0 {
+				continue
+			}
+			ports, weights := r.toPorts()
+			f := Forwarding{Name: r.Comment, FromPort: r.dport(), ToPorts: ports, Weights: weights, Protocol: r.protocol()}
+			if chain == nftChain {
+				res = append(res, f)
+				continue
+			}
+			f.Expose = r.expose()
+			res = mergeExposed(res, f)
+		}
+	}
+	return mergeProtocols(res), nil
+}
+
+type nftRuleInfo struct {
+	Handle  int
+	Comment string
+	Expr    []struct {
+		Match *struct {
+			Left struct {
+				Payload *struct {
+					Protocol string
+					Field    string
+				}
+				Meta *struct {
+					Key string
+				}
+			}
+			Right json.RawMessage
+		}
+		Redirect *struct {
+			Port json.RawMessage
+		}
+	}
+}
+
+// toPorts returns the ports the rule redirects to, either one port or the map of numgen.
+// The weights are the sizes of the ranges of the map, nil if it maps single numbers.
+func (r nftRuleInfo) toPorts() (ports, weights []int) {
+	for _, e := range r.Expr {
+		if e.Redirect == nil {
+			continue
+		}
+		var port int
+		if json.Unmarshal(e.Redirect.Port, &port) == nil {
+			return []int{port}, nil
+		}
+		var m struct {
+			Map struct {
+				Data struct {
+					Set [][2]json.RawMessage
+				}
+			}
+		}
+		if json.Unmarshal(e.Redirect.Port, &m) != nil {
+			return nil, nil
+		}
+		var ranged bool
+		for _, elem := range m.Map.Data.Set {
+			var port int
+			if json.Unmarshal(elem[1], &port) != nil {
+				return nil, nil
+			}
+			ports = append(ports, port)
+			var key struct {
+				Range *[2]int
+			}
+			if json.Unmarshal(elem[0], &key) == nil && key.Range != nil {
+				weights = append(weights, key.Range[1]-key.Range[0]+1)
+				ranged = true
+			} else {
+				// nft prints the range of one number as the number.
+				weights = append(weights, 1)
+			}
+		}
+		if !ranged {
+			weights = nil
+		}
+		return ports, weights
+	}
+	return nil, nil
+}
+
+// expose returns the interface and the source the rule matches.
+func (r nftRuleInfo) expose() *Expose {
+	e := &Expose{}
+	for _, m := range r.Expr {
+		switch {
+		case m.Match == nil:
+		case m.Match.Left.Meta != nil && m.Match.Left.Meta.Key == "iifname":
+			_ = json.Unmarshal(m.Match.Right, &e.Interface)
+		case m.Match.Left.Payload != nil && m.Match.Left.Payload.Field == "saddr":
+			var prefix struct {
+				Prefix struct {
+					Addr string
+					Len  int
+				}
+			}
+			if json.Unmarshal(m.Match.Right, &prefix) == nil {
+				e.Source = fmt.Sprintf("%s/%d", prefix.Prefix.Addr, prefix.Prefix.Len)
+			} else if json.Unmarshal(m.Match.Right, &e.Source) == nil {
+				// nft prints a single address without the prefix.
+				if strings.Contains(e.Source, ":") {
+					e.Source += "/128"
+				} else {
+					e.Source += "/32"
+				}
+			}
+		}
+	}
+	return e
+}
+
+// protocol returns the protocol of the destination port the rule matches.
+func (r nftRuleInfo) protocol() string {
+	for _, e := range r.Expr {
+		if e.Match != nil && e.Match.Left.Payload != nil && e.Match.Left.Payload.Field == "dport" {
+			return e.Match.Left.Payload.Protocol
+		}
+	}
+	return ""
+}
+
+// dport returns the destination port the rule matches.
+func (r nftRuleInfo) dport() int {
+	for _, e := range r.Expr {
+		if e.Match == nil || e.Match.Left.Payload == nil || e.Match.Left.Payload.Field != "dport" {
+			continue
+		}
+		var port int
+		if json.Unmarshal(e.Match.Right, &port) == nil {
+			return port
+		}
+	}
+	return 0
+}
+
+func findNftRule(chain, name, protocol string, fromPort int) (nftRuleInfo, bool, error) {
+	out, err := exec.Command("nft", "-j", "-a", "list", "chain", nftFamily, nftTable, chain).Output()
+	if err != nil {
+		// the table hasn't been created yet.
+		return nftRuleInfo{}, false, nil
+	}
+	return extractNftRule(out, name, protocol, fromPort)
+}
+
+// extractNftRule returns the rule of the port and protocol. The port of another deployment is an error, whatever the protocol.
+func extractNftRule(listJson []byte, name, protocol string, fromPort int) (nftRuleInfo, bool, error) {
+	rules, err := parseNftRules(listJson)
+	if err != nil {
+		return nftRuleInfo{}, false, err
+	}
+	var rule nftRuleInfo
+	var found bool
+	for _, r := range rules {
+		if r.dport() != fromPort {
+			continue
+		}
+		if r.Comment != name {
+			return nftRuleInfo{}, false, fmt.Errorf("port %d is already forwarded by '%s'", fromPort, r.Comment)
+		}
+		if r.protocol() == protocol {
+			rule, found = r, true
+		}
+	}
+	return rule, found, nil
+}
+
+func parseNftRules(listJson []byte) ([]nftRuleInfo, error) {
+	var list struct {
+		Nftables []struct {
+			Rule *nftRuleInfo
+		}
+	}
+	err := json.Unmarshal(listJson, &list)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse nft output: %s", err)
+	}
+	var rules []nftRuleInfo
+	for _, obj := range list.Nftables {
+		if obj.Rule != nil {
+			rules = append(rules, *obj.Rule)
+		}
+	}
+	return rules, nil
+}
+
+func runNft(script string) error {
+	cmd := exec.Command("nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(script)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("nft failed: %s: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
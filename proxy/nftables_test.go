@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+)
+
+func TestNftRule(t *testing.T) {
+	got := nftRule("go", "tcp", 27000, []int{40001}, nil)
+	want := `tcp dport 27000 redirect to : 40001 comment "go"`
+	if got != want {
+		t.Errorf("got %s, wanted %s", got, want)
+	}
+	got = nftRule("go", "udp", 27000, []int{40001, 40002}, nil)
+	want = `udp dport 27000 redirect to : numgen inc mod 2 map { 0 : 40001, 1 : 40002 } comment "go"`
+	if got != want {
+		t.Errorf("got %s, wanted %s", got, want)
+	}
+	got = nftRule("go", "tcp", 27000, []int{40001, 40002}, []int{90, 10})
+	want = `tcp dport 27000 redirect to : numgen random mod 100 map { 0-89 : 40001, 90-99 : 40002 } comment "go"`
+	if got != want {
+		t.Errorf("got %s, wanted %s", got, want)
+	}
+}
+
+func TestNftSetPortForwarding_UnquotableName(t *testing.T) {
+	err := nftables{}.SetPortForwarding(Forwarding{Name: "a\"; flush ruleset; \"", FromPort: 1234, ToPorts: []int{4001}})
+	if err == nil {
+		t.Error("expected the name with a quote to be rejected before running nft")
+	}
+}
+
+func TestNftExpose(t *testing.T) {
+	got := nftExposeMatch(Expose{Interface: "eth0", Source: "10.1.2.3/8"})
+	want := `iifname "eth0" ip saddr 10.0.0.0/8 `
+	if got != want {
+		t.Errorf("got %s, wanted %s", got, want)
+	}
+	got = nftExposeMatch(Expose{Source: "fd00::1/8"})
+	want = `ip6 saddr fd00::/8 `
+	if got != want {
+		t.Errorf("got %s, wanted %s", got, want)
+	}
+	out := `{"nftables": [{"rule": {"family": "inet", "table": "yetis", "chain": "prerouting", "handle": 4, "comment": "hello", "expr": [
+{"match": {"op": "==", "left": {"meta": {"key": "iifname"}}, "right": "eth0"}},
+{"match": {"op": "==", "left": {"payload": {"protocol": "ip", "field": "saddr"}}, "right": {"prefix": {"addr": "10.0.0.0", "len": 8}}}}]}}]}`
+	rules, err := parseNftRules([]byte(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := rules[0].expose(); *e != (Expose{Interface: "eth0", Source: "10.0.0.0/8"}) {
+		t.Errorf("wrong expose %+v", e)
+	}
+}
+
+func TestExtractNftRule(t *testing.T) {
+	dport := func(port int) string {
+		return fmt.Sprintf(`[{"match": {"op": "==", "left": {"meta": {"key": "oif"}}, "right": "lo"}}, {"match": {"op": "==", "left": {"payload": {"protocol": "tcp", "field": "dport"}}, "right": %d}}]`, port)
+	}
+	out := `{"nftables": [{"metainfo": {"version": "1.0.9", "json_schema_version": 1}},
+{"chain": {"family": "inet", "table": "yetis", "name": "output", "handle": 1, "type": "nat", "hook": "output", "prio": -100, "policy": "accept"}},
+{"rule": {"family": "inet", "table": "yetis", "chain": "output", "handle": 4, "comment": "hello", "expr": ` + dport(2700) + `}},
+{"rule": {"family": "inet", "table": "yetis", "chain": "output", "handle": 7, "comment": "go", "expr": ` + dport(27000) + `}}]}`
+	rule, found, err := extractNftRule([]byte(out), "go", "tcp", 27000)
+	if err != nil || !found || rule.Handle != 7 || rule.Comment != "go" {
+		t.Errorf("expected rule with handle 7, got %+v, %t, %v", rule, found, err)
+	}
+	_, found, _ = extractNftRule([]byte(out), "go", "udp", 27000)
+	if found {
+		t.Errorf("expected not to find the udp rule")
+	}
+	_, found, _ = extractNftRule([]byte(out), "go", "tcp", 270)
+	if found {
+		t.Errorf("expected not to find the rule")
+	}
+	_, _, err = extractNftRule([]byte(out), "other", "udp", 27000)
+	if err == nil {
+		t.Errorf("the port of another deployment shouldn't be found")
+	}
+}
+
+func TestNftRuleToPorts(t *testing.T) {
+	out := `{"nftables": [{"rule": {"family": "inet", "table": "yetis", "chain": "output", "handle": 4, "comment": "hello", "expr": [{"redirect": {"port": 40001}}]}},
+{"rule": {"family": "inet", "table": "yetis", "chain": "output", "handle": 7, "comment": "go", "expr": [{"redirect": {"port": {"map": {"key": {"numgen": {"mode": "inc", "mod": 2, "offset": 0}}, "data": {"set": [[0, 40001], [1, 40002]]}}}}}]}}]}`
+	rules, err := parseNftRules([]byte(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 2 {
+		t.Fatalf("wrong rules %+v", rules)
+	}
+	ports, weights := rules[0].toPorts()
+	if !slices.Equal(ports, []int{40001}) || weights != nil {
+		t.Errorf("wrong ports %v, weights %v", ports, weights)
+	}
+	ports, weights = rules[1].toPorts()
+	if !slices.Equal(ports, []int{40001, 40002}) || weights != nil {
+		t.Errorf("wrong ports %v, weights %v", ports, weights)
+	}
+}
+
+func TestNftRuleToPorts_Weights(t *testing.T) {
+	out := `{"nftables": [{"rule": {"family": "inet", "table": "yetis", "chain": "output", "handle": 7, "comment": "go", "expr": [{"redirect": {"port": {"map": {"key": {"numgen": {"mode": "random", "mod": 100, "offset": 0}}, "data": {"set": [[{"range": [0, 98]}, 40001], [99, 40002]]}}}}}]}}]}`
+	rules, err := parseNftRules([]byte(out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ports, weights := rules[0].toPorts()
+	if !slices.Equal(ports, []int{40001, 40002}) || !slices.Equal(weights, []int{99, 1}) {
+		t.Errorf("wrong ports %v, weights %v", ports, weights)
+	}
+}
@@ -0,0 +1,318 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/glossd/yetis/common"
+	"io"
+	"log"
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The userspace proxy doesn't need root, Yetis listens on the port itself.
+
+var userspaceLock sync.Mutex
+
+// listening port -> proxy
+var userspaceProxies = map[int]*userspaceProxy{}
+
+const backendDialTimeout = time.Second
+
+// The client must finish the TLS handshake in time, the backend isn't dialed before.
+var tlsHandshakeTimeout = 10 * time.Second
+
+type userspaceProxy struct {
+	// The deployment owning the port.
+	name     string
+	protocol string
+	// On the loopback of both IPv4 and IPv6, or on all the addresses if exposed.
+	listeners   []net.Listener
+	packetConns []net.PacketConn
+	targets     atomic.Pointer[userspaceTargets]
+	next        atomic.Uint64
+	// nil accepts only the connections from the host.
+	expose *Expose
+	// The addresses of the exposed interface.
+	interfaceAddrs []net.IP
+	source         *net.IPNet
+	// nil forwards the connections as they are.
+	tls *TLS
+}
+
+// userspaceTargets are the ports with their weights, switched together.
+type userspaceTargets struct {
+	ports   []int
+	weights []int
+}
+
+// SetUserspaceForwarding listens on FromPort and splices each connection to one of ToPorts in round-robin, or by Weights if they're set.
+// UDP datagrams are relayed by the client address, see serveUDP.
+// The ports are switched atomically, the established connections stay with their backend.
+// TLS is terminated with the certificate reloaded on changes of the files.
+// Changing Expose, Protocol or TLS reopens the listener. Empty ToPorts closes the listener.
+func SetUserspaceForwarding(f Forwarding) error {
+	userspaceLock.Lock()
+	defer userspaceLock.Unlock()
+	p, ok := userspaceProxies[f.FromPort]
+	if ok && p.name != f.Name {
+		return fmt.Errorf("port %d is already forwarded by '%s'", f.FromPort, p.name)
+	}
+	if ok && (len(f.ToPorts) == 0 || !sameListeners(p.forwarding(), f)) {
+		delete(userspaceProxies, f.FromPort)
+		err := p.close()
+		if err != nil {
+			return err
+		}
+		ok = false
+	}
+	if len(f.ToPorts) == 0 {
+		return nil
+	}
+	if !ok {
+		var err error
+		p, err = listenUserspace(f)
+		if err != nil {
+			return err
+		}
+		userspaceProxies[f.FromPort] = p
+		for _, l := range p.listeners {
+			go p.serve(l)
+		}
+		for _, c := range p.packetConns {
+			go p.serveUDP(c)
+		}
+	}
+	p.targets.Store(&userspaceTargets{ports: slices.Clone(f.ToPorts), weights: slices.Clone(f.Weights)})
+	return nil
+}
+
+// listenUserspace listens on the loopback of both IPv4 and IPv6, or on all the addresses if the forwarding is exposed.
+// The IPv6 loopback is skipped if the host doesn't have it.
+func listenUserspace(f Forwarding) (*userspaceProxy, error) {
+	p := &userspaceProxy{name: f.Name, protocol: f.Protocol, expose: f.Expose, tls: f.TLS}
+	var tlsConfig *tls.Config
+	if f.TLS != nil {
+		certs, err := newCertReloader(*f.TLS)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig = &tls.Config{GetCertificate: certs.getCertificate}
+	}
+	hosts := common.LoopbackHosts
+	// UDP doesn't know the local address of a datagram on all the addresses, it listens on the addresses of the interface instead.
+	udpHosts := common.LoopbackHosts
+	if f.Expose != nil {
+		hosts = []string{""}
+		udpHosts = []string{""}
+		if f.Expose.Interface != "" {
+			iface, err := net.InterfaceByName(f.Expose.Interface)
+			if err != nil {
+				return nil, fmt.Errorf("failed to find %s interface: %s", f.Expose.Interface, err)
+			}
+			addrs, err := iface.Addrs()
+			if err != nil {
+				return nil, fmt.Errorf("failed to get addresses of %s interface: %s", f.Expose.Interface, err)
+			}
+			udpHosts = slices.Clone(common.LoopbackHosts)
+			for _, a := range addrs {
+				if ipNet, ok := a.(*net.IPNet); ok {
+					p.interfaceAddrs = append(p.interfaceAddrs, ipNet.IP)
+					udpHosts = append(udpHosts, ipNet.IP.String())
+				}
+			}
+		}
+		if f.Expose.Source != "" {
+			_, source, err := net.ParseCIDR(f.Expose.Source)
+			if err != nil {
+				return nil, fmt.Errorf("invalid source: %s", err)
+			}
+			p.source = source
+		}
+	}
+	if f.forwards("tcp") {
+		for i, host := range hosts {
+			l, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(f.FromPort)))
+			if err != nil && i == 0 {
+				_ = p.close()
+				return nil, fmt.Errorf("failed to listen on %d port: %s", f.FromPort, err)
+			}
+			if err == nil && tlsConfig != nil {
+				l = tls.NewListener(l, tlsConfig)
+			}
+			if err == nil {
+				p.listeners = append(p.listeners, l)
+			}
+		}
+	}
+	if f.forwards("udp") {
+		for i, host := range udpHosts {
+			c, err := net.ListenPacket("udp", net.JoinHostPort(host, strconv.Itoa(f.FromPort)))
+			if err != nil && i == 0 {
+				_ = p.close()
+				return nil, fmt.Errorf("failed to listen on %d udp port: %s", f.FromPort, err)
+			}
+			if err == nil {
+				p.packetConns = append(p.packetConns, c)
+			}
+		}
+	}
+	return p, nil
+}
+
+// sameListeners tells if the forwardings listen on the same addresses for the same protocols with the same certificate.
+func sameListeners(a, b Forwarding) bool {
+	return a.Expose.equal(b.Expose) && a.TLS.equal(b.TLS) && a.forwards("tcp") == b.forwards("tcp") && a.forwards("udp") == b.forwards("udp")
+}
+
+func (p *userspaceProxy) forwarding() Forwarding {
+	t := p.targets.Load()
+	return Forwarding{Name: p.name, ToPorts: slices.Clone(t.ports), Weights: slices.Clone(t.weights), Protocol: p.protocol, Expose: p.expose, TLS: p.tls}
+}
+
+func (p *userspaceProxy) close() error {
+	var errs []error
+	for _, l := range p.listeners {
+		errs = append(errs, l.Close())
+	}
+	for _, c := range p.packetConns {
+		errs = append(errs, c.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// allowed tells if the connection from the network matches the interface and the source. The ones from the host always do.
+func (p *userspaceProxy) allowed(conn net.Conn) bool {
+	// the TLS connection has the addresses of the TCP one.
+	remote, _ := conn.RemoteAddr().(*net.TCPAddr)
+	local, _ := conn.LocalAddr().(*net.TCPAddr)
+	if remote == nil || local == nil || remote.IP.IsLoopback() {
+		return true
+	}
+	if p.source != nil && !p.source.Contains(remote.IP) {
+		return false
+	}
+	if p.expose != nil && p.expose.Interface != "" {
+		return slices.ContainsFunc(p.interfaceAddrs, local.IP.Equal)
+	}
+	return true
+}
+
+func ListUserspaceForwarding() []Forwarding {
+	userspaceLock.Lock()
+	defer userspaceLock.Unlock()
+	var res []Forwarding
+	for port, p := range userspaceProxies {
+		f := p.forwarding()
+		f.FromPort = port
+		res = append(res, f)
+	}
+	slices.SortFunc(res, func(a, b Forwarding) int {
+		return a.FromPort - b.FromPort
+	})
+	return res
+}
+
+func (p *userspaceProxy) serve(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("Userspace proxy failed to accept connection: %s\n", err)
+			continue
+		}
+		go p.handle(conn)
+	}
+}
+
+func (p *userspaceProxy) handle(conn net.Conn) {
+	defer conn.Close()
+	if !p.allowed(conn) {
+		return
+	}
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		ctx, cancel := context.WithTimeout(context.Background(), tlsHandshakeTimeout)
+		err := tlsConn.HandshakeContext(ctx)
+		cancel()
+		if err != nil {
+			return
+		}
+	}
+	t := p.targets.Load()
+	targets := t.ports
+	start := t.pick(p.nextTarget())
+	var backend net.Conn
+	var err error
+	// If the backend refuses, the connection goes to the next one.
+	for i := range targets {
+		port := targets[(start+i)%len(targets)]
+		backend, err = dialBackend(port)
+		if err == nil {
+			break
+		}
+	}
+	if backend == nil {
+		log.Printf("Userspace proxy couldn't connect to any of %v: %s\n", targets, err)
+		return
+	}
+	defer backend.Close()
+	splice(conn, backend)
+}
+
+// pick returns the index of the port the nth connection goes to, every 100 connections are split by the weights.
+func (t *userspaceTargets) pick(n int) int {
+	if t.weights == nil {
+		return n % len(t.ports)
+	}
+	n %= 100
+	for i, w := range t.weights {
+		if n < w {
+			return i
+		}
+		n -= w
+	}
+	return len(t.weights) - 1
+}
+
+// nextTarget returns the number of the next connection.
+func (p *userspaceProxy) nextTarget() int {
+	return int(p.next.Add(1))
+}
+
+// dialBackend connects to the port on the loopback of IPv4, then of IPv6.
+func dialBackend(port int) (net.Conn, error) {
+	var err error
+	for _, host := range common.LoopbackHosts {
+		var conn net.Conn
+		conn, err = net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(port)), backendDialTimeout)
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// splice copies the data both ways until both sides are done.
+func splice(a, b net.Conn) {
+	done := make(chan bool, 2)
+	copyHalf := func(dst, src net.Conn) {
+		_, _ = io.Copy(dst, src)
+		// both TCP and TLS connections can close the writing half.
+		if c, ok := dst.(interface{ CloseWrite() error }); ok {
+			_ = c.CloseWrite()
+		}
+		done <- true
+	}
+	go copyHalf(a, b)
+	go copyHalf(b, a)
+	<-done
+	<-done
+}
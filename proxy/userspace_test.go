@@ -0,0 +1,174 @@
+package proxy
+
+import (
+	"fmt"
+	"github.com/glossd/fetch"
+	"github.com/glossd/yetis/common"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestUserspaceForwarding(t *testing.T) {
+	var servers []int
+	for i := 0; i < 2; i++ {
+		port := common.MustGetFreePort()
+		servers = append(servers, port)
+		mux := &http.ServeMux{}
+		mux.HandleFunc("/hello", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Connection", "close")
+			w.Write([]byte(fmt.Sprint(port)))
+		})
+		go http.ListenAndServe(fmt.Sprintf(":%d", port), mux)
+	}
+	proxyPort := common.MustGetFreePort()
+	if !common.IsPortOpenRetry(servers[1], 10*time.Millisecond, 10) {
+		t.Fatal("server hasn't started")
+	}
+
+	err := SetUserspaceForwarding(Forwarding{Name: "hello", FromPort: proxyPort, ToPorts: servers})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer SetUserspaceForwarding(Forwarding{Name: "hello", FromPort: proxyPort})
+	hits := map[string]int{}
+	for i := 0; i < 10; i++ {
+		res, err := fetch.Get[string](fmt.Sprintf("http://localhost:%d/hello", proxyPort))
+		if err != nil {
+			t.Fatal(err)
+		}
+		hits[res]++
+	}
+	if hits[fmt.Sprint(servers[0])] != 5 || hits[fmt.Sprint(servers[1])] != 5 {
+		t.Errorf("expected round-robin, got %v", hits)
+	}
+
+	err = SetUserspaceForwarding(Forwarding{Name: "hello", FromPort: proxyPort, ToPorts: servers, Weights: []int{90, 10}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hits = map[string]int{}
+	for i := 0; i < 100; i++ {
+		res, err := fetch.Get[string](fmt.Sprintf("http://localhost:%d/hello", proxyPort))
+		if err != nil {
+			t.Fatal(err)
+		}
+		hits[res]++
+	}
+	if hits[fmt.Sprint(servers[0])] != 90 || hits[fmt.Sprint(servers[1])] != 10 {
+		t.Errorf("expected 90 and 10 connections, got %v", hits)
+	}
+
+	err = SetUserspaceForwarding(Forwarding{Name: "other", FromPort: proxyPort, ToPorts: servers})
+	if err == nil {
+		t.Error("the port of another deployment shouldn't be forwarded")
+	}
+
+	// the closed port is skipped
+	err = SetUserspaceForwarding(Forwarding{Name: "hello", FromPort: proxyPort, ToPorts: []int{common.MustGetFreePort(), servers[1]}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		res, err := fetch.Get[string](fmt.Sprintf("http://localhost:%d/hello", proxyPort))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res != fmt.Sprint(servers[1]) {
+			t.Errorf("expected the second server, got %s", res)
+		}
+	}
+
+	err = SetUserspaceForwarding(Forwarding{Name: "hello", FromPort: proxyPort})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !common.IsPortCloseRetry(proxyPort, 10*time.Millisecond, 10) {
+		t.Error("proxy port should be closed")
+	}
+}
+
+func TestUserspaceForwarding_Expose(t *testing.T) {
+	serverPort := common.MustGetFreePort()
+	mux := &http.ServeMux{}
+	mux.HandleFunc("/hello", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Connection", "close")
+		w.Write([]byte("OK"))
+	})
+	go http.ListenAndServe(fmt.Sprintf(":%d", serverPort), mux)
+	if !common.IsPortOpenRetry(serverPort, 10*time.Millisecond, 10) {
+		t.Fatal("server hasn't started")
+	}
+	hostIP := nonLoopbackIP()
+	if hostIP == "" {
+		t.Skip("no network address")
+	}
+	proxyPort := common.MustGetFreePort()
+	get := func(host string) error {
+		_, err := fetch.Get[string](fmt.Sprintf("http://%s:%d/hello", host, proxyPort), fetch.Config{Timeout: time.Second})
+		return err
+	}
+
+	err := SetUserspaceForwarding(Forwarding{Name: "hello", FromPort: proxyPort, ToPorts: []int{serverPort}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer SetUserspaceForwarding(Forwarding{Name: "hello", FromPort: proxyPort})
+	if get(hostIP) == nil {
+		t.Error("not exposed proxy shouldn't accept connections from the network")
+	}
+
+	err = SetUserspaceForwarding(Forwarding{Name: "hello", FromPort: proxyPort, ToPorts: []int{serverPort}, Expose: &Expose{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := get(hostIP); err != nil {
+		t.Errorf("exposed proxy should accept connections from the network: %s", err)
+	}
+
+	err = SetUserspaceForwarding(Forwarding{Name: "hello", FromPort: proxyPort, ToPorts: []int{serverPort}, Expose: &Expose{Source: "198.51.100.0/24"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if get(hostIP) == nil {
+		t.Error("connections outside of the source shouldn't be forwarded")
+	}
+	if err := get("127.0.0.1"); err != nil {
+		t.Errorf("connections from the host should be forwarded: %s", err)
+	}
+}
+
+func nonLoopbackIP() string {
+	addrs, _ := net.InterfaceAddrs()
+	for _, a := range addrs {
+		if ipNet, ok := a.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && ipNet.IP.To4() != nil {
+			return ipNet.IP.String()
+		}
+	}
+	return ""
+}
+
+func TestUserspaceForwarding_IPv6(t *testing.T) {
+	l, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skip("no IPv6 loopback")
+	}
+	mux := &http.ServeMux{}
+	mux.HandleFunc("/hello", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("OK"))
+	})
+	go http.Serve(l, mux)
+	proxyPort := common.MustGetFreePort()
+	err = SetUserspaceForwarding(Forwarding{Name: "hello", FromPort: proxyPort, ToPorts: []int{l.Addr().(*net.TCPAddr).Port}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer SetUserspaceForwarding(Forwarding{Name: "hello", FromPort: proxyPort})
+	for _, host := range []string{"127.0.0.1", "[::1]"} {
+		res, err := fetch.Get[string](fmt.Sprintf("http://%s:%d/hello", host, proxyPort))
+		if err != nil || res != "OK" {
+			t.Errorf("failed to proxy from %s to IPv6 server: %v", host, err)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// The files are checked for changes at most this often, on the handshakes.
+const certCheckPeriod = time.Second
+
+// certReloader serves the certificate and loads it again once the files change, so that the renewals don't need a restart.
+type certReloader struct {
+	files TLS
+	lock  sync.Mutex
+	cert  *tls.Certificate
+	// The modification time of the cert and the key files of the loaded certificate.
+	certMod, keyMod time.Time
+	checkedAt       time.Time
+}
+
+func newCertReloader(files TLS) (*certReloader, error) {
+	r := &certReloader{files: files}
+	err := r.load()
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) load() error {
+	certMod, keyMod, err := r.modTimes()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.files.CertFile, r.files.KeyFile)
+	if err != nil {
+		return fmt.Errorf("failed to load certificate: %s", err)
+	}
+	r.cert, r.certMod, r.keyMod = &cert, certMod, keyMod
+	return nil
+}
+
+func (r *certReloader) modTimes() (time.Time, time.Time, error) {
+	certInfo, err := os.Stat(r.files.CertFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("failed to read certificate: %s", err)
+	}
+	keyInfo, err := os.Stat(r.files.KeyFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("failed to read key: %s", err)
+	}
+	return certInfo.ModTime(), keyInfo.ModTime(), nil
+}
+
+// getCertificate reloads the certificate if the files changed. The broken files keep the previous certificate.
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if time.Since(r.checkedAt) < certCheckPeriod {
+		return r.cert, nil
+	}
+	r.checkedAt = time.Now()
+	certMod, keyMod, err := r.modTimes()
+	if err == nil && (!certMod.Equal(r.certMod) || !keyMod.Equal(r.keyMod)) {
+		err = r.load()
+		if err == nil {
+			log.Printf("Reloaded certificate %s\n", r.files.CertFile)
+		}
+	}
+	if err != nil {
+		log.Printf("Userspace proxy keeps the previous certificate: %s\n", err)
+	}
+	return r.cert, nil
+}
@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"github.com/glossd/yetis/common"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUserspaceForwarding_TLS(t *testing.T) {
+	port := common.MustGetFreePort()
+	go http.ListenAndServe(fmt.Sprintf(":%d", port), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the backend gets the plaintext
+		w.Write([]byte(fmt.Sprint(r.TLS == nil)))
+	}))
+	if !common.IsPortOpenRetry(port, 10*time.Millisecond, 10) {
+		t.Fatal("server hasn't started")
+	}
+	dir := t.TempDir()
+	files := TLS{CertFile: filepath.Join(dir, "cert.pem"), KeyFile: filepath.Join(dir, "key.pem")}
+	writeTestCert(t, files, "first")
+
+	proxyPort := common.MustGetFreePort()
+	err := SetUserspaceForwarding(Forwarding{Name: "tls", FromPort: proxyPort, ToPorts: []int{port}, TLS: &files})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer SetUserspaceForwarding(Forwarding{Name: "tls", FromPort: proxyPort})
+
+	get := func() (string, string) {
+		t.Helper()
+		client := http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, DisableKeepAlives: true}}
+		res, err := client.Get(fmt.Sprintf("https://localhost:%d/", proxyPort))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+		body, _ := io.ReadAll(res.Body)
+		return string(body), res.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	body, cn := get()
+	assert(t, body, "true")
+	assert(t, cn, "first")
+
+	// the renewed certificate is served without reopening the port.
+	time.Sleep(certCheckPeriod)
+	writeTestCert(t, files, "renewed")
+	_, cn = get()
+	assert(t, cn, "renewed")
+
+	err = SetUserspaceForwarding(Forwarding{Name: "tls", FromPort: common.MustGetFreePort(), ToPorts: []int{port}, TLS: &TLS{CertFile: filepath.Join(dir, "missing.pem"), KeyFile: files.KeyFile}})
+	if err == nil {
+		t.Error("expected the missing certificate to fail")
+	}
+}
+
+func TestUserspaceForwarding_TLSHandshakeTimeout(t *testing.T) {
+	prev := tlsHandshakeTimeout
+	tlsHandshakeTimeout = 100 * time.Millisecond
+	defer func() { tlsHandshakeTimeout = prev }()
+	backend, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	var dialed atomic.Int64
+	go func() {
+		for {
+			c, err := backend.Accept()
+			if err != nil {
+				return
+			}
+			dialed.Add(1)
+			c.Close()
+		}
+	}()
+	dir := t.TempDir()
+	files := TLS{CertFile: filepath.Join(dir, "cert.pem"), KeyFile: filepath.Join(dir, "key.pem")}
+	writeTestCert(t, files, "slow")
+	proxyPort := common.MustGetFreePort()
+	err = SetUserspaceForwarding(Forwarding{Name: "tls-slow", FromPort: proxyPort, ToPorts: []int{backend.Addr().(*net.TCPAddr).Port}, TLS: &files})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer SetUserspaceForwarding(Forwarding{Name: "tls-slow", FromPort: proxyPort})
+
+	// the client never sends the hello.
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", proxyPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert(t, err, io.EOF)
+	assert(t, dialed.Load(), int64(0))
+}
+
+func writeTestCert(t *testing.T, files TLS, commonName string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(files.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(files.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"errors"
+	"github.com/glossd/yetis/common/unix"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// UDP has no connections, each client address gets its own session with the backend chosen in round-robin.
+// The session ends after it's idle for udpSessionTimeout.
+const udpSessionTimeout = 30 * time.Second
+
+const maxDatagramSize = 65535
+
+type udpSession struct {
+	backend    *net.UDPConn
+	lastActive atomic.Int64
+}
+
+func (s *udpSession) touch() {
+	s.lastActive.Store(time.Now().UnixNano())
+}
+
+func (s *udpSession) idle() bool {
+	return time.Since(time.Unix(0, s.lastActive.Load())) >= udpSessionTimeout
+}
+
+// serveUDP relays the datagrams of the clients to their backends and the replies back until the conn is closed.
+func (p *userspaceProxy) serveUDP(conn net.PacketConn) {
+	var mu sync.Mutex
+	sessions := map[string]*udpSession{}
+	defer func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, s := range sessions {
+			s.backend.Close()
+		}
+	}()
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			log.Printf("Userspace proxy failed to read datagram: %s\n", err)
+			continue
+		}
+		if udpAddr, ok := addr.(*net.UDPAddr); ok && !p.allowedRemote(udpAddr.IP) {
+			continue
+		}
+		mu.Lock()
+		s, ok := sessions[addr.String()]
+		if !ok {
+			s, err = p.dialUDP()
+			if err != nil {
+				mu.Unlock()
+				log.Printf("Userspace proxy couldn't relay datagram: %s\n", err)
+				continue
+			}
+			sessions[addr.String()] = s
+			go func() {
+				p.replyUDP(conn, addr, s)
+				mu.Lock()
+				delete(sessions, addr.String())
+				mu.Unlock()
+			}()
+		}
+		mu.Unlock()
+		s.touch()
+		_, err = s.backend.Write(buf[:n])
+		if err != nil {
+			// the backend is gone, the next datagram starts a new session.
+			s.backend.Close()
+		}
+	}
+}
+
+// allowedRemote tells if the datagram from the network matches the source. The ones from the host always do.
+func (p *userspaceProxy) allowedRemote(ip net.IP) bool {
+	return ip.IsLoopback() || p.source == nil || p.source.Contains(ip)
+}
+
+// dialUDP connects to the next target, on the loopback of the family the target is bound to.
+func (p *userspaceProxy) dialUDP() (*udpSession, error) {
+	t := p.targets.Load()
+	port := t.ports[t.pick(p.nextTarget())]
+	host := "127.0.0.1"
+	if bound, _ := unix.IsUDP4PortBound(port); !bound {
+		host = "::1"
+	}
+	addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return nil, err
+	}
+	backend, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return nil, err
+	}
+	s := &udpSession{backend: backend}
+	s.touch()
+	return s, nil
+}
+
+func (p *userspaceProxy) replyUDP(conn net.PacketConn, client net.Addr, s *udpSession) {
+	defer s.backend.Close()
+	buf := make([]byte, maxDatagramSize)
+	for {
+		_ = s.backend.SetReadDeadline(time.Now().Add(udpSessionTimeout))
+		n, err := s.backend.Read(buf)
+		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() && !s.idle() {
+				continue
+			}
+			return
+		}
+		s.touch()
+		_, err = conn.WriteTo(buf[:n], client)
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"github.com/glossd/yetis/common"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestUserspaceForwarding_UDP(t *testing.T) {
+	var servers []int
+	for i := 0; i < 2; i++ {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		port := conn.LocalAddr().(*net.UDPAddr).Port
+		servers = append(servers, port)
+		go func() {
+			buf := make([]byte, 1024)
+			for {
+				n, addr, err := conn.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+				conn.WriteTo(append(buf[:n], []byte(" from "+strconv.Itoa(port))...), addr)
+			}
+		}()
+	}
+	proxyPort := common.MustGetFreePort()
+	err := SetUserspaceForwarding(Forwarding{Name: "dns", FromPort: proxyPort, ToPorts: servers, Protocol: "udp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer SetUserspaceForwarding(Forwarding{Name: "dns", FromPort: proxyPort})
+	if common.IsPortOpen(proxyPort) {
+		t.Error("tcp shouldn't be forwarded")
+	}
+
+	hits := map[string]int{}
+	for i := 0; i < 4; i++ {
+		hits[exchangeUDP(t, proxyPort, "ping")]++
+	}
+	if hits["ping from "+strconv.Itoa(servers[0])] != 2 || hits["ping from "+strconv.Itoa(servers[1])] != 2 {
+		t.Errorf("expected sessions in round-robin, got %v", hits)
+	}
+
+	forwardings := ListUserspaceForwarding()
+	assert(t, len(forwardings), 1)
+	assert(t, forwardings[0].Protocol, "udp")
+
+	err = SetUserspaceForwarding(Forwarding{Name: "dns", FromPort: proxyPort, ToPorts: servers[:1], Protocol: "both"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !common.IsPortOpenRetry(proxyPort, 10*time.Millisecond, 10) {
+		t.Error("tcp should be forwarded too")
+	}
+	assert(t, exchangeUDP(t, proxyPort, "pong"), "pong from "+strconv.Itoa(servers[0]))
+}
+
+// exchangeUDP sends the message from a new client and returns the reply.
+func exchangeUDP(t *testing.T, port int, msg string) string {
+	t.Helper()
+	conn, err := net.Dial("udp", "127.0.0.1:"+strconv.Itoa(port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(time.Second))
+	_, err = conn.Write([]byte(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1024)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf[:n])
+}
@@ -17,7 +17,7 @@ func AlertFail(name string) error {
 		log.Printf("AlertFail skipped: deployment %s not found\n", name)
 		return err
 	}
-	_, loaded := alertStore.LoadOrStore(rootNameForRollingUpdate(name), true)
+	_, loaded := alertStore.LoadOrStore(rootName(d), true)
 	if loaded {
 		return fmt.Errorf("alert has already been sent")
 	}
@@ -27,7 +27,10 @@ func AlertFail(name string) error {
 		log.Printf("AlertFail skipped: marshal: %s\n", err)
 		return err
 	}
-	err = serverConfig.Alerting.Send(fmt.Sprintf("Deployment %s Failed", d.spec.Name), info)
+	if d.lastTermination != nil {
+		info = "Last termination: " + d.lastTermination.String() + "\n\n" + info
+	}
+	err = serverConfig.Alerting.Send(fmt.Sprintf("Deployment %s Failed", replicaName(d.name, d.replica)), info)
 	if err != nil {
 		log.Printf("AlertFail skipped: send: %s", err)
 		return err
@@ -36,7 +39,7 @@ func AlertFail(name string) error {
 }
 
 func AlertRecovery(name string) error {
-	_, loaded := alertStore.LoadAndDelete(rootNameForRollingUpdate(name))
+	_, loaded := alertStore.LoadAndDelete(resolveRootName(name))
 	if !loaded {
 		err := fmt.Errorf("alert not triggered for %s", name)
 		log.Printf("AlertRecovery skipped: %s\n", err)
@@ -53,7 +56,7 @@ func AlertRecovery(name string) error {
 		log.Printf("AlertRecovery skipped: marshal: %s\n", err)
 		return err
 	}
-	err = serverConfig.Alerting.Send(fmt.Sprintf("Deployment %s Recovered", d.spec.Name), string(info))
+	err = serverConfig.Alerting.Send(fmt.Sprintf("Deployment %s Recovered", replicaName(d.name, d.replica)), string(info))
 	if err != nil {
 		log.Printf("AlertRecovery skipped: send: %s", err)
 		return err
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/glossd/fetch"
+	"github.com/glossd/yetis/common"
+	"log"
+)
+
+// startPreview starts the new instances of all the replicas next to the old ones and forwards strategy.previewPort to them once they're healthy.
+// proxy.port and the route stay on the old instances until the promotion.
+func startPreview(root string, applySpec common.DeploymentSpec, generation int) error {
+	var specs []common.DeploymentSpec
+	for i := 0; i < applySpec.Replicas; i++ {
+		spec, err := startInstance(applySpec, instance{name: root, replica: i, generation: generation, preview: true}, false)
+		if err != nil {
+			return fmt.Errorf("failed to start preview of replica %d of '%s': %s", i, root, err)
+		}
+		specs = append(specs, spec)
+	}
+	for _, spec := range specs {
+		err := waitReady(spec)
+		if err != nil {
+			// don't delete, need to see what went wrong, abort deletes it.
+			return fmt.Errorf("the preview '%s' isn't healthy: %s", spec.Name, err)
+		}
+	}
+	err := syncProxy(root, applySpec.Strategy.PreviewPort)
+	if err != nil {
+		return fmt.Errorf("failed to forward preview port: %s", err)
+	}
+	log.Printf("Deployment '%s' is previewed on port %d\n", root, applySpec.Strategy.PreviewPort)
+	return nil
+}
+
+// splitPreview separates the preview instances from the ones taking the traffic.
+func splitPreview(replicas []deployment) (preview, current []deployment) {
+	for _, d := range replicas {
+		if d.preview {
+			preview = append(preview, d)
+		} else {
+			current = append(current, d)
+		}
+	}
+	return preview, current
+}
+
+func PromoteDeployment(r fetch.Request[fetch.Empty]) error {
+	name := r.PathValues["name"]
+	if name == "" {
+		return fmt.Errorf(`name can't be empty`)
+	}
+	return promoteDeployment(r.Context, resolveRootName(name))
+}
+
+// promoteDeployment switches proxy.port and the route from the old instances to the preview ones together, then deletes the old ones.
+// The canary is promoted right away without waiting for the rest of the steps.
+func promoteDeployment(ctx context.Context, root string) error {
+	if c, ok := canaries.Load(root); ok {
+		return promoteCanary(ctx, root, c)
+	}
+	preview, current := splitPreview(getReplicas(root))
+	if len(preview) == 0 {
+		return fmt.Errorf("deployment '%s' doesn't have a preview or a canary", root)
+	}
+	// the preview which failed to start is kept to see what went wrong, it must not take the traffic.
+	if ro, _ := rollouts.Load(root); ro.Status != RolloutPreview {
+		return fmt.Errorf("the preview of '%s' isn't healthy, abort it", root)
+	}
+	for _, d := range preview {
+		if !d.isReady() {
+			return fmt.Errorf("the preview '%s' isn't ready", d.spec.Name)
+		}
+	}
+	for _, d := range current {
+		updateDeploymentStatus(d.spec.Name, Terminating)
+	}
+	for _, d := range preview {
+		setDeploymentPreview(d.spec.Name, false)
+	}
+	spec := preview[0].spec
+	ports := append(spec.ProxyPorts(), spec.Strategy.PreviewPort)
+	err := syncProxy(root, ports...)
+	if err != nil {
+		// the old instances keep the traffic.
+		for _, d := range preview {
+			setDeploymentPreview(d.spec.Name, true)
+		}
+		for _, d := range current {
+			updateDeploymentStatus(d.spec.Name, d.status)
+		}
+		logProxyErr(syncProxy(root, ports...))
+		return fmt.Errorf("failed to switch proxy to the preview: %s", err)
+	}
+
+	var errs []error
+	for _, d := range current {
+		err := deleteInstance(ctx, d.spec.Name)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to delete old deployment '%s': %s", d.spec.Name, err))
+		}
+	}
+	commitRevision(root)
+	finishRollout(root, nil, false)
+	log.Printf("Promoted deployment '%s'\n", root)
+	return errors.Join(errs...)
+}
+
+func AbortDeployment(r fetch.Request[fetch.Empty]) error {
+	name := r.PathValues["name"]
+	if name == "" {
+		return fmt.Errorf(`name can't be empty`)
+	}
+	return abortDeployment(r.Context, resolveRootName(name))
+}
+
+// resumePreviews marks the rollouts of the previews restored from the previous run of Yetis waiting for the promotion.
+func resumePreviews() {
+	roots := map[string]bool{}
+	rangeDeployments(func(_ string, d deployment) {
+		if d.preview {
+			roots[rootName(d)] = true
+		}
+	})
+	for root := range roots {
+		if _, ok := rollouts.Load(root); ok {
+			// restored with its status, the failed preview stays failed.
+			continue
+		}
+		startRollout(root)
+		previewRollout(root)
+	}
+}
+
+// abortDeployment deletes the preview or the canary instances, the old ones keep the traffic.
+func abortDeployment(ctx context.Context, root string) error {
+	if c, ok := canaries.Load(root); ok {
+		return abortCanary(ctx, root, c, nil)
+	}
+	preview, _ := splitPreview(getReplicas(root))
+	if len(preview) == 0 {
+		return fmt.Errorf("deployment '%s' doesn't have a preview or a canary", root)
+	}
+	var errs []error
+	for _, d := range preview {
+		err := deleteInstance(ctx, d.spec.Name)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to delete preview '%s': %s", d.spec.Name, err))
+		}
+	}
+	dropRevision(root)
+	abortRollout(root)
+	log.Printf("Aborted the preview of deployment '%s'\n", root)
+	return errors.Join(errs...)
+}
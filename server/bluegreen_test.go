@@ -0,0 +1,85 @@
+package server
+
+import (
+	"context"
+	"github.com/glossd/fetch"
+	"github.com/glossd/yetis/common"
+	"testing"
+)
+
+func TestBlueGreen(t *testing.T) {
+	backend := newFakeBackend()
+	useProxyBackend(t, backend)
+
+	proxyPort, previewPort := common.MustGetFreePort(), common.MustGetFreePort()
+	config := common.DeploymentSpec{
+		Name:          "bg",
+		Cmd:           "sleep 10",
+		Logdir:        "stdout",
+		Strategy:      common.DeploymentStrategy{Type: common.BlueGreen, PreviewPort: previewPort},
+		Proxy:         common.Proxies{{Port: proxyPort}},
+		LivenessProbe: common.Probe{Exec: common.Exec{Command: "true"}, InitialDelaySeconds: 0.01, PeriodSeconds: 0.1},
+	}
+	_, err := CreateOrRestartDeployment(fetch.Request[common.DeploymentSpec]{Context: context.Background(), Body: config})
+	assert(t, err, nil)
+	defer deleteReplicas(context.Background(), config.Name)
+	blue, _ := getInstance("bg")
+	assert(t, waitReady(blue.spec), nil)
+	assert(t, syncProxy("bg", proxyPort), nil)
+	bluePort := blue.spec.YetisPort()
+
+	config.Cmd = "sleep 20"
+	res, err := CreateOrRestartDeployment(fetch.Request[common.DeploymentSpec]{Context: context.Background(), Body: config})
+	assert(t, err, nil)
+	assert(t, res.PreviewPort, previewPort)
+	green, ok := getDeployment("bg@1")
+	assert(t, ok, true)
+	assert(t, green.preview, true)
+	// proxy.port stays on the old instance until the promotion
+	assert(t, backend.forwarding(proxyPort).ToPorts[0], bluePort)
+	assert(t, backend.forwarding(previewPort).ToPorts[0], green.spec.YetisPort())
+	d, _ := getInstance("bg")
+	assert(t, d.spec.Cmd, "sleep 10")
+	ro, _ := rollouts.Load("bg")
+	assert(t, ro.Status, RolloutPreview)
+	if restartDeployment(context.Background(), "bg", nil) == nil {
+		t.Error("expected the restart to wait for the promotion")
+	}
+
+	updateDeploymentStatus("bg@1", Pending)
+	if promoteDeployment(context.Background(), "bg") == nil {
+		t.Error("expected the unready preview not to be promoted")
+	}
+	updateDeploymentStatus("bg@1", Running)
+	rollouts.Store("bg", Rollout{Status: RolloutFailed})
+	if promoteDeployment(context.Background(), "bg") == nil {
+		t.Error("expected the failed preview not to be promoted")
+	}
+	rollouts.Store("bg", ro)
+
+	assert(t, promoteDeployment(context.Background(), "bg"), nil)
+	assert(t, backend.forwarding(proxyPort).ToPorts[0], green.spec.YetisPort())
+	_, ok = backend.get(previewPort)
+	assert(t, ok, false)
+	assert(t, len(getReplicas("bg")), 1)
+	d, _ = getInstance("bg")
+	assert(t, d.spec.Cmd, "sleep 20")
+	assert(t, d.preview, false)
+	ro, _ = rollouts.Load("bg")
+	assert(t, ro.Status, RolloutComplete)
+
+	config.Cmd = "sleep 30"
+	_, err = CreateOrRestartDeployment(fetch.Request[common.DeploymentSpec]{Context: context.Background(), Body: config})
+	assert(t, err, nil)
+	assert(t, abortDeployment(context.Background(), "bg"), nil)
+	_, ok = backend.get(previewPort)
+	assert(t, ok, false)
+	d, _ = getInstance("bg")
+	assert(t, d.spec.Cmd, "sleep 20")
+	assert(t, len(getReplicas("bg")), 1)
+	ro, _ = rollouts.Load("bg")
+	assert(t, ro.Status, RolloutAborted)
+	if abortDeployment(context.Background(), "bg") == nil {
+		t.Error("expected no preview to abort")
+	}
+}
@@ -0,0 +1,333 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/glossd/yetis/common"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// canary is the Canary rollout in progress, the instances of its generation get weight percent of the connections of proxy.port.
+type canary struct {
+	generation int
+	weight     atomic.Int64
+	// The probes of the new instances since the last step, see countCanaryProbe.
+	probes   atomic.Int64
+	failures atomic.Int64
+	// Set by whichever finishes the canary first: the last step, promote or abort.
+	done atomic.Bool
+	// Closed once the canary is finished, stops runCanary.
+	stop     chan struct{}
+	stopOnce sync.Once
+	// Closed when runCanary returns.
+	stopped chan struct{}
+}
+
+func newCanary(generation int) *canary {
+	return &canary{generation: generation, stop: make(chan struct{}), stopped: make(chan struct{})}
+}
+
+// finish stops the steps of the canary.
+func (c *canary) finish() {
+	c.stopOnce.Do(func() { close(c.stop) })
+}
+
+// root name -> the canary in progress
+var canaries = common.Map[string, *canary]{}
+
+// startCanary starts the new instances of all the replicas next to the old ones,
+// once they're healthy they get strategy.canary.weight of the connections and the steps begin.
+func startCanary(ctx context.Context, root string, applySpec common.DeploymentSpec, generation int) error {
+	c := newCanary(generation)
+	c.weight.Store(int64(applySpec.Strategy.Canary.Weight))
+	canaries.Store(root, c)
+	var specs []common.DeploymentSpec
+	for i := 0; i < applySpec.Replicas; i++ {
+		spec, err := startInstance(applySpec, instance{name: root, replica: i, generation: generation}, false)
+		if err != nil {
+			err = fmt.Errorf("failed to start canary of replica %d of '%s': %s", i, root, err)
+			logCanaryErr(abortCanary(ctx, root, c, err))
+			return err
+		}
+		specs = append(specs, spec)
+	}
+	for _, spec := range specs {
+		err := waitReady(spec)
+		if err != nil {
+			err = fmt.Errorf("the canary '%s' isn't healthy: %s", spec.Name, err)
+			logCanaryErr(abortCanary(ctx, root, c, err))
+			return err
+		}
+	}
+	err := syncProxy(root, applySpec.ProxyPorts()...)
+	if err != nil {
+		err = fmt.Errorf("failed to forward proxy port to the canary: %s", err)
+		logCanaryErr(abortCanary(ctx, root, c, err))
+		return err
+	}
+	canaryRollout(root, applySpec.Strategy.Canary.Weight)
+	log.Printf("Canary of deployment '%s' takes %d%% of the connections\n", root, applySpec.Strategy.Canary.Weight)
+	go runCanary(root, c, *applySpec.Strategy.Canary)
+	return nil
+}
+
+// runCanary raises the weight of the canary every step while it's healthy, 100 promotes it.
+func runCanary(root string, c *canary, s common.CanaryStrategy) {
+	defer close(c.stopped)
+	ticker := time.NewTicker(s.StepDuration())
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+		}
+		if c.done.Load() {
+			return
+		}
+		err := checkCanary(root, c, s)
+		if err != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			logCanaryErr(abortCanary(ctx, root, c, err))
+			cancel()
+			return
+		}
+		weight := min(int(c.weight.Load())+s.StepWeight, 100)
+		if weight == 100 {
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			err := promoteCanary(ctx, root, c)
+			cancel()
+			if err != nil {
+				log.Printf("Failed to promote canary of '%s': %s\n", root, err)
+				continue
+			}
+			return
+		}
+		c.weight.Store(int64(weight))
+		err = syncProxy(root, canaryPorts(root, c)...)
+		if err != nil {
+			log.Printf("Failed to raise the weight of canary of '%s': %s\n", root, err)
+			continue
+		}
+		canaryRollout(root, weight)
+		log.Printf("Canary of deployment '%s' takes %d%% of the connections\n", root, weight)
+	}
+}
+
+// checkCanary returns why the canary must be aborted: one of the new instances isn't ready, has restarted
+// or the new instances failed more probes since the last step than maxFailureRate allows.
+func checkCanary(root string, c *canary, s common.CanaryStrategy) error {
+	fresh, _ := splitCanary(getReplicas(root), c)
+	if len(fresh) == 0 {
+		return fmt.Errorf("the canary of '%s' doesn't exist", root)
+	}
+	for _, d := range fresh {
+		if d.restarts > 0 || d.exited || d.status != Running || !d.isReady() {
+			setRolloutFailure(root, captureFailure(d))
+			return fmt.Errorf("the canary '%s' isn't healthy: status %s, restarts %d", d.spec.Name, d.status, d.restarts)
+		}
+	}
+	probes, failures := c.probes.Swap(0), c.failures.Swap(0)
+	if probes == 0 {
+		return nil
+	}
+	rate := float64(failures) * 100 / float64(probes)
+	if rate > s.MaxFailureRate {
+		setRolloutFailure(root, captureFailure(fresh[0]))
+		return fmt.Errorf("the canary of '%s' failed %.1f%% of the probes, more than maxFailureRate %g%%", root, rate, s.MaxFailureRate)
+	}
+	return nil
+}
+
+// countCanaryProbe counts the result of the liveness or the readiness probe of the new instance.
+func countCanaryProbe(d deployment, healthy bool) {
+	c, ok := canaries.Load(rootName(d))
+	if !ok || d.generation != c.generation {
+		return
+	}
+	c.probes.Add(1)
+	if !healthy {
+		c.failures.Add(1)
+	}
+}
+
+// splitCanary separates the new instances of the canary from the old ones.
+func splitCanary(replicas []deployment, c *canary) (fresh, current []deployment) {
+	for _, d := range replicas {
+		if d.generation == c.generation {
+			fresh = append(fresh, d)
+		} else {
+			current = append(current, d)
+		}
+	}
+	return fresh, current
+}
+
+// canaryWeights splits the connections between the instances of the canary and the old ones, each group shares its weight equally.
+// Nil if only one of the groups takes the connections.
+func canaryWeights(c *canary, instances []deployment) []int {
+	var num int
+	for _, d := range instances {
+		if d.generation == c.generation {
+			num++
+		}
+	}
+	if num == 0 || num == len(instances) {
+		return nil
+	}
+	canaryShares := splitWeight(int(c.weight.Load()), num)
+	currentShares := splitWeight(100-int(c.weight.Load()), len(instances)-num)
+	var weights []int
+	for _, d := range instances {
+		if d.generation == c.generation {
+			weights, canaryShares = append(weights, canaryShares[0]), canaryShares[1:]
+		} else {
+			weights, currentShares = append(weights, currentShares[0]), currentShares[1:]
+		}
+	}
+	return weights
+}
+
+// splitWeight splits the weight into n shares, the first ones get the remainder.
+func splitWeight(weight, n int) []int {
+	shares := make([]int, n)
+	for i := range shares {
+		shares[i] = weight / n
+		if i < weight%n {
+			shares[i]++
+		}
+	}
+	return shares
+}
+
+// canaryPorts returns the proxy ports of the deployment.
+func canaryPorts(root string, c *canary) []int {
+	fresh, _ := splitCanary(getReplicas(root), c)
+	if len(fresh) == 0 {
+		return nil
+	}
+	return fresh[0].spec.ProxyPorts()
+}
+
+// promoteCanary forwards all the connections to the new instances, then deletes the old ones.
+func promoteCanary(ctx context.Context, root string, c *canary) error {
+	fresh, _ := splitCanary(getReplicas(root), c)
+	if len(fresh) == 0 {
+		return fmt.Errorf("the canary of '%s' doesn't exist", root)
+	}
+	for _, d := range fresh {
+		if !d.isReady() {
+			return fmt.Errorf("the canary '%s' isn't ready", d.spec.Name)
+		}
+	}
+	if !c.done.CompareAndSwap(false, true) {
+		return fmt.Errorf("canary of '%s' is already finishing", root)
+	}
+	weight := c.weight.Swap(100)
+	err := syncProxy(root, canaryPorts(root, c)...)
+	if err != nil {
+		// the canary goes on from where it was.
+		c.weight.Store(weight)
+		c.done.Store(false)
+		logProxyErr(syncProxy(root, canaryPorts(root, c)...))
+		return fmt.Errorf("failed to switch proxy to the canary: %s", err)
+	}
+	c.finish()
+	_, current := splitCanary(getReplicas(root), c)
+	for _, d := range current {
+		updateDeploymentStatus(d.spec.Name, Terminating)
+	}
+	canaries.Delete(root)
+
+	var errs []error
+	for _, d := range current {
+		err := deleteInstance(ctx, d.spec.Name)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to delete old deployment '%s': %s", d.spec.Name, err))
+		}
+	}
+	commitRevision(root)
+	finishRollout(root, nil, false)
+	log.Printf("Promoted canary of deployment '%s'\n", root)
+	return errors.Join(errs...)
+}
+
+// abortCanary forwards all the connections back to the old instances and deletes the new ones.
+// The cause fails the rollout, without it the rollout is aborted by the user.
+func abortCanary(ctx context.Context, root string, c *canary, cause error) error {
+	if !c.done.CompareAndSwap(false, true) {
+		return fmt.Errorf("canary of '%s' is already finishing", root)
+	}
+	c.finish()
+	c.weight.Store(0)
+	logProxyErr(syncProxy(root, canaryPorts(root, c)...))
+	fresh, _ := splitCanary(getReplicas(root), c)
+	for _, d := range fresh {
+		updateDeploymentStatus(d.spec.Name, Terminating)
+	}
+	canaries.Delete(root)
+
+	var errs []error
+	for _, d := range fresh {
+		err := deleteInstance(ctx, d.spec.Name)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to delete canary '%s': %s", d.spec.Name, err))
+		}
+	}
+	dropRevision(root)
+	if cause != nil {
+		finishRollout(root, cause, true)
+		log.Printf("Rolled back canary of deployment '%s': %s\n", root, cause)
+	} else {
+		abortRollout(root)
+		log.Printf("Aborted canary of deployment '%s'\n", root)
+	}
+	return errors.Join(errs...)
+}
+
+// deleteCanary stops the steps of the canary of the deleted deployment.
+func deleteCanary(root string) {
+	if c, ok := canaries.LoadAndDelete(root); ok {
+		c.done.Store(true)
+		c.finish()
+	}
+}
+
+// resumeCanaries starts over the steps of the canaries interrupted by the restart of Yetis, from strategy.canary.weight.
+func resumeCanaries() {
+	roots := map[string][]deployment{}
+	rangeDeployments(func(_ string, d deployment) {
+		if d.spec.Strategy.Type == common.Canary && d.status != Terminating {
+			roots[rootName(d)] = append(roots[rootName(d)], d)
+		}
+	})
+	for root, replicas := range roots {
+		generation := latestGeneration(replicas)
+		c := newCanary(generation)
+		fresh, current := splitCanary(replicas, c)
+		if len(current) == 0 {
+			continue
+		}
+		s := common.CanaryStrategy{}.WithDefaults()
+		if fresh[0].spec.Strategy.Canary != nil {
+			s = *fresh[0].spec.Strategy.Canary
+		}
+		c.weight.Store(int64(s.Weight))
+		canaries.Store(root, c)
+		logProxyErr(syncProxy(root, fresh[0].spec.ProxyPorts()...))
+		startRollout(root)
+		canaryRollout(root, s.Weight)
+		log.Printf("Resumed canary of deployment '%s' at %d%% of the connections\n", root, s.Weight)
+		go runCanary(root, c, s)
+	}
+}
+
+func logCanaryErr(err error) {
+	if err != nil {
+		log.Printf("Failed to abort canary: %s\n", err)
+	}
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"context"
+	"github.com/glossd/fetch"
+	"github.com/glossd/yetis/common"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestCanary(t *testing.T) {
+	backend := newFakeBackend()
+	useProxyBackend(t, backend)
+
+	proxyPort := common.MustGetFreePort()
+	config := common.DeploymentSpec{
+		Name:          "c",
+		Cmd:           "sleep 10",
+		Logdir:        "stdout",
+		Strategy:      common.DeploymentStrategy{Type: common.Canary, Canary: &common.CanaryStrategy{Weight: 20, StepWeight: 80, StepSeconds: 0.5}},
+		Proxy:         common.Proxies{{Port: proxyPort}},
+		LivenessProbe: common.Probe{Exec: common.Exec{Command: "true"}, InitialDelaySeconds: 0.01, PeriodSeconds: 0.1},
+	}
+	_, err := CreateOrRestartDeployment(fetch.Request[common.DeploymentSpec]{Context: context.Background(), Body: config})
+	assert(t, err, nil)
+	defer deleteReplicas(context.Background(), config.Name)
+	stable, _ := getInstance("c")
+	assert(t, waitReady(stable.spec), nil)
+	assert(t, syncProxy("c", proxyPort), nil)
+
+	config.Cmd = "sleep 20"
+	res, err := CreateOrRestartDeployment(fetch.Request[common.DeploymentSpec]{Context: context.Background(), Body: config})
+	assert(t, err, nil)
+	assert(t, res.CanaryWeight, 20)
+	next, ok := getDeployment("c@1")
+	assert(t, ok, true)
+	f := backend.forwarding(proxyPort)
+	assert(t, slices.Equal(f.ToPorts, []int{stable.spec.YetisPort(), next.spec.YetisPort()}), true)
+	assert(t, slices.Equal(f.Weights, []int{80, 20}), true)
+	ro, _ := rollouts.Load("c")
+	assert(t, ro.Status, RolloutProgressing)
+	assert(t, ro.Weight, 20)
+	c, ok := canaries.Load("c")
+	assert(t, ok, true)
+	if restartDeployment(context.Background(), "c", nil) == nil {
+		t.Error("expected the restart to wait for the canary")
+	}
+
+	// the next step reaches 100 and promotes the canary.
+	waitCanaryStopped(t, c)
+	ro, _ = rollouts.Load("c")
+	assert(t, ro.Status, RolloutComplete)
+	assert(t, len(getReplicas("c")), 1)
+	d, _ := getInstance("c")
+	assert(t, d.spec.Cmd, "sleep 20")
+	f = backend.forwarding(proxyPort)
+	assert(t, slices.Equal(f.ToPorts, []int{next.spec.YetisPort()}), true)
+	assert(t, f.Weights == nil, true)
+
+	config.Cmd = "sleep 30"
+	config.Strategy.Canary.StepSeconds = 60
+	_, err = CreateOrRestartDeployment(fetch.Request[common.DeploymentSpec]{Context: context.Background(), Body: config})
+	assert(t, err, nil)
+	c, ok = canaries.Load("c")
+	assert(t, ok, true)
+	updateDeploymentStatus("c@2", Pending)
+	if promoteDeployment(context.Background(), "c") == nil {
+		t.Error("expected the unready canary not to be promoted")
+	}
+	assert(t, c.done.Load(), false)
+	updateDeploymentStatus("c@2", Running)
+	c.probes.Add(4)
+	c.failures.Add(1)
+	if checkCanary("c", c, *config.Strategy.Canary) == nil {
+		t.Error("expected the failed probes to abort the canary")
+	}
+	assert(t, abortDeployment(context.Background(), "c"), nil)
+	waitCanaryStopped(t, c)
+	d, _ = getInstance("c")
+	assert(t, d.spec.Cmd, "sleep 20")
+	assert(t, len(getReplicas("c")), 1)
+	assert(t, slices.Equal(backend.forwarding(proxyPort).ToPorts, []int{next.spec.YetisPort()}), true)
+	ro, _ = rollouts.Load("c")
+	assert(t, ro.Status, RolloutAborted)
+	if abortDeployment(context.Background(), "c") == nil {
+		t.Error("expected no canary to abort")
+	}
+}
+
+// waitCanaryStopped waits for runCanary to return, it doesn't touch the proxy after.
+func waitCanaryStopped(t *testing.T, c *canary) {
+	t.Helper()
+	select {
+	case <-c.stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the canary hasn't stopped")
+	}
+}
+
+func TestCanaryWeights(t *testing.T) {
+	c := newCanary(1)
+	c.weight.Store(10)
+	instances := []deployment{
+		{instance: instance{name: "w"}},
+		{instance: instance{name: "w", replica: 1}},
+		{instance: instance{name: "w", replica: 2}},
+		{instance: instance{name: "w", generation: 1}},
+	}
+	assert(t, slices.Equal(canaryWeights(c, instances), []int{30, 30, 30, 10}), true)
+	c.weight.Store(25)
+	assert(t, slices.Equal(canaryWeights(c, instances), []int{25, 25, 25, 25}), true)
+	assert(t, canaryWeights(c, instances[:3]) == nil, true)
+	assert(t, slices.Equal(splitWeight(100, 3), []int{34, 33, 33}), true)
+}
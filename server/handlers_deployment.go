@@ -3,51 +3,75 @@ package server
 import (
 	"cmp"
 	"context"
+	"errors"
 	"fmt"
 	"github.com/glossd/fetch"
 	"github.com/glossd/yetis/common"
-	"github.com/glossd/yetis/proxy"
+	"github.com/glossd/yetis/common/unix"
 	"log"
-	"regexp"
 	"slices"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
 type CRDeploymentResponse struct {
 	// True if restarted, false if created
 	Existed bool
+	// Set if BlueGreen started the preview, it waits for the promotion.
+	PreviewPort int
+	// Set if Canary started the new instances, the percentage of the connections they take at first.
+	CanaryWeight int
 }
 
 func CreateOrRestartDeployment(req fetch.Request[common.DeploymentSpec]) (*CRDeploymentResponse, error) {
 	spec := req.Body
 	// Validation
-	if spec.Strategy.Type == common.Recreate {
-		if spec.Proxy.Port == 0 && spec.LivenessProbe.Port() == 0 {
-			return nil, fmt.Errorf("either livenessProbe.tcpSocket.port or proxy.port must be specified for Recreate strategy")
+	if spec.Strategy.Type == common.RollingUpdate || spec.Strategy.Type == common.BlueGreen || spec.Strategy.Type == common.Canary {
+		if spec.LivenessProbe.Port() > 0 || hasReadinessOrStartupPort(spec) {
+			return nil, fmt.Errorf("probe port can't be specified with %s strategy", spec.Strategy.Type)
 		}
-	}
-	if spec.Strategy.Type == common.RollingUpdate {
-		if spec.LivenessProbe.Port() > 0 {
-			return nil, fmt.Errorf("livenessProxy.tcpSocket.port can't be specified with RollingUpdate strategy")
-		}
-		if spec.Proxy.Port == 0 {
-			return nil, fmt.Errorf("proxy.port must be specified with RollingUpdate strategy")
+		if len(spec.ProxyPorts()) == 0 && spec.Route == nil {
+			return nil, fmt.Errorf("proxy.port or route must be specified with %s strategy", spec.Strategy.Type)
 		}
 	}
 
-	if spec.Proxy.Port > 0 && spec.LivenessProbe.Port() > 0 {
-		return nil, fmt.Errorf("livenessProxy.tcpSocket.port can't be specified with proxy.port")
+	if spec.Route != nil && httpProxy == nil {
+		return nil, fmt.Errorf("route requires proxy.http.port in the Yetis config")
+	}
+
+	if (len(spec.ProxyPorts()) > 0 || spec.Route != nil) && (spec.LivenessProbe.Port() > 0 || hasReadinessOrStartupPort(spec)) {
+		return nil, fmt.Errorf("probe port can't be specified with proxy.port or route")
 	}
 
 	// If the deployment already exists, restart it
-	if d, ok := getDeploymentByRootName(spec.Name); ok {
-		nameNum := d.spec.Name
-		err := restartDeployment(req.Context, nameNum, &spec)
+	if len(getReplicas(spec.Name)) > 0 {
+		err := restartDeployment(req.Context, spec.Name, &spec)
 		if err != nil {
 			return nil, err
 		}
-		return &CRDeploymentResponse{Existed: true}, nil
+		res := &CRDeploymentResponse{Existed: true, PreviewPort: spec.Strategy.PreviewPort}
+		if spec.Strategy.Type == common.Canary {
+			res.CanaryWeight = spec.WithDefaults().(common.DeploymentSpec).Strategy.Canary.Weight
+		}
+		return res, nil
+	}
+
+	for _, port := range spec.ProxyPorts() {
+		if owner, ok := getProxyOwner(port); ok {
+			return nil, fmt.Errorf("proxy.port %d is already used by '%s' deployment", port, owner)
+		}
+	}
+	if port := spec.Strategy.PreviewPort; port > 0 {
+		if owner, ok := getProxyOwner(port); ok {
+			return nil, fmt.Errorf("strategy.previewPort %d is already used by '%s' deployment", port, owner)
+		}
+	}
+	if r := spec.WithDefaults().(common.DeploymentSpec).Route; r != nil {
+		if owner, ok := getRouteOwner(*r); ok {
+			return nil, fmt.Errorf("route %s%s is already used by '%s' deployment", r.Host, r.Path, owner)
+		}
 	}
 
 	if spec.LivenessProbe.Port() > 0 {
@@ -57,32 +81,48 @@ func CreateOrRestartDeployment(req fetch.Request[common.DeploymentSpec]) (*CRDep
 	}
 
 	// Begin creating the deployment
-	spec, err := setYetisPortEnv(spec.WithDefaults().(common.DeploymentSpec))
-	if err != nil {
-		return nil, err
+	spec = spec.WithDefaults().(common.DeploymentSpec)
+	for i := 0; i < spec.Replicas; i++ {
+		_, err := startReplica(spec, i, 0, false)
+		if err != nil {
+			_ = deleteReplicas(req.Context, spec.Name)
+			return nil, err
+		}
 	}
 
-	if spec.Proxy.Port > 0 {
-		err := proxy.CreatePortForwarding(spec.Proxy.Port, spec.LivenessProbe.Port())
+	if ports := spec.ProxyPorts(); len(ports) > 0 || spec.Route != nil {
+		err := syncProxy(spec.Name, ports...)
 		if err != nil {
+			_ = deleteReplicas(req.Context, spec.Name)
 			return nil, fmt.Errorf("failed to create proxy: %s", err)
 		}
 	}
+	recordRevision(spec)
 
-	spec, err = startDeploymentWithEnv(spec, false, false)
+	return &CRDeploymentResponse{Existed: false}, nil
+}
+
+// startReplica starts the replica of the deployment on a new $YETIS_PORT with the liveness check.
+// The spec has the name of the deployment, the returned one has the name of the instance.
+func startReplica(spec common.DeploymentSpec, replica, generation int, upsert bool) (common.DeploymentSpec, error) {
+	return startInstance(spec, instance{name: spec.Name, replica: replica, generation: generation}, upsert)
+}
+
+func startInstance(spec common.DeploymentSpec, inst instance, upsert bool) (common.DeploymentSpec, error) {
+	spec.Name = instanceName(inst.name, inst.replica, inst.generation)
+	spec, err := startReplicaWithEnv(spec, inst, upsert, true)
 	if err != nil {
-		if spec.Proxy.Port > 0 {
-			_ = proxy.DeletePortForwarding(spec.Proxy.Port, spec.LivenessProbe.Port())
-		}
-		return nil, err
+		return spec, err
 	}
-
 	startLivenessCheck(spec)
-
-	return &CRDeploymentResponse{Existed: false}, nil
+	return spec, nil
 }
 
 func startDeploymentWithEnv(spec common.DeploymentSpec, upsert, setYetisPort bool) (common.DeploymentSpec, error) {
+	return startReplicaWithEnv(spec, instance{name: spec.Name}, upsert, setYetisPort)
+}
+
+func startReplicaWithEnv(spec common.DeploymentSpec, inst instance, upsert, setYetisPort bool) (common.DeploymentSpec, error) {
 	var err error
 	if setYetisPort {
 		spec, err = setYetisPortEnv(spec.WithDefaults().(common.DeploymentSpec))
@@ -95,7 +135,7 @@ func startDeploymentWithEnv(spec common.DeploymentSpec, upsert, setYetisPort boo
 		return spec, fmt.Errorf("deployment %s spec is invalid: %s", spec.Name, err)
 	}
 
-	saved := saveDeployment(spec, upsert)
+	saved := saveReplica(spec, inst, upsert)
 	if !saved {
 		return spec, fmt.Errorf("deployment '%s' already exists", spec.Name)
 	}
@@ -111,39 +151,95 @@ func startDeploymentWithEnv(spec common.DeploymentSpec, upsert, setYetisPort boo
 		log.Printf("Failed to update pid after launching process, pid=%d", pid)
 		return spec, err
 	}
+	superviseProcess(spec.Name, pid)
 	return spec, nil
 }
 
 const yetisPortEnv = "YETIS_PORT"
 
+// setYetisPortEnv assigns new ports to $YETIS_PORT and to the named ports.
+// The probes checking the old ones are moved to the new ones, the probes without a port check the target of the first proxy.
 func setYetisPortEnv(c common.DeploymentSpec) (common.DeploymentSpec, error) {
-	freePort, err := common.GetFreePort()
-	if err != nil {
-		return common.DeploymentSpec{}, fmt.Errorf("failed to assigned port: %s", err)
-	}
-	if c.LivenessProbe.Port() == 0 || isYetisPortUsed(c) {
-		c.LivenessProbe.TcpSocket.Port = freePort
+	names := []string{yetisPortEnv}
+	for _, p := range c.Ports {
+		names = append(names, common.PortEnv(p.Name))
+	}
+	assigned := map[string]int{}
+	var ports []int
+	for _, name := range names {
+		freePort, err := getFreePortExcept(ports)
+		if err != nil {
+			return common.DeploymentSpec{}, fmt.Errorf("failed to assigned port: %s", err)
+		}
+		assigned[name] = freePort
+		ports = append(ports, freePort)
 	}
 
+	newSpec := c
 	var newEnvs []common.EnvVar
 	for _, envVar := range c.Env {
-		if envVar.Name == yetisPortEnv {
+		if _, ok := assigned[envVar.Name]; ok {
 			// remove old env
 			continue
 		}
 		newEnvs = append(newEnvs, envVar)
 	}
-	newEnvs = append(newEnvs, common.EnvVar{Name: yetisPortEnv, Value: strconv.Itoa(freePort)})
-	c.Env = newEnvs
-	return c, nil
+	for _, name := range names {
+		newEnvs = append(newEnvs, common.EnvVar{Name: name, Value: strconv.Itoa(assigned[name])})
+	}
+	newSpec.Env = newEnvs
+
+	// newPort returns the port the probe should check after the assignment.
+	newPort := func(port int) int {
+		if port == 0 {
+			return newSpec.DefaultProbePort()
+		}
+		for _, name := range names {
+			if c.GetEnv(name) == strconv.Itoa(port) {
+				return assigned[name]
+			}
+		}
+		return port
+	}
+	// Without proxy, route, httpGet and udpSocket, the probe without a port isn't set and the process is only supervised by its exit.
+	if c.LivenessProbe.Port() > 0 || len(c.ProxyPorts()) > 0 || c.Route != nil || c.LivenessProbe.HttpGet.IsSet() || c.LivenessProbe.UdpSocket != nil {
+		newSpec.LivenessProbe = c.LivenessProbe.WithPort(newPort(c.LivenessProbe.Port()))
+	}
+	if c.ReadinessProbe != nil {
+		p := c.ReadinessProbe.WithPort(newPort(c.ReadinessProbe.Port()))
+		newSpec.ReadinessProbe = &p
+	}
+	if c.StartupProbe != nil {
+		p := c.StartupProbe.WithPort(newPort(c.StartupProbe.Port()))
+		newSpec.StartupProbe = &p
+	}
+	return newSpec, nil
+}
+
+// getFreePortExcept returns a free port which isn't one of the ports just assigned.
+func getFreePortExcept(ports []int) (int, error) {
+	for {
+		port, err := common.GetFreePort()
+		if err != nil || !slices.Contains(ports, port) {
+			return port, err
+		}
+	}
+}
+
+func hasReadinessOrStartupPort(c common.DeploymentSpec) bool {
+	return (c.ReadinessProbe != nil && c.ReadinessProbe.Port() > 0) || (c.StartupProbe != nil && c.StartupProbe.Port() > 0)
 }
 
 func isYetisPortUsed(c common.DeploymentSpec) bool {
-	return c.YetisPort() == c.LivenessProbe.TcpSocket.Port
+	return c.IsYetisPort(c.LivenessProbe.Port())
 }
 
 type DeploymentInfo struct {
-	Name     string
+	// The name of the replica, the instances of the replica during RollingUpdate have the same name.
+	Name string
+	// The name of the process, unique.
+	Instance string
+	Ready    bool
 	Status   string
 	Pid      int
 	Restarts int
@@ -158,11 +254,21 @@ func ListDeployment() ([]DeploymentInfo, error) {
 	var res []DeploymentInfo
 	rangeDeployments(func(name string, p deployment) {
 		portInfo := strconv.Itoa(p.spec.LivenessProbe.Port())
-		if p.spec.Proxy.Port > 0 {
-			portInfo = strconv.Itoa(p.spec.Proxy.Port) + " to " + strconv.Itoa(p.spec.LivenessProbe.Port())
+		if ports := p.proxyPorts(); len(ports) > 0 {
+			var infos []string
+			for _, port := range ports {
+				pr, _ := p.proxyOf(port)
+				infos = append(infos, strconv.Itoa(port)+" to "+strconv.Itoa(p.spec.NamedPort(pr.TargetPort)))
+			}
+			portInfo = strings.Join(infos, ", ")
+			if p.preview {
+				portInfo += " (preview)"
+			}
 		}
 		res = append(res, DeploymentInfo{
-			Name:         name,
+			Name:         replicaName(p.name, p.replica),
+			Instance:     name,
+			Ready:        p.isReady(),
 			Status:       p.status.String(),
 			Pid:          p.pid,
 			Restarts:     p.restarts,
@@ -179,7 +285,7 @@ func ListDeployment() ([]DeploymentInfo, error) {
 
 func sortDeployments(res []DeploymentInfo) {
 	slices.SortFunc(res, func(a, b DeploymentInfo) int {
-		return cmp.Compare(a.Name, b.Name)
+		return cmp.Or(cmp.Compare(a.Name, b.Name), cmp.Compare(a.Instance, b.Instance))
 	})
 }
 
@@ -199,12 +305,24 @@ func ageSince(t time.Time) string {
 }
 
 type DeploymentFullInfo struct {
+	// The name the deployment was applied with.
+	Name string
+	// The name of the process, see Instances for all of them.
+	Instance string
+	Replica  int
+	// True while the BlueGreen instance waits for the promotion.
+	Preview  bool
 	Pid      int
 	Restarts int
 	Status   string
+	Ready    bool
 	Age      string
 	LogPath  string
-	Spec     common.DeploymentSpec
+	// The output of the last exec liveness probe.
+	ProbeOutput string
+	// Nil if the process has never exited.
+	LastTermination *Termination
+	Spec            common.DeploymentSpec
 }
 
 func GetDeployment(r fetch.Request[fetch.Empty]) (*DeploymentFullInfo, error) {
@@ -212,7 +330,7 @@ func GetDeployment(r fetch.Request[fetch.Empty]) (*DeploymentFullInfo, error) {
 	if name == "" {
 		return nil, fmt.Errorf("name can't be empty")
 	}
-	p, ok := deploymentStore.Load(name)
+	p, ok := getInstance(name)
 	if !ok {
 		return nil, fmt.Errorf("name '%s' doesn't exist", name)
 	}
@@ -221,44 +339,184 @@ func GetDeployment(r fetch.Request[fetch.Empty]) (*DeploymentFullInfo, error) {
 }
 
 func deploymentToInfo(p deployment) *DeploymentFullInfo {
+	spec := p.spec
+	spec.Name = p.name
 	return &DeploymentFullInfo{
-		Pid:      p.pid,
-		Restarts: p.restarts,
-		Status:   p.status.String(),
-		Age:      ageSince(p.createdAt),
-		LogPath:  p.logPath,
-		Spec:     p.spec,
+		Name:            p.name,
+		Instance:        p.spec.Name,
+		Replica:         p.replica,
+		Preview:         p.preview,
+		Pid:             p.pid,
+		Restarts:        p.restarts,
+		Status:          p.status.String(),
+		Ready:           p.isReady(),
+		Age:             ageSince(p.createdAt),
+		LogPath:         p.logPath,
+		ProbeOutput:     p.probeOutput,
+		LastTermination: p.lastTermination,
+		Spec:            spec,
 	}
 }
 
+// GetInstances returns all the instances of the deployment, the replicas and the instances of the unfinished RollingUpdate.
+func GetInstances(r fetch.Request[fetch.Empty]) ([]DeploymentFullInfo, error) {
+	name := r.PathValues["name"]
+	if name == "" {
+		return nil, fmt.Errorf("name can't be empty")
+	}
+	replicas := getReplicas(resolveRootName(name))
+	if len(replicas) == 0 {
+		return nil, fmt.Errorf("name '%s' doesn't exist", name)
+	}
+	var res []DeploymentFullInfo
+	for _, d := range replicas {
+		res = append(res, *deploymentToInfo(d))
+	}
+	return res, nil
+}
+
+// DeleteDeployment deletes all the replicas of the deployment.
 func DeleteDeployment(r fetch.Request[fetch.Empty]) error {
 	name := r.PathValues["name"]
 	if name == "" {
 		return fmt.Errorf(`name can't be empty`)
 	}
+	return deleteReplicas(r.Context, resolveRootName(name))
+}
+
+// resolveRootName accepts the name of the deployment, of any of its replicas or instances.
+func resolveRootName(name string) string {
+	if d, ok := getInstance(name); ok {
+		return rootName(d)
+	}
+	return name
+}
+
+func deleteReplicas(ctx context.Context, root string) error {
+	replicas := getReplicas(root)
+	if len(replicas) == 0 {
+		return fmt.Errorf(`'%s' doesn't exist'`, root)
+	}
+	// the steps must not abort or promote the canary being deleted.
+	deleteCanary(root)
+	// all the replicas are taken out of the proxy at once, then drained in parallel.
+	var ports []int
+	for _, d := range replicas {
+		updateDeploymentStatus(d.spec.Name, Terminating)
+		for _, p := range d.proxyPorts() {
+			if !slices.Contains(ports, p) {
+				ports = append(ports, p)
+			}
+		}
+	}
+	logProxyErr(syncProxy(root, ports...))
+	errs := make([]error, len(replicas))
+	var wg sync.WaitGroup
+	for i, d := range replicas {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = deleteInstance(ctx, d.spec.Name)
+		}()
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+	deleteRevisions(root)
+	deleteRollout(root)
+	return nil
+}
 
+// deleteInstance deletes one replica of the deployment.
+func deleteInstance(ctx context.Context, name string) error {
 	d, ok := getDeployment(name)
 	if !ok {
 		return fmt.Errorf(`'%s' doesn't exist'`, name)
 	}
 
 	updateDeploymentStatus(name, Terminating)
-
-	err := terminateProcess(r.Context, d.pid)
+	// stop forwarding new connections to the process before terminating it.
+	logProxyErr(syncProxy(rootName(d), d.proxyPorts()...))
+	if len(d.proxyPorts()) > 0 || d.spec.Route != nil {
+		// the drain doesn't use up the grace period of the termination.
+		drainCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), d.spec.Strategy.DrainDuration()+drainCheckPeriod)
+		drainConnections(drainCtx, d.spec)
+		cancel()
+	}
+
+	termCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), terminationGracePeriod)
+	defer cancel()
+	err := terminateProcess(termCtx, d.pid)
 	if err != nil {
 		return err
 	}
 
 	deleteDeployment(name)
 	deleteLivenessCheck(name)
-	if d.spec.Proxy.Port > 0 {
-		err := proxy.DeletePortForwarding(d.spec.Proxy.Port, d.spec.LivenessProbe.Port())
+	crashLoopMap.Delete(name)
+	logProxyErr(syncProxy(rootName(d), d.proxyPorts()...))
+	log.Printf("Deleted deployment '%s'\n", name)
+	return nil
+}
+
+// How long the process has after SIGTERM before it's killed.
+var terminationGracePeriod = 10 * time.Second
+
+// How often the established connections are counted while draining.
+var drainCheckPeriod = 100 * time.Millisecond
+
+// drainConnections waits for the established connections of the replica to close, at most strategy.drainSeconds.
+// The replica must already be out of the proxy, so that it doesn't get new connections.
+func drainConnections(ctx context.Context, spec common.DeploymentSpec) {
+	timeout := spec.Strategy.DrainDuration()
+	if timeout == 0 {
+		// give it 50 millis in case the deployment doesn't have graceful shutdown
+		time.Sleep(50 * time.Millisecond)
+		return
+	}
+	deadline := time.After(timeout)
+	for {
+		n := establishedConnections(spec)
+		if n == 0 {
+			return
+		}
+		select {
+		case <-deadline:
+			log.Printf("Deployment '%s' still has %d connections after draining for %s\n", spec.Name, n, timeout)
+			return
+		case <-ctx.Done():
+			return
+		case <-time.After(drainCheckPeriod):
+		}
+	}
+}
+
+// establishedConnections counts the connections accepted on $YETIS_PORT and the named ports.
+func establishedConnections(spec common.DeploymentSpec) int {
+	ports := []int{spec.YetisPort()}
+	for _, p := range spec.Ports {
+		ports = append(ports, spec.NamedPort(p.Name))
+	}
+	var count int
+	for _, port := range ports {
+		if port == 0 {
+			continue
+		}
+		n, err := unix.CountEstablished(port)
 		if err != nil {
-			log.Println("Failed to delete port forwarding:", err)
+			log.Printf("Failed to count connections of port %d: %s\n", port, err)
+			return 0
 		}
+		count += n
+	}
+	return count
+}
+
+func logProxyErr(err error) {
+	if err != nil {
+		log.Println("Failed to update port forwarding:", err)
 	}
-	log.Printf("Deleted deployment '%s'\n", name)
-	return nil
 }
 
 func RestartDeployment(r fetch.Request[fetch.Empty]) error {
@@ -266,127 +524,300 @@ func RestartDeployment(r fetch.Request[fetch.Empty]) error {
 	if name == "" {
 		return fmt.Errorf(`name can't be empty`)
 	}
-	return restartDeployment(r.Context, name, nil)
+	return restartDeployment(r.Context, resolveRootName(name), nil)
 }
 
-func restartDeployment(ctx context.Context, name string, reapplySpec *common.DeploymentSpec) error {
-	oldDeployment, ok := getDeployment(name)
-	if !ok {
-		return fmt.Errorf(`deployment '%s' doesn't exist'`, name)
-	}
+type ScaleRequest struct {
+	Replicas int
+}
 
-	if reapplySpec != nil {
-		if oldDeployment.spec.Strategy.Type != reapplySpec.Strategy.Type {
-			return fmt.Errorf("couldn't restart deployment '%s': strategy.type must be the same, delete the existing one and apply again", reapplySpec.Name)
-		}
-		if oldDeployment.spec.Proxy.Port != reapplySpec.Proxy.Port {
-			return fmt.Errorf("couldn't restart deployment '%s': proxy.prot must be the same, delete the existing one and apply again", reapplySpec.Name)
-		}
+func ScaleDeployment(r fetch.Request[ScaleRequest]) error {
+	name := r.PathValues["name"]
+	if name == "" {
+		return fmt.Errorf(`name can't be empty`)
+	}
+	if r.Body.Replicas < 1 {
+		return fmt.Errorf("replicas must be at least 1")
 	}
+	return scaleDeployment(r.Context, resolveRootName(name), r.Body.Replicas)
+}
 
-	deleteLivenessCheck(name)
-	var newSpec common.DeploymentSpec
-	var err error
-	if oldDeployment.spec.Strategy.Type == common.RollingUpdate {
-		// todo reapplySpec for apply restart
-		applySpec := oldDeployment.spec
-		if reapplySpec != nil {
-			applySpec = *reapplySpec
+// scaleDeployment starts or deletes replicas without restarting the others.
+// The deleted replicas are drained from the proxy before the termination.
+func scaleDeployment(ctx context.Context, root string, num int) error {
+	replicas := getReplicas(root)
+	if len(replicas) == 0 {
+		return fmt.Errorf(`deployment '%s' doesn't exist'`, root)
+	}
+	if preview, _ := splitPreview(replicas); len(preview) > 0 {
+		return fmt.Errorf("deployment '%s' has a preview, promote or abort it first", root)
+	}
+	if _, ok := canaries.Load(root); ok {
+		return fmt.Errorf("deployment '%s' has a canary, promote or abort it first", root)
+	}
+	spec := replicas[0].spec
+	spec.Name = root
+	spec.Replicas = num
+	generation := latestGeneration(replicas)
+
+	running := map[int]bool{}
+	for _, d := range replicas {
+		if d.replica < num {
+			running[d.replica] = true
+			// the restart keeps the number of replicas
+			updateDeploymentReplicas(d.spec.Name, num)
+			continue
 		}
-		applySpec.Name = upgradeNameForRollingUpdate(oldDeployment.spec.Name)
-		newSpec, err = startDeploymentWithEnv(applySpec, false, true)
+		err := deleteInstance(ctx, d.spec.Name)
 		if err != nil {
-			return fmt.Errorf("rastart failed: the new rolling deployment of '%s' failed to start: %s", oldDeployment.spec.Name, err)
-		}
-		startLivenessCheck(newSpec)
-		// check that the new deployment is healthy
-
-		duration := 10000*time.Millisecond + newSpec.LivenessProbe.InitialDelayDuration() + time.Duration(newSpec.LivenessProbe.FailureThreshold)*newSpec.LivenessProbe.PeriodDuration()
-		timeout := time.After(duration)
-	loop:
-		for {
-			select {
-			case <-timeout:
-				// don't delete, need to see what went wrong.
-				return fmt.Errorf("rastart failed: the new '%s' deployment isn't healthy: context deadline exceeded", newSpec.Name)
-			default:
-				depStatus, ok := getDeploymentStatus(newSpec.Name)
-				if !ok {
-					// shouldn't happen
-					return fmt.Errorf("rastart failed: new '%s' deployment not found", oldDeployment.spec.Name)
-				}
-				if depStatus == Running {
-					break loop
-				}
-			}
+			return fmt.Errorf("failed to delete replica '%s': %s", d.spec.Name, err)
 		}
-
-		// point to the new port
-		err := proxy.UpdatePortForwarding(newSpec.Proxy.Port, oldDeployment.spec.LivenessProbe.Port(), newSpec.LivenessProbe.Port())
+	}
+	for i := 0; i < num; i++ {
+		if running[i] {
+			continue
+		}
+		_, err := startReplica(spec, i, generation, false)
 		if err != nil {
-			return fmt.Errorf("started new deployment but failed to update proxy: %s", err)
+			return fmt.Errorf("failed to start replica %d of '%s': %s", i, root, err)
 		}
+	}
+	log.Printf("Scaled deployment '%s' to %d replicas\n", root, num)
+	return nil
+}
 
-		// give it 50 millis in case the deployment doesn't have graceful shutdown
-		time.Sleep(50 * time.Millisecond)
+// restartDeployment replaces the replicas one at a time.
+// Reapplying the spec with a different number of replicas starts or deletes the extra ones.
+func restartDeployment(ctx context.Context, root string, reapplySpec *common.DeploymentSpec) error {
+	replicas := getReplicas(root)
+	if len(replicas) == 0 {
+		return fmt.Errorf(`deployment '%s' doesn't exist'`, root)
+	}
+	if preview, _ := splitPreview(replicas); len(preview) > 0 {
+		return fmt.Errorf("deployment '%s' has a preview, promote or abort it first", root)
+	}
+	if _, ok := canaries.Load(root); ok {
+		return fmt.Errorf("deployment '%s' has a canary, promote or abort it first", root)
+	}
+	first := replicas[0]
 
-		// delete old deployment
-		err = DeleteDeployment(fetch.Request[fetch.Empty]{Context: ctx, PathValues: map[string]string{"name": oldDeployment.spec.Name}})
-		if err != nil {
-			return fmt.Errorf("failed to delete old deployment '%s': %s", oldDeployment.spec.Name, err)
+	if reapplySpec != nil {
+		spec := reapplySpec.WithDefaults().(common.DeploymentSpec)
+		reapplySpec = &spec
+		if first.spec.Strategy.Type != reapplySpec.Strategy.Type {
+			return fmt.Errorf("couldn't restart deployment '%s': strategy.type must be the same, delete the existing one and apply again", reapplySpec.Name)
 		}
-
-	} else {
-		err := terminateProcess(ctx, oldDeployment.pid)
-		if err != nil {
-			return fmt.Errorf("failed to terminate deployment's process: %s", err)
+		if !slices.Equal(first.spec.ProxyPorts(), reapplySpec.ProxyPorts()) {
+			return fmt.Errorf("couldn't restart deployment '%s': proxy ports must be the same, delete the existing one and apply again", reapplySpec.Name)
 		}
-		var applySpec = oldDeployment.spec
+		if port := reapplySpec.Strategy.PreviewPort; port > 0 {
+			if owner, ok := getProxyOwner(port); ok && owner != root {
+				return fmt.Errorf("strategy.previewPort %d is already used by '%s' deployment", port, owner)
+			}
+		}
+	}
+
+	applySpec := first.spec
+	if reapplySpec != nil {
+		applySpec = *reapplySpec
+	}
+	applySpec.Name = root
+	// RollingUpdate, BlueGreen and Canary start the new instances next to the old ones.
+	generation := latestGeneration(replicas)
+	if first.spec.Strategy.Type != common.Recreate {
+		generation++
+	}
+
+	startRollout(root)
+	if first.spec.Strategy.Type == common.BlueGreen || first.spec.Strategy.Type == common.Canary {
 		if reapplySpec != nil {
-			applySpec = *reapplySpec
+			// the spec becomes a revision once it's promoted.
+			holdRevision(*reapplySpec)
 		}
-		newSpec, err = startDeploymentWithEnv(applySpec, true, true)
+	}
+	if first.spec.Strategy.Type == common.BlueGreen {
+		err := startPreview(root, applySpec, generation)
 		if err != nil {
-			return fmt.Errorf("faield to start deployment: %s", err)
+			dropRevision(root)
+			finishRollout(root, err, false)
+			return err
 		}
+		previewRollout(root)
+		return nil
+	}
+	if first.spec.Strategy.Type == common.Canary {
+		// startCanary fails the rollout itself, the steps finish it.
+		return startCanary(ctx, root, applySpec, generation)
+	}
+	rolled, err := replaceReplicas(ctx, root, replicas, applySpec, generation)
+	var rolledBack bool
+	if err != nil && first.spec.Strategy.Type == common.RollingUpdate && applySpec.Strategy.RollbackOnFailure {
+		rolledBack = rollBack(ctx, root, first.spec, rolled)
+	}
+	if err == nil && reapplySpec != nil {
+		recordRevision(*reapplySpec)
+	}
+	finishRollout(root, err, rolledBack)
+	return err
+}
 
-		if newSpec.Proxy.Port > 0 {
-			err := proxy.UpdatePortForwarding(newSpec.Proxy.Port, oldDeployment.spec.LivenessProbe.Port(), newSpec.LivenessProbe.Port())
+// replaceReplicas restarts the replicas with the spec one at a time. Returns the numbers of the replicas replaced by RollingUpdate.
+func replaceReplicas(ctx context.Context, root string, replicas []deployment, applySpec common.DeploymentSpec, generation int) ([]int, error) {
+	oldReplicas := map[int]deployment{}
+	num := applySpec.Replicas
+	for _, d := range replicas {
+		oldReplicas[d.replica] = d
+		num = max(num, d.replica+1)
+	}
+	var rolled []int
+	for i := 0; i < num; i++ {
+		old, hasOld := oldReplicas[i]
+		if i >= applySpec.Replicas {
+			err := deleteInstance(ctx, old.spec.Name)
 			if err != nil {
-				return fmt.Errorf("restarted deployment but failed to update proxy port: %s", err)
+				return rolled, fmt.Errorf("failed to delete replica '%s': %s", old.spec.Name, err)
 			}
+			continue
+		}
+		if !hasOld {
+			_, err := startReplica(applySpec, i, generation, false)
+			if err != nil {
+				return rolled, fmt.Errorf("failed to start replica %d of '%s': %s", i, root, err)
+			}
+			continue
+		}
+		var err error
+		if old.spec.Strategy.Type == common.RollingUpdate {
+			err = rollReplica(ctx, old, applySpec, i, generation)
+			if err == nil {
+				rolled = append(rolled, i)
+			}
+		} else {
+			err = recreateReplica(ctx, old, applySpec, i)
+		}
+		if err != nil {
+			return rolled, err
 		}
-
-		startLivenessCheck(newSpec)
 	}
+	return rolled, nil
+}
 
-	return nil
+// rollBack rolls the replicas already replaced by the failed rollout back to the previous spec.
+func rollBack(ctx context.Context, root string, previous common.DeploymentSpec, rolled []int) bool {
+	previous.Name = root
+	previous.Strategy.RollbackOnFailure = false
+	generation := latestGeneration(getReplicas(root)) + 1
+	for _, i := range rolled {
+		current, ok := getInstance(replicaName(root, i))
+		if !ok {
+			continue
+		}
+		err := rollReplica(ctx, current, previous, i, generation)
+		if err != nil {
+			log.Printf("Failed to roll back replica %d of '%s': %s\n", i, root, err)
+			return false
+		}
+	}
+	log.Printf("Rolled back deployment '%s'\n", root)
+	return true
 }
 
-var rollingUpdatePattern = regexp.MustCompile(`^.*-(\d+)$`)
+// rollReplica starts the new replica and deletes the old one once the new one is ready.
+func rollReplica(ctx context.Context, old deployment, applySpec common.DeploymentSpec, replica, generation int) error {
+	deleteLivenessCheck(old.spec.Name)
+	newSpec, err := startReplica(applySpec, replica, generation, false)
+	if err != nil {
+		if applySpec.Strategy.RollbackOnFailure {
+			abortReplica(ctx, old, newSpec.Name)
+		}
+		return fmt.Errorf("rastart failed: the new rolling deployment of '%s' failed to start: %s", old.spec.Name, err)
+	}
+	err = waitReady(newSpec)
+	if err == context.DeadlineExceeded {
+		if applySpec.Strategy.RollbackOnFailure {
+			abortReplica(ctx, old, newSpec.Name)
+			return fmt.Errorf("rastart failed: the new '%s' deployment isn't healthy, rolled back to '%s'", newSpec.Name, old.spec.Name)
+		}
+		// don't delete, need to see what went wrong.
+		return fmt.Errorf("rastart failed: the new '%s' deployment isn't healthy: %s", newSpec.Name, err)
+	}
+	if err != nil {
+		return fmt.Errorf("rastart failed: %s", err)
+	}
 
-func upgradeNameForRollingUpdate(oldName string) string {
-	matchPairs := rollingUpdatePattern.FindStringSubmatchIndex(oldName)
-	if len(matchPairs) < 1 {
-		return oldName + "-1"
+	// forward all the proxy ports to the new replica together
+	err = syncProxy(rootName(old), newSpec.ProxyPorts()...)
+	if err != nil {
+		return fmt.Errorf("started new deployment but failed to update proxy: %s", err)
 	}
-	idx := matchPairs[len(matchPairs)-2]
-	numStr := oldName[idx:]
-	num, err := strconv.Atoi(numStr)
+
+	// delete old deployment, its connections are drained first.
+	err = deleteInstance(ctx, old.spec.Name)
 	if err != nil {
-		return oldName + "-1"
+		return fmt.Errorf("failed to delete old deployment '%s': %s", old.spec.Name, err)
 	}
+	return nil
+}
 
-	return oldName[:idx] + strconv.Itoa(num+1)
+// How long the new instance has to become ready on top of the time its probes need.
+var readyGracePeriod = 10 * time.Second
+
+// waitReady waits for the new instance to become ready within the time its probes need.
+// Returns context.DeadlineExceeded if it isn't healthy by then.
+func waitReady(spec common.DeploymentSpec) error {
+	readiness := spec.LivenessProbe
+	if spec.ReadinessProbe != nil {
+		readiness = *spec.ReadinessProbe
+	}
+	duration := readyGracePeriod + readiness.InitialDelayDuration() + time.Duration(readiness.FailureThreshold)*readiness.PeriodDuration()
+	if spec.StartupProbe != nil {
+		duration += spec.StartupProbe.InitialDelayDuration() + time.Duration(spec.StartupProbe.FailureThreshold)*spec.StartupProbe.PeriodDuration()
+	}
+	timeout := time.After(duration)
+	for {
+		select {
+		case <-timeout:
+			return context.DeadlineExceeded
+		default:
+			d, ok := getDeployment(spec.Name)
+			if !ok {
+				// shouldn't happen
+				return fmt.Errorf("new '%s' deployment not found", spec.Name)
+			}
+			if d.isReady() {
+				return nil
+			}
+		}
+	}
 }
 
-var rollingUpdateRootPattern = regexp.MustCompile(`^(.*)-\d+$`)
+// abortReplica captures the failed new instance into the rollout and terminates it.
+// The old instance stays in the proxy and gets its liveness check back.
+func abortReplica(ctx context.Context, old deployment, newName string) {
+	if d, ok := getDeployment(newName); ok {
+		f := captureFailure(d)
+		setRolloutFailure(rootName(old), f)
+		log.Printf("Rolling back '%s': the new '%s' deployment failed with status %s, restarts %d\n", rootName(old), newName, f.Status, f.Restarts)
+		err := deleteInstance(ctx, newName)
+		if err != nil {
+			log.Printf("Failed to delete the failed '%s' deployment: %s\n", newName, err)
+		}
+	}
+	startLivenessCheck(old.spec)
+}
 
-func rootNameForRollingUpdate(name string) string {
-	matchPairs := rollingUpdateRootPattern.FindStringSubmatchIndex(name)
-	if len(matchPairs) < 1 {
-		return name
+// recreateReplica terminates the old replica and starts the new one in its place.
+func recreateReplica(ctx context.Context, old deployment, applySpec common.DeploymentSpec, replica int) error {
+	deleteLivenessCheck(old.spec.Name)
+	updateDeploymentStatus(old.spec.Name, Terminating)
+	terminationReasons.Store(old.pid, "Restarted")
+	err := terminateProcess(ctx, old.pid)
+	if err != nil {
+		return fmt.Errorf("failed to terminate deployment's process: %s", err)
 	}
-	idx := matchPairs[len(matchPairs)-1]
-	return name[:idx]
+	_, err = startReplica(applySpec, replica, old.generation, true)
+	if err != nil {
+		return fmt.Errorf("faield to start deployment: %s", err)
+	}
+	return nil
 }
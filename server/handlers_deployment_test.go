@@ -1,7 +1,14 @@
 package server
 
 import (
+	"context"
+	"github.com/glossd/yetis/common"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
 	"testing"
+	"time"
 )
 
 func TestSortDeployments(t *testing.T) {
@@ -11,41 +18,161 @@ func TestSortDeployments(t *testing.T) {
 	assert(t, res[1].Name, "b")
 }
 
-func TestUpgradeNameForRollingUpdate(t *testing.T) {
+func TestLegacyRootName(t *testing.T) {
 	type testCase struct {
-		I string
-		O string
+		Name     string
+		Replica  int
+		Strategy common.StrategyType
+		// The names of the other records.
+		Others []string
+		O      string
 	}
 	var cases = []testCase{
-		{I: "hello", O: "hello-1"},
-		{I: "hello--1", O: "hello--2"},
-		{I: "hello-2", O: "hello-3"},
-		{I: "hello-12", O: "hello-13"},
-		{I: "hello-1-sec", O: "hello-1-sec-1"},
+		{Name: "hello-1", Strategy: common.RollingUpdate, Others: []string{"hello"}, O: "hello"},
+		{Name: "hello-12.2", Replica: 2, Strategy: common.RollingUpdate, Others: []string{"hello-11"}, O: "hello"},
+		{Name: "hello-1-sec-1", Strategy: common.RollingUpdate, Others: []string{"hello-1-sec"}, O: "hello-1-sec"},
+		{Name: "hello", Strategy: common.RollingUpdate, Others: []string{"hello-1"}, O: "hello"},
+		// nothing proves -2 is the generation
+		{Name: "api-v-2", Strategy: common.RollingUpdate, O: "api-v-2"},
+		{Name: "api-v-2", Strategy: common.RollingUpdate, Others: []string{"api-v-2", "api"}, O: "api-v-2"},
+		{Name: "worker-2", Strategy: common.Recreate, Others: []string{"worker"}, O: "worker-2"},
+		{Name: "worker-2.1", Replica: 1, Strategy: common.Recreate, O: "worker-2"},
 	}
 	for _, c := range cases {
-		got := upgradeNameForRollingUpdate(c.I)
+		names := append([]string{c.Name}, c.Others...)
+		got := legacyRootName(deploymentRecord{Spec: common.DeploymentSpec{Name: c.Name, Strategy: common.DeploymentStrategy{Type: c.Strategy}}, Replica: c.Replica}, names)
 		if c.O != got {
 			t.Errorf("expected %s, got %s", c.O, got)
 		}
 	}
 }
 
-func TestRootNameForRollingUpdate(t *testing.T) {
-	type testCase struct {
-		I string
-		O string
+func TestSetYetisPortEnv_NamedPorts(t *testing.T) {
+	spec := common.DeploymentSpec{
+		Name:  "named",
+		Cmd:   "sleep 10",
+		Ports: []common.Port{{Name: "admin"}, {Name: "grpc-web"}},
+		Proxy: common.Proxies{{Port: 9090, TargetPort: "admin"}, {Port: 8080}},
+	}.WithDefaults().(common.DeploymentSpec)
+	spec, err := setYetisPortEnv(spec)
+	assert(t, err, nil)
+	yetisPort, admin, grpcWeb := spec.YetisPort(), spec.NamedPort("admin"), spec.GetEnv("YETIS_PORT_GRPC_WEB")
+	if yetisPort == 0 || admin == 0 || grpcWeb == "" || yetisPort == admin {
+		t.Fatalf("expected different ports to be assigned, got %d, %d, %s", yetisPort, admin, grpcWeb)
 	}
-	var cases = []testCase{
-		{I: "hello-1", O: "hello"},
-		{I: "hello", O: "hello"},
-		{I: "hello-12", O: "hello"},
-		{I: "hello-1-sec-1", O: "hello-1-sec"},
+	// the probe checks the target of the first proxy.
+	assert(t, spec.LivenessProbe.Port(), admin)
+
+	restarted, err := setYetisPortEnv(spec)
+	assert(t, err, nil)
+	assert(t, len(restarted.Env), 3)
+	if restarted.NamedPort("admin") == admin {
+		t.Errorf("expected a new admin port")
 	}
-	for _, c := range cases {
-		got := rootNameForRollingUpdate(c.I)
-		if c.O != got {
-			t.Errorf("expected %s, got %s", c.O, got)
+	assert(t, restarted.LivenessProbe.Port(), restarted.NamedPort("admin"))
+}
+
+func TestDrainConnections(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	port := l.Addr().(*net.TCPAddr).Port
+	spec := common.DeploymentSpec{
+		Name:     "drain",
+		Env:      []common.EnvVar{{Name: yetisPortEnv, Value: strconv.Itoa(port)}},
+		Strategy: common.DeploymentStrategy{DrainSeconds: 0.3},
+	}
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	drainConnections(context.Background(), spec)
+	if time.Since(start) < 300*time.Millisecond {
+		t.Errorf("expected to wait for the connection until the timeout, waited %s", time.Since(start))
+	}
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		client.Close()
+		server.Close()
+	}()
+	start = time.Now()
+	spec.Strategy.DrainSeconds = 5
+	drainConnections(context.Background(), spec)
+	if time.Since(start) > time.Second {
+		t.Errorf("expected to stop waiting once the connection closed, waited %s", time.Since(start))
+	}
+}
+
+func TestDeleteInstance_GracePeriodAfterDrain(t *testing.T) {
+	backend := newFakeBackend()
+	useProxyBackend(t, backend)
+
+	marker := filepath.Join(t.TempDir(), "terminated")
+	spec := common.DeploymentSpec{
+		Name:          "grace",
+		Cmd:           `sh -c 'trap "touch ` + marker + `; exit 0" TERM; while true; do sleep 0.01; done'`,
+		Logdir:        "stdout",
+		Proxy:         common.Proxies{{Port: common.MustGetFreePort()}},
+		Strategy:      common.DeploymentStrategy{DrainSeconds: 0.1},
+		LivenessProbe: common.Probe{Exec: common.Exec{Command: "true"}, InitialDelaySeconds: 0.01, PeriodSeconds: 0.1},
+	}.WithDefaults().(common.DeploymentSpec)
+	_, err := startReplica(spec, 0, 0, false)
+	assert(t, err, nil)
+	time.Sleep(100 * time.Millisecond)
+
+	// the caller's deadline is already over, the process still gets SIGTERM before SIGKILL.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	<-ctx.Done()
+	assert(t, deleteInstance(ctx, "grace"), nil)
+	if _, err := os.Stat(marker); err != nil {
+		t.Errorf("expected the process to handle SIGTERM: %s", err)
+	}
+}
+
+func TestDeleteReplicas_DrainInParallel(t *testing.T) {
+	backend := newFakeBackend()
+	useProxyBackend(t, backend)
+
+	proxyPort := common.MustGetFreePort()
+	for i := 0; i < 2; i++ {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		client, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		server, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
 		}
+		defer server.Close()
+		spec := common.DeploymentSpec{
+			Name:     replicaName("parallel", i),
+			Env:      []common.EnvVar{{Name: yetisPortEnv, Value: strconv.Itoa(l.Addr().(*net.TCPAddr).Port)}},
+			Proxy:    common.Proxies{{Port: proxyPort}},
+			Strategy: common.DeploymentStrategy{DrainSeconds: 0.3},
+		}
+		deploymentStore.Store(spec.Name, deployment{status: Running, spec: spec, instance: instance{name: "parallel", replica: i}})
+	}
+
+	start := time.Now()
+	assert(t, deleteReplicas(context.Background(), "parallel"), nil)
+	if time.Since(start) > 550*time.Millisecond {
+		t.Errorf("expected the replicas to drain in parallel, took %s", time.Since(start))
 	}
+	assert(t, len(getReplicas("parallel")), 0)
 }
@@ -2,10 +2,20 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
+	"fmt"
 	"github.com/glossd/yetis/common"
-	"github.com/glossd/yetis/proxy"
+	"github.com/glossd/yetis/common/unix"
+	"io"
 	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
 	"time"
+	"unicode/utf8"
 )
 
 // name -> Threshold
@@ -19,9 +29,19 @@ type Threshold struct {
 
 const defaultRestartLimit = 2
 
-// Non-blocking
+// Non-blocking. Starts readiness check as well.
+// Without probes the deployment is considered running once launched.
 func startLivenessCheck(c common.DeploymentSpec) {
-	runLivenessCheck(c.Name, c.LivenessProbe.InitialDelayDuration(), c.LivenessProbe.PeriodDuration(), defaultRestartLimit, nil)
+	startReadinessCheck(c)
+	if !hasHealthCheck(c) {
+		updateDeploymentStatus(c.Name, Running)
+		return
+	}
+	first := c.LivenessProbe
+	if c.StartupProbe != nil {
+		first = *c.StartupProbe
+	}
+	runLivenessCheck(c.Name, first.InitialDelayDuration(), first.PeriodDuration(), defaultRestartLimit, nil)
 }
 
 // Non-blocking.
@@ -40,19 +60,28 @@ func runLivenessCheck(name string, init, period time.Duration, restartsLimit int
 			cleanUp()
 			return
 		case <-time.After(init):
-			var ticker = time.NewTicker(period).C
+			var ticker = time.NewTicker(period)
+			defer ticker.Stop()
+			// startupProbe and livenessProbe can have different periods.
+			resetPeriod := func() {
+				if p := probePeriod(name, period); p != period {
+					period = p
+					ticker.Reset(p)
+				}
+			}
 
 			// check instantly
 			if t := heartbeat(name, restartsLimit); t == dead {
 				cleanUp()
 				return
 			}
+			resetPeriod()
 			for {
 				select {
 				case <-stop:
 					cleanUp()
 					return
-				case <-ticker:
+				case <-ticker.C:
 					switch heartbeat(name, restartsLimit) {
 					case dead:
 						cleanUp()
@@ -67,15 +96,17 @@ func runLivenessCheck(name string, init, period time.Duration, restartsLimit int
 							return
 						}
 					}
+					resetPeriod()
 				}
 			}
 		}
 	}()
 }
 
-// Blocking
+// Blocking. Deletes readiness check as well.
 // * it seems timeout happens during TestLivenessRestart on server shutdown.
 func deleteLivenessCheck(name string) bool {
+	deleteReadinessCheck(name)
 	v, ok := livenessMap.Load(name)
 	if ok {
 		select {
@@ -104,18 +135,23 @@ func heartbeat(deploymentName string, restartsLimit int) heartbeatResult {
 		// release go routine for GC
 		return dead
 	}
-	if dep.status == Terminating {
+	if dep.status == Terminating || dep.status == BackOff || dep.exited {
 		return alive
 	}
 
-	var port = dep.spec.LivenessProbe.Port()
+	starting := isStarting(dep)
+	pr := activeProbe(dep)
 	// Remove 10 milliseconds for everything to process and wait for the new tick.
-	portOpen := isPortOpen(port, dep.spec.LivenessProbe.PeriodDuration()-10*time.Millisecond)
+	healthy, output := probe(dep, pr, pr.PeriodDuration()-10*time.Millisecond)
+	countCanaryProbe(dep, healthy)
+	if pr.Exec.IsSet() {
+		updateDeploymentProbeOutput(dep.spec.Name, output)
+	}
 	tsh, ok := thresholdMap.Load(dep.spec.Name)
 	if !ok {
 		tsh = Threshold{}
 	}
-	if portOpen {
+	if healthy {
 		tsh.FailureCount = 0
 		tsh.SuccessCount++
 	} else {
@@ -124,7 +160,7 @@ func heartbeat(deploymentName string, restartsLimit int) heartbeatResult {
 	}
 	thresholdMap.Store(dep.spec.Name, tsh)
 
-	if tsh.FailureCount >= dep.spec.LivenessProbe.FailureThreshold {
+	if tsh.FailureCount >= pr.FailureThreshold {
 		p, ok := getDeployment(dep.spec.Name)
 		oldSpec := p.spec
 		if !ok {
@@ -137,8 +173,20 @@ func heartbeat(deploymentName string, restartsLimit int) heartbeatResult {
 			AlertFail(oldSpec.Name)
 			return tryAgain
 		}
-		log.Printf("Restarting '%s' deployment, failureThreshold was reached\n", oldSpec.Name)
-		updateDeploymentStatus(oldSpec.Name, Terminating)
+		if starting {
+			log.Printf("Restarting '%s' deployment, failureThreshold of startupProbe was reached\n", oldSpec.Name)
+		} else {
+			log.Printf("Restarting '%s' deployment, failureThreshold was reached\n", oldSpec.Name)
+		}
+		if !markTerminating(oldSpec.Name, p.pid) {
+			// the process exited and is being restarted.
+			return alive
+		}
+		if starting {
+			terminationReasons.Store(p.pid, "StartupProbeFailed")
+		} else {
+			terminationReasons.Store(p.pid, "LivenessProbeFailed")
+		}
 		ctx, cancelCtx := context.WithTimeout(context.Background(), oldSpec.LivenessProbe.PeriodDuration())
 		defer cancelCtx()
 		err := terminateProcess(ctx, p.pid)
@@ -148,35 +196,24 @@ func heartbeat(deploymentName string, restartsLimit int) heartbeatResult {
 			log.Printf("terminated '%s' deployment, pid=%d\n", oldSpec.Name, p.pid)
 		}
 
-		updateDeploymentStatus(oldSpec.Name, Pending)
-
-		newSpec, err := setYetisPortEnv(oldSpec)
-		if err != nil {
-			log.Printf("failed to set prot env for %s deployment: %s \n", newSpec.Name, err)
-			return alive
-		}
-
-		_ = updateDeployment(newSpec, 0, "", false)
-		pid, logPath, err := launchProcess(newSpec, false)
+		newSpec, err := relaunchDeployment(p)
 		if err != nil {
 			log.Printf("Liveness failed to restart deployment '%s': %s\n", newSpec.Name, err)
 		}
-		_ = updateDeployment(newSpec, pid, logPath, true)
-		thresholdMap.Delete(newSpec.Name)
-		if newSpec.Proxy.Port > 0 {
-			err := proxy.UpdatePortForwarding(newSpec.Proxy.Port, p.spec.LivenessProbe.Port(), newSpec.LivenessProbe.Port())
-			if err != nil {
-				log.Printf("Liveness restarted deployment, but failed to restart service: %s", err)
-			} else {
-				log.Printf("Liveness changed service of '%s' target port to %d\n", newSpec.Name, newSpec.LivenessProbe.Port())
-			}
-		}
 
-		// wait for initial delay
-		time.Sleep(newSpec.LivenessProbe.InitialDelayDuration())
+		// wait for initial delay, the new process starts with startupProbe if it's specified.
+		if newSpec.StartupProbe != nil {
+			time.Sleep(newSpec.StartupProbe.InitialDelayDuration())
+		} else {
+			time.Sleep(newSpec.LivenessProbe.InitialDelayDuration())
+		}
 		return alive
 	}
-	if tsh.SuccessCount >= dep.spec.LivenessProbe.SuccessThreshold {
+	if tsh.SuccessCount >= pr.SuccessThreshold {
+		if starting {
+			setDeploymentStarted(dep.spec.Name)
+			thresholdMap.Delete(dep.spec.Name)
+		}
 		updateDeploymentStatus(dep.spec.Name, Running)
 		if dep.status != Running { // if it wasn't already running
 			// Status could be Pending after Failed. Threshold could be cleaned after Failed.
@@ -188,11 +225,154 @@ func heartbeat(deploymentName string, restartsLimit int) heartbeatResult {
 	return alive
 }
 
+// isStarting returns true until startupProbe succeeds.
+func isStarting(d deployment) bool {
+	return d.spec.StartupProbe != nil && !d.started
+}
+
+// activeProbe returns startupProbe until it succeeds, then livenessProbe.
+func activeProbe(d deployment) common.Probe {
+	if isStarting(d) {
+		return *d.spec.StartupProbe
+	}
+	return d.spec.LivenessProbe
+}
+
+func probePeriod(name string, def time.Duration) time.Duration {
+	d, ok := getDeployment(name)
+	if !ok {
+		return def
+	}
+	return activeProbe(d).PeriodDuration()
+}
+
+// probe returns true if the deployment is healthy. The output is only returned by exec probe.
+func probe(d deployment, p common.Probe, timeout time.Duration) (bool, string) {
+	if p.Exec.IsSet() {
+		return isExecOK(d.spec, p.Exec, min(timeout, p.Exec.TimeoutDuration()))
+	}
+	if p.HttpGet.IsSet() {
+		return isHttpGetOK(p.HttpGet, timeout), ""
+	}
+	if p.UdpSocket != nil {
+		return isUdpPortBound(d.pid, p.UdpSocket.Port), ""
+	}
+	return isPortOpen(p.Host(), p.Port(), timeout), ""
+}
+
+func isUdpPortBound(pid, port int) bool {
+	if isPortOpenMock != nil {
+		return *isPortOpenMock
+	}
+	bound, err := unix.IsUDPPortBound(pid, port)
+	if err != nil {
+		log.Printf("udpSocket probe: %s\n", err)
+	}
+	return bound
+}
+
 var isPortOpenMock *bool
 
-func isPortOpen(port int, dur time.Duration) bool {
+func isPortOpen(host string, port int, dur time.Duration) bool {
+	if isPortOpenMock != nil {
+		return *isPortOpenMock
+	}
+	return common.DialHostPort(host, port, dur) == nil
+}
+
+// isHttpGetOK tries the hosts of both IPv4 and IPv6 at the same time if the host isn't specified, the first one to respond decides.
+func isHttpGetOK(h common.HttpGet, timeout time.Duration) bool {
 	if isPortOpenMock != nil {
 		return *isPortOpenMock
 	}
-	return common.DialPort(port, dur) == nil
+	hosts := []string{h.Host}
+	if h.Host == "" {
+		hosts = common.LoopbackHosts
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	type result struct {
+		ok  bool
+		err error
+	}
+	results := make(chan result, len(hosts))
+	for _, host := range hosts {
+		go func() {
+			ok, err := httpGet(ctx, h, host)
+			results <- result{ok: ok, err: err}
+		}()
+	}
+	for range hosts {
+		r := <-results
+		if r.err == nil {
+			return r.ok
+		}
+	}
+	return false
+}
+
+// Like Kubernetes, the probe doesn't verify the certificate and opens a new connection every time.
+var probeTransport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, DisableKeepAlives: true}
+
+func httpGet(ctx context.Context, h common.HttpGet, host string) (bool, error) {
+	url := fmt.Sprintf("%s://%s%s", strings.ToLower(h.Scheme), net.JoinHostPort(host, strconv.Itoa(h.Port)), h.Path)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		log.Printf("httpGet probe: invalid request %s: %s\n", url, err)
+		return false, err
+	}
+	for _, header := range h.HttpHeaders {
+		req.Header.Add(header.Name, header.Value)
+	}
+	client := http.Client{Transport: probeTransport}
+	res, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+	_, _ = io.Copy(io.Discard, res.Body)
+	return res.StatusCode >= h.MinStatus && res.StatusCode <= h.MaxStatus, nil
+}
+
+// The output of the exec probe is trimmed to this size.
+const maxProbeOutput = 1024
+
+// trimProbeOutput keeps the end of the output, the cut doesn't split a rune.
+func trimProbeOutput(output string) string {
+	if len(output) <= maxProbeOutput {
+		return output
+	}
+	i := len(output) - maxProbeOutput
+	for i < len(output) && !utf8.RuneStart(output[i]) {
+		i++
+	}
+	return output[i:]
+}
+
+func isExecOK(spec common.DeploymentSpec, e common.Exec, timeout time.Duration) (bool, string) {
+	if isPortOpenMock != nil {
+		return *isPortOpenMock, ""
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "sh", "-c", e.Command)
+	cmd.Dir = spec.Workdir
+	cmd.Env = os.Environ()
+	for _, envVar := range spec.Env {
+		cmd.Env = append(cmd.Env, envVar.Name+"="+envValue(spec, envVar))
+	}
+	// Children of the command could keep the output open.
+	cmd.WaitDelay = 100 * time.Millisecond
+	out, err := cmd.CombinedOutput()
+	output := trimProbeOutput(strings.TrimSpace(string(out)))
+	if err != nil {
+		if ctx.Err() != nil {
+			err = fmt.Errorf("timed out after %s", timeout)
+		}
+		if output == "" {
+			return false, err.Error()
+		}
+		return false, output + "\n" + err.Error()
+	}
+	return true, output
 }
@@ -2,14 +2,20 @@ package server
 
 import (
 	"github.com/glossd/yetis/common"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
 	"testing"
 	"time"
+	"unicode/utf8"
 )
 
 func TestLivenessFailed(t *testing.T) {
 	config := common.DeploymentSpec{
 		Name:   "liveness",
-		Cmd:    "echo 'Liveness Test'",
+		Cmd:    "sleep 10",
 		Logdir: "stdout",
 		LivenessProbe: common.Probe{
 			TcpSocket:           common.TcpSocket{Port: 27000},
@@ -48,7 +54,7 @@ func TestLivenessFailed(t *testing.T) {
 func TestLivenessResurrection(t *testing.T) {
 	config := common.DeploymentSpec{
 		Name:   "liveness",
-		Cmd:    "echo 'Liveness Test'",
+		Cmd:    "sleep 10",
 		Logdir: "stdout",
 		LivenessProbe: common.Probe{
 			TcpSocket:           common.TcpSocket{Port: 27000},
@@ -77,6 +83,195 @@ func TestLivenessResurrection(t *testing.T) {
 	assertD(t, Running, 1)
 }
 
+func TestStartupProbe(t *testing.T) {
+	config := common.DeploymentSpec{
+		Name:   "liveness",
+		Cmd:    "sleep 10",
+		Logdir: "stdout",
+		LivenessProbe: common.Probe{
+			TcpSocket:           common.TcpSocket{Port: 27000},
+			InitialDelaySeconds: 0.01,
+			FailureThreshold:    1,
+			SuccessThreshold:    1,
+		},
+		StartupProbe: &common.Probe{
+			TcpSocket:           common.TcpSocket{Port: 27000},
+			InitialDelaySeconds: 0.01,
+			FailureThreshold:    3,
+			SuccessThreshold:    1,
+		},
+	}
+	_, err := startDeploymentWithEnv(config, false, true)
+	assert(t, err, nil)
+	defer deleteDeployment(config.Name)
+	isPortOpenMock = BoolPtr(false)
+	defer func() { isPortOpenMock = nil }()
+	// startupProbe tolerates more failures than livenessProbe
+	heartbeat(config.Name, 2)
+	heartbeat(config.Name, 2)
+	assertD(t, Pending, 0)
+	isPortOpenMock = BoolPtr(true)
+	heartbeat(config.Name, 2)
+	assertD(t, Running, 0)
+	d, _ := getDeployment(config.Name)
+	assert(t, d.started, true)
+	isPortOpenMock = BoolPtr(false)
+	heartbeat(config.Name, 2)
+	assertD(t, Pending, 1)
+	d, _ = getDeployment(config.Name)
+	assert(t, d.started, false)
+}
+
+func TestReadinessProbe(t *testing.T) {
+	config := common.DeploymentSpec{
+		Name:          "liveness",
+		Cmd:           "sleep 10",
+		Logdir:        "stdout",
+		LivenessProbe: common.Probe{TcpSocket: common.TcpSocket{Port: 27000}},
+		ReadinessProbe: &common.Probe{
+			TcpSocket:        common.TcpSocket{Port: 27000},
+			FailureThreshold: 2,
+			SuccessThreshold: 2,
+		},
+	}
+	_, err := startDeploymentWithEnv(config, false, true)
+	assert(t, err, nil)
+	defer deleteDeployment(config.Name)
+	isPortOpenMock = BoolPtr(true)
+	defer func() { isPortOpenMock = nil }()
+	heartbeat(config.Name, 2)
+	assertD(t, Running, 0)
+	assertReady := func(ready bool) {
+		t.Helper()
+		d, _ := getDeployment(config.Name)
+		assert(t, d.isReady(), ready)
+	}
+	assertReady(false)
+	readinessbeat(config.Name)
+	assertReady(false)
+	readinessbeat(config.Name)
+	assertReady(true)
+	isPortOpenMock = BoolPtr(false)
+	readinessbeat(config.Name)
+	assertReady(true)
+	readinessbeat(config.Name)
+	assertReady(false)
+	// readiness doesn't restart the deployment
+	assertD(t, Running, 0)
+}
+
+func TestIsHttpGetOK(t *testing.T) {
+	var status = http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" || r.Header.Get("X-Probe") != "yetis" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+	port := srv.Listener.Addr().(*net.TCPAddr).Port
+
+	h := common.DeploymentSpec{LivenessProbe: common.Probe{HttpGet: common.HttpGet{
+		Path:        "/healthz",
+		Port:        port,
+		HttpHeaders: []common.HttpHeader{{Name: "X-Probe", Value: "yetis"}},
+	}}}.WithDefaults().(common.DeploymentSpec).LivenessProbe.HttpGet
+
+	assert(t, isHttpGetOK(h, time.Second), true)
+	status = http.StatusInternalServerError
+	assert(t, isHttpGetOK(h, time.Second), false)
+	h.MaxStatus = 599
+	assert(t, isHttpGetOK(h, time.Second), true)
+	h.MaxStatus = 499
+	h.Path = "/bogus"
+	assert(t, isHttpGetOK(h, time.Second), true)
+	h.MaxStatus = 399
+	assert(t, isHttpGetOK(h, time.Second), false)
+}
+
+func TestIsHttpGetOK_NoIdleConnections(t *testing.T) {
+	var open atomic.Int64
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		switch state {
+		case http.StateNew:
+			open.Add(1)
+		case http.StateClosed, http.StateHijacked:
+			open.Add(-1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+	port := srv.Listener.Addr().(*net.TCPAddr).Port
+
+	h := common.HttpGet{Path: "/", Port: port, Scheme: "HTTP", MinStatus: 200, MaxStatus: 399}
+	for i := 0; i < 5; i++ {
+		assert(t, isHttpGetOK(h, time.Second), true)
+	}
+	for i := 0; i < 20 && open.Load() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert(t, open.Load(), int64(0))
+}
+
+func TestIsHttpGetOK_IPv6(t *testing.T) {
+	l, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skip("no IPv6 loopback")
+	}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.Listener = l
+	srv.Start()
+	defer srv.Close()
+	port := l.Addr().(*net.TCPAddr).Port
+
+	h := common.HttpGet{Path: "/", Port: port, Scheme: "HTTP", MinStatus: 200, MaxStatus: 399}
+	assert(t, isHttpGetOK(h, time.Second), true)
+	h.Host = "::1"
+	assert(t, isHttpGetOK(h, time.Second), true)
+	h.Host = "127.0.0.1"
+	assert(t, isHttpGetOK(h, time.Second), false)
+}
+
+func TestProbe_UdpSocket(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := conn.LocalAddr().(*net.UDPAddr).Port
+	p := common.Probe{UdpSocket: &common.UdpSocket{Port: port}}
+	ok, _ := probe(deployment{pid: os.Getpid()}, p, time.Second)
+	assert(t, ok, true)
+	conn.Close()
+	ok, _ = probe(deployment{pid: os.Getpid()}, p, time.Second)
+	assert(t, ok, false)
+}
+
+func TestIsExecOK(t *testing.T) {
+	spec := common.DeploymentSpec{
+		Workdir: "./logcounter",
+		Env:     []common.EnvVar{{Name: "YETIS_FOO", Value: "foo"}, {Name: "PORT", Value: "$YETIS_PORT"}, {Name: "YETIS_PORT", Value: "1234"}},
+	}
+	ok, out := isExecOK(spec, common.Exec{Command: "ls && echo $YETIS_FOO $PORT"}, time.Second)
+	assert(t, ok, true)
+	assert(t, out, "hello-service-3.log\nfoo 1234")
+
+	ok, out = isExecOK(spec, common.Exec{Command: "echo failure && exit 3"}, time.Second)
+	assert(t, ok, false)
+	assert(t, out, "failure\nexit status 3")
+
+	ok, out = isExecOK(spec, common.Exec{Command: "sleep 1"}, 10*time.Millisecond)
+	assert(t, ok, false)
+	assert(t, out, "timed out after 10ms")
+
+	// 1200 bytes of 3-byte runes, the cut moves to the start of the next rune.
+	ok, out = isExecOK(spec, common.Exec{Command: "i=0; while [ $i -lt 400 ]; do printf '€'; i=$((i+1)); done"}, time.Second)
+	assert(t, ok, true)
+	assert(t, utf8.ValidString(out), true)
+	assert(t, len(out), 1023)
+}
+
 func assertD(t *testing.T, status ProcessStatus, restarts int) {
 	t.Helper()
 	d, ok := getDeployment("liveness")
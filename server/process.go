@@ -16,6 +16,9 @@ import (
 	"syscall"
 )
 
+// pid -> started command, waiting to be supervised.
+var launchedCmds = common.Map[int, *exec.Cmd]{}
+
 var logNamePattern = regexp.MustCompile("^[a-zA-Z]+-(\\d+).log$")
 
 func launchProcess(c common.DeploymentSpec, wait bool) (pid int, logPath string, err error) {
@@ -29,7 +32,7 @@ func launchProcess(c common.DeploymentSpec, wait bool) (pid int, logPath string,
 		if err != nil {
 			return 0, "", fmt.Errorf("failed to create log file for '%s': %s", c.Name, err)
 		}
-		// todo close the file
+		// the file is closed once the process exits, see superviseProcess.
 		pid, err = launchProcessWithOut(c, file, wait)
 		return pid, fullPath, err
 	}
@@ -49,10 +52,7 @@ func launchProcessWithOut(c common.DeploymentSpec, w io.Writer, wait bool) (int,
 		if i > 0 {
 			ev.WriteString(" ")
 		}
-		val := envVar.Value
-		if val == "$"+yetisPortEnv {
-			val = strconv.Itoa(c.YetisPort())
-		}
+		val := envValue(c, envVar)
 		if strings.Contains(envVar.Value, "'") {
 			// escaping single quotes.
 			val = strings.ReplaceAll(val, "'", `'\''`)
@@ -63,7 +63,7 @@ func launchProcessWithOut(c common.DeploymentSpec, w io.Writer, wait bool) (int,
 	if err != nil {
 		return 0, err
 	}
-	shCmd := append([]string{"sh", "-c", ev.String() + " " + c.Cmd})
+	shCmd := []string{"sh", "-c", ev.String() + " " + c.Cmd}
 	cmd := exec.Command(shCmd[0], shCmd[1:]...)
 	if w != nil {
 		cmd.Stdout = w
@@ -82,6 +82,9 @@ func launchProcessWithOut(c common.DeploymentSpec, w io.Writer, wait bool) (int,
 		return 0, err
 	}
 	pid := cmd.Process.Pid
+	if !wait {
+		launchedCmds.Store(pid, cmd)
+	}
 
 	if isYetisPortUsed(c) {
 		log.Printf("launched '%s' deployment with port=%d, pid=%d\n", c.Name, c.LivenessProbe.Port(), pid)
@@ -95,6 +98,19 @@ func launchProcessWithOut(c common.DeploymentSpec, w io.Writer, wait bool) (int,
 	return pid, nil
 }
 
+// envValue resolves $YETIS_PORT and the named ports which are assigned on the server.
+func envValue(c common.DeploymentSpec, envVar common.EnvVar) string {
+	if envVar.Value == "$"+yetisPortEnv {
+		return strconv.Itoa(c.YetisPort())
+	}
+	for _, p := range c.Ports {
+		if envVar.Value == "$"+common.PortEnv(p.Name) {
+			return strconv.Itoa(c.NamedPort(p.Name))
+		}
+	}
+	return envVar.Value
+}
+
 func checkExecutable(c common.DeploymentSpec) error {
 	firstExec := strings.Split(c.Cmd, " ")[0]
 	if !unix.ExecutableExists(firstExec) {
@@ -130,6 +146,12 @@ func getLogCounter(name, logDir string) int {
 
 func terminateProcess(ctx context.Context, pid int) error {
 	if pid != 0 {
+		if !unix.IsProcessAlive(pid) {
+			// The process has already exited and been reaped, but its children could still be alive.
+			// The session id and the process group id are equal to the pid.
+			_ = syscall.Kill(-pid, syscall.SIGKILL)
+			return nil
+		}
 		err := unix.TerminateSession(ctx, pid)
 		if err != nil && err != context.DeadlineExceeded {
 			return err
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"github.com/glossd/yetis/common"
+	"time"
+)
+
+// name -> Threshold
+var readinessThresholdMap = common.Map[string, Threshold]{}
+var readinessMap = common.Map[string, chan bool]{}
+
+// Non-blocking. Does nothing if readinessProbe isn't specified.
+func startReadinessCheck(c common.DeploymentSpec) {
+	if c.ReadinessProbe == nil {
+		return
+	}
+	name := c.Name
+	init, period := c.ReadinessProbe.InitialDelayDuration(), c.ReadinessProbe.PeriodDuration()
+	stop := make(chan bool)
+	readinessMap.Store(name, stop)
+	go func() {
+		defer readinessThresholdMap.Delete(name)
+		select {
+		case <-stop:
+			return
+		case <-time.After(init):
+			var ticker = time.NewTicker(period)
+			defer ticker.Stop()
+			for {
+				if !readinessbeat(name) {
+					return
+				}
+				select {
+				case <-stop:
+					return
+				case <-ticker.C:
+				}
+			}
+		}
+	}()
+}
+
+// Non-blocking.
+func deleteReadinessCheck(name string) {
+	v, ok := readinessMap.LoadAndDelete(name)
+	if ok {
+		close(v)
+	}
+}
+
+// readinessbeat updates the readiness of the deployment.
+// Returns false if the deployment doesn't exist anymore.
+func readinessbeat(deploymentName string) bool {
+	dep, ok := getDeployment(deploymentName)
+	if !ok {
+		return false
+	}
+	if dep.spec.ReadinessProbe == nil {
+		return false
+	}
+	if dep.status == Terminating || dep.pid == 0 || isStarting(dep) {
+		return true
+	}
+
+	pr := *dep.spec.ReadinessProbe
+	healthy, _ := probe(dep, pr, pr.PeriodDuration()-10*time.Millisecond)
+	countCanaryProbe(dep, healthy)
+	tsh, ok := readinessThresholdMap.Load(deploymentName)
+	if !ok {
+		tsh = Threshold{}
+	}
+	if healthy {
+		tsh.FailureCount = 0
+		tsh.SuccessCount++
+	} else {
+		tsh.FailureCount++
+		tsh.SuccessCount = 0
+	}
+	readinessThresholdMap.Store(deploymentName, tsh)
+
+	if tsh.SuccessCount >= pr.SuccessThreshold && !dep.ready {
+		updateDeploymentReady(deploymentName, true)
+	}
+	if tsh.FailureCount >= pr.FailureThreshold && dep.ready {
+		updateDeploymentReady(deploymentName, false)
+	}
+	return true
+}
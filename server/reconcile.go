@@ -0,0 +1,134 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/glossd/fetch"
+	"github.com/glossd/yetis/proxy"
+	"log"
+	"slices"
+	"time"
+)
+
+// How often the proxy rules on the host are compared with the deployments.
+var reconcilePeriod = time.Minute
+
+type ProxyChange struct {
+	Name   string
+	Port   int
+	Action string // deleted, repaired or created
+	From   []int
+	To     []int
+}
+
+func (c ProxyChange) String() string {
+	if c.Name == "" {
+		return fmt.Sprintf("%s legacy proxy port %d: %v -> %v", c.Action, c.Port, c.From, c.To)
+	}
+	return fmt.Sprintf("%s proxy port %d of '%s' deployment: %v -> %v", c.Action, c.Port, c.Name, c.From, c.To)
+}
+
+type ReconcileResponse struct {
+	Changes []ProxyChange
+}
+
+func ReconcileProxy(_ fetch.Empty) (*ReconcileResponse, error) {
+	changes, err := reconcileProxy()
+	if err != nil {
+		return nil, err
+	}
+	return &ReconcileResponse{Changes: changes}, nil
+}
+
+// reconcileProxy makes the forwardings on the host match the deployments.
+// The forwardings without a deployment and the ones left by the older versions of Yetis are deleted,
+// the ones pointing at the wrong ports are repaired and the missing ones are created.
+func reconcileProxy() ([]ProxyChange, error) {
+	proxyLock.Lock()
+	defer proxyLock.Unlock()
+	present, err := listForwardings()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list proxy rules: %s", err)
+	}
+
+	desired := map[int]proxy.Forwarding{}
+	rangeDeployments(func(name string, d deployment) {
+		for _, port := range d.proxyPorts() {
+			if _, ok := desired[port]; !ok {
+				desired[port] = proxyForwarding(rootName(d), port)
+			}
+		}
+	})
+
+	var changes []ProxyChange
+	var errs []error
+	if cleaner, ok := proxyBackend.(proxy.LegacyCleaner); ok {
+		legacy, err := cleaner.DeleteLegacy()
+		for _, f := range legacy {
+			c := ProxyChange{Port: f.FromPort, Action: "deleted", From: f.ToPorts}
+			log.Printf("Reconciled %s\n", c)
+			changes = append(changes, c)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to delete legacy proxy rules: %s", err))
+		}
+	}
+	apply := func(c ProxyChange, prev, f proxy.Forwarding) {
+		err := setForwarding(prev, true, f)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to reconcile port %d of '%s': %s", c.Port, c.Name, err))
+			return
+		}
+		if len(f.ToPorts) == 0 {
+			proxyTargets.Delete(c.Port)
+		} else {
+			proxyTargets.Store(c.Port, f)
+		}
+		log.Printf("Reconciled %s\n", c)
+		changes = append(changes, c)
+	}
+
+	for _, f := range present {
+		want, ok := desired[f.FromPort]
+		switch {
+		case !ok || want.Name != f.Name || len(want.ToPorts) == 0:
+			apply(ProxyChange{Name: f.Name, Port: f.FromPort, Action: "deleted", From: f.ToPorts}, f, proxy.Forwarding{Name: f.Name, FromPort: f.FromPort, TLS: f.TLS})
+		case !want.Equal(f):
+			apply(ProxyChange{Name: f.Name, Port: f.FromPort, Action: "repaired", From: f.ToPorts, To: want.ToPorts}, f, want)
+		default:
+			proxyTargets.Store(f.FromPort, f)
+		}
+	}
+	for port, want := range desired {
+		if len(want.ToPorts) == 0 {
+			continue
+		}
+		found := slices.ContainsFunc(present, func(f proxy.Forwarding) bool {
+			return f.FromPort == port && f.Name == want.Name
+		})
+		if !found {
+			apply(ProxyChange{Name: want.Name, Port: port, Action: "created", To: want.ToPorts}, want, want)
+		}
+	}
+	if len(errs) > 0 {
+		return changes, errors.Join(errs...)
+	}
+	return changes, nil
+}
+
+// runReconcileLoop reconciles the proxy periodically until the server shuts down.
+func runReconcileLoop(stop <-chan bool) {
+	ticker := time.NewTicker(reconcilePeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			_, err := reconcileProxy()
+			if err != nil {
+				log.Printf("Failed to reconcile proxy: %s\n", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"github.com/glossd/yetis/common"
+	"github.com/glossd/yetis/proxy"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// fakeBackend keeps the forwardings in memory.
+type fakeBackend struct {
+	lock        sync.Mutex
+	forwardings map[int]proxy.Forwarding
+}
+
+func newFakeBackend(fs ...proxy.Forwarding) *fakeBackend {
+	b := &fakeBackend{forwardings: map[int]proxy.Forwarding{}}
+	for _, f := range fs {
+		b.forwardings[f.FromPort] = f
+	}
+	return b
+}
+
+func (*fakeBackend) Name() string { return "fake" }
+
+func (b *fakeBackend) SetPortForwarding(f proxy.Forwarding) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if len(f.ToPorts) == 0 {
+		delete(b.forwardings, f.FromPort)
+	} else {
+		b.forwardings[f.FromPort] = f
+	}
+	return nil
+}
+
+func (b *fakeBackend) List() ([]proxy.Forwarding, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	var res []proxy.Forwarding
+	for _, f := range b.forwardings {
+		res = append(res, f)
+	}
+	return res, nil
+}
+
+// get returns the forwarding of the port, ok is false if the port isn't forwarded.
+func (b *fakeBackend) get(port int) (proxy.Forwarding, bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	f, ok := b.forwardings[port]
+	return f, ok
+}
+
+// forwarding returns the forwarding of the port, empty if the port isn't forwarded.
+func (b *fakeBackend) forwarding(port int) proxy.Forwarding {
+	f, _ := b.get(port)
+	return f
+}
+
+// useProxyBackend swaps proxyBackend for the test, the pending syncs of the proxy finish with the previous one.
+func useProxyBackend(t *testing.T, b proxy.Backend) {
+	t.Helper()
+	flushProxySyncs()
+	prev := swapProxyBackend(b)
+	t.Cleanup(func() {
+		flushProxySyncs()
+		swapProxyBackend(prev)
+	})
+}
+
+func swapProxyBackend(b proxy.Backend) proxy.Backend {
+	proxyLock.Lock()
+	defer proxyLock.Unlock()
+	prev := proxyBackend
+	proxyBackend = b
+	return prev
+}
+
+func TestReconcileProxy(t *testing.T) {
+	backend := newFakeBackend(
+		proxy.Forwarding{Name: "orphan", FromPort: 1111, ToPorts: []int{4001}},
+		proxy.Forwarding{Name: "r", FromPort: 2222, ToPorts: []int{4002}},
+	)
+	useProxyBackend(t, backend)
+
+	spec := func(name string, port, proxyPort int) common.DeploymentSpec {
+		return common.DeploymentSpec{Name: name, Env: []common.EnvVar{{Name: yetisPortEnv, Value: strconv.Itoa(port)}}, Proxy: common.Proxies{{Port: proxyPort}}}
+	}
+	deploymentStore.Store("r", deployment{pid: 1, status: Running, spec: spec("r", 5001, 2222), instance: instance{name: "r"}})
+	deploymentStore.Store("s", deployment{pid: 2, status: Running, spec: spec("s", 5002, 3333), instance: instance{name: "s"}})
+	defer func() {
+		deploymentStore.Delete("r")
+		deploymentStore.Delete("s")
+		proxyTargets.Delete(2222)
+		proxyTargets.Delete(3333)
+	}()
+
+	changes, err := reconcileProxy()
+	assert(t, err, nil)
+	assert(t, len(changes), 3)
+	_, ok := backend.get(1111)
+	assert(t, ok, false)
+	assert(t, slices.Equal(backend.forwarding(2222).ToPorts, []int{5001}), true)
+	assert(t, slices.Equal(backend.forwarding(3333).ToPorts, []int{5002}), true)
+
+	changes, err = reconcileProxy()
+	assert(t, err, nil)
+	assert(t, len(changes), 0)
+
+	d, _ := getDeployment("s")
+	d.spec.Proxy[0].Expose = &common.Expose{Interface: "eth0"}
+	deploymentStore.Store("s", d)
+	changes, err = reconcileProxy()
+	assert(t, err, nil)
+	assert(t, len(changes), 1)
+	assert(t, changes[0].Action, "repaired")
+	assert(t, backend.forwarding(3333).Expose.Interface, "eth0")
+}
+
+// legacyBackend also has the forwardings of the older versions of Yetis.
+type legacyBackend struct {
+	*fakeBackend
+	legacy []proxy.Forwarding
+}
+
+func (b *legacyBackend) DeleteLegacy() ([]proxy.Forwarding, error) {
+	deleted := b.legacy
+	b.legacy = nil
+	return deleted, nil
+}
+
+func TestReconcileProxy_Legacy(t *testing.T) {
+	backend := &legacyBackend{fakeBackend: newFakeBackend(), legacy: []proxy.Forwarding{{FromPort: 1111, ToPorts: []int{4001}}}}
+	useProxyBackend(t, backend)
+
+	changes, err := reconcileProxy()
+	assert(t, err, nil)
+	assert(t, len(changes), 1)
+	assert(t, changes[0].Port, 1111)
+	assert(t, changes[0].Action, "deleted")
+	assert(t, len(backend.legacy), 0)
+	changes, err = reconcileProxy()
+	assert(t, err, nil)
+	assert(t, len(changes), 0)
+}
@@ -0,0 +1,335 @@
+package server
+
+import (
+	"cmp"
+	"errors"
+	"github.com/glossd/yetis/common"
+	"github.com/glossd/yetis/proxy"
+	"log"
+	"slices"
+	"strconv"
+	"sync"
+)
+
+// replicaName returns the name of the replica of the deployment.
+// The first replica keeps the name, the others are suffixed with the replica number, e.g. hello, hello.1, hello.2
+func replicaName(name string, replica int) string {
+	if replica == 0 {
+		return name
+	}
+	return name + "." + strconv.Itoa(replica)
+}
+
+// instanceName returns the name of the process running the replica.
+// RollingUpdate starts each generation next to the previous one, the generations after the first are suffixed with the number, e.g. hello@1, hello.1@1
+func instanceName(name string, replica, generation int) string {
+	if generation == 0 {
+		return replicaName(name, replica)
+	}
+	return replicaName(name, replica) + "@" + strconv.Itoa(generation)
+}
+
+// rootName returns the name the deployment was applied with.
+func rootName(d deployment) string {
+	return d.name
+}
+
+// getReplicas returns the replicas of the deployment sorted by the replica number.
+// During RollingUpdate the old and the new replica with the same number can both be present.
+func getReplicas(root string) []deployment {
+	var res []deployment
+	rangeDeployments(func(name string, d deployment) {
+		if rootName(d) == root {
+			res = append(res, d)
+		}
+	})
+	slices.SortFunc(res, func(a, b deployment) int {
+		return cmp.Or(cmp.Compare(a.replica, b.replica), cmp.Compare(a.spec.Name, b.spec.Name))
+	})
+	return res
+}
+
+// getInstance resolves the name of the deployment, of its replica or of the instance to the instance.
+// Out of the instances of the replica the latest generation wins, the deployment name resolves to the first replica.
+func getInstance(name string) (deployment, bool) {
+	if d, ok := getDeployment(name); ok && instanceName(d.name, d.replica, d.generation) == name {
+		return d, true
+	}
+	var latest deployment
+	var found bool
+	rangeDeployments(func(_ string, d deployment) {
+		if replicaName(d.name, d.replica) != name && (d.name != name || d.replica != 0) {
+			return
+		}
+		if !found || isLater(d, latest) {
+			latest = d
+			found = true
+		}
+	})
+	return latest, found
+}
+
+// isLater prefers the instances which aren't terminating, then the later generation.
+func isLater(d, than deployment) bool {
+	if (d.status == Terminating) != (than.status == Terminating) {
+		return than.status == Terminating
+	}
+	return d.generation > than.generation
+}
+
+// latestGeneration returns the highest generation of the replicas.
+func latestGeneration(replicas []deployment) int {
+	var gen int
+	for _, d := range replicas {
+		gen = max(gen, d.generation)
+	}
+	return gen
+}
+
+// getProxyOwner returns the root name of the deployment forwarding from the proxy port or previewing on it.
+func getProxyOwner(port int) (string, bool) {
+	var owner string
+	var found bool
+	deploymentStore.Range(func(name string, d deployment) bool {
+		if slices.Contains(d.proxyPorts(), port) || d.spec.Strategy.PreviewPort == port {
+			owner = rootName(d)
+			found = true
+			return false
+		}
+		return true
+	})
+	return owner, found
+}
+
+var proxyLock sync.Mutex
+
+// proxy port -> the applied forwarding.
+var proxyTargets = common.Map[int, proxy.Forwarding]{}
+
+// syncProxy points the proxy ports and the route of the deployment to its ready replicas. If none of them is ready, the ports aren't forwarded.
+// Without replicas the proxy ports are closed. All the ports are switched under one lock, so that they point at the same replicas.
+func syncProxy(name string, ports ...int) error {
+	proxyLock.Lock()
+	defer proxyLock.Unlock()
+	var errs []error
+	for _, port := range ports {
+		errs = append(errs, syncProxyPort(name, port))
+	}
+	errs = append(errs, syncRoute(name))
+	return errors.Join(errs...)
+}
+
+func syncProxyPort(name string, port int) error {
+	if port == 0 {
+		return nil
+	}
+	f := proxyForwarding(name, port)
+	applied, ok := proxyTargets.Load(port)
+	if ok && applied.Equal(f) {
+		return nil
+	}
+	err := setForwarding(applied, ok, f)
+	if err != nil {
+		return err
+	}
+	if len(f.ToPorts) == 0 {
+		proxyTargets.Delete(port)
+	} else {
+		proxyTargets.Store(port, f)
+	}
+	if f.Weights != nil {
+		log.Printf("Proxy port %d forwards to %v weighted %v\n", port, f.ToPorts, f.Weights)
+	} else {
+		log.Printf("Proxy port %d forwards to %v\n", port, f.ToPorts)
+	}
+	return nil
+}
+
+// proxyForwarding returns the forwarding the deployments of the proxy port need.
+func proxyForwarding(name string, port int) proxy.Forwarding {
+	f := proxy.Forwarding{Name: name, FromPort: port}
+	f.ToPorts, f.Weights = proxyTargetPorts(port)
+	p := latestProxy(port)
+	f.Protocol = string(p.Protocol)
+	if p.Expose != nil {
+		f.Expose = &proxy.Expose{Interface: p.Expose.Interface, Source: p.Expose.Source}
+	}
+	if p.TLS != nil {
+		f.TLS = &proxy.TLS{CertFile: p.TLS.CertFile, KeyFile: p.TLS.KeyFile}
+	}
+	return f
+}
+
+// backendOf returns the backend of the forwarding. Only the userspace proxy terminates TLS.
+func backendOf(f proxy.Forwarding) proxy.Backend {
+	if f.TLS != nil {
+		return proxy.Userspace
+	}
+	return proxyBackend
+}
+
+// setForwarding applies the forwarding by its backend. If the port moves to another backend, e.g. tls is added,
+// the previous forwarding is deleted first, otherwise its rules would keep taking the connections.
+func setForwarding(prev proxy.Forwarding, hasPrev bool, f proxy.Forwarding) error {
+	if hasPrev && backendOf(prev).Name() != backendOf(f).Name() {
+		err := backendOf(prev).SetPortForwarding(proxy.Forwarding{Name: prev.Name, FromPort: prev.FromPort, TLS: prev.TLS})
+		if err != nil {
+			return err
+		}
+	}
+	return backendOf(f).SetPortForwarding(f)
+}
+
+// listForwardings returns the forwardings of the backend and the TLS ones of the userspace proxy.
+func listForwardings() ([]proxy.Forwarding, error) {
+	res, err := proxyBackend.List()
+	if err != nil || proxyBackend.Name() == proxy.Userspace.Name() {
+		return res, err
+	}
+	return append(res, proxy.ListUserspaceForwarding()...), nil
+}
+
+// latestProxy returns the proxy config of the port, the latest applied spec wins during RollingUpdate.
+func latestProxy(port int) common.Proxy {
+	var latest *deployment
+	rangeDeployments(func(name string, d deployment) {
+		if _, ok := d.proxyOf(port); ok && d.status != Terminating && (latest == nil || d.createdAt.After(latest.createdAt)) {
+			latest = &d
+		}
+	})
+	if latest == nil {
+		return common.Proxy{Port: port}
+	}
+	p, _ := latest.proxyOf(port)
+	return p
+}
+
+// Selected on the start of the server.
+var proxyBackend = proxy.Iptables
+
+func selectProxyBackend(name common.ProxyBackend) proxy.Backend {
+	if b, ok := proxy.BackendByName(string(name)); ok {
+		return b
+	}
+	return proxy.DetectBackend()
+}
+
+// proxySync is the sync of the proxy of a deployment waiting for its worker, see syncProxyLater.
+type proxySync struct {
+	ports []int
+	dirty bool
+}
+
+var proxySyncLock sync.Mutex
+
+// Signaled under proxySyncLock when a worker exits.
+var proxySyncDone = sync.NewCond(&proxySyncLock)
+
+// root name -> the sync of its running worker
+var proxySyncs = map[string]*proxySync{}
+
+// Non-blocking. Called on every change of a deployment, the proxy is synced in case its readiness has changed.
+// The changes are coalesced, one worker per deployment syncs the ports of all the changes since its last sync.
+func syncProxyLater(d deployment) {
+	ports := d.proxyPorts()
+	if len(ports) == 0 && d.spec.Route == nil {
+		return
+	}
+	root := rootName(d)
+	proxySyncLock.Lock()
+	defer proxySyncLock.Unlock()
+	s, running := proxySyncs[root]
+	if !running {
+		s = &proxySync{}
+		proxySyncs[root] = s
+	}
+	for _, port := range ports {
+		if !slices.Contains(s.ports, port) {
+			s.ports = append(s.ports, port)
+		}
+	}
+	s.dirty = true
+	if !running {
+		go runProxySync(root, s)
+	}
+}
+
+// runProxySync syncs the proxy of the deployment until no change is left.
+func runProxySync(root string, s *proxySync) {
+	for {
+		proxySyncLock.Lock()
+		if !s.dirty {
+			delete(proxySyncs, root)
+			proxySyncDone.Broadcast()
+			proxySyncLock.Unlock()
+			return
+		}
+		ports := s.ports
+		s.ports, s.dirty = nil, false
+		proxySyncLock.Unlock()
+
+		err := syncProxy(root, ports...)
+		if err != nil {
+			log.Printf("Failed to update proxy ports %v: %s\n", ports, err)
+		}
+	}
+}
+
+// flushProxySyncs waits until the workers of syncProxyLater are done.
+func flushProxySyncs() {
+	proxySyncLock.Lock()
+	defer proxySyncLock.Unlock()
+	for len(proxySyncs) > 0 {
+		proxySyncDone.Wait()
+	}
+}
+
+// proxyTargetPorts returns the target ports of the proxy port, each replica is forwarded to on the port named by targetPort.
+// The weights are set while the canary of the deployment takes a share of the connections.
+func proxyTargetPorts(port int) ([]int, []int) {
+	var ready []deployment
+	rangeDeployments(func(name string, d deployment) {
+		if _, ok := d.proxyOf(port); !ok || d.pid == 0 || d.exited || d.status == Terminating || d.status == BackOff {
+			return
+		}
+		// without a ready replica the port isn't forwarded, the connections are refused rather than sent to an unhealthy one.
+		if d.isReady() {
+			ready = append(ready, d)
+		}
+	})
+	slices.SortFunc(ready, func(a, b deployment) int {
+		return cmp.Compare(a.spec.Name, b.spec.Name)
+	})
+	var ports []int
+	var targets []deployment
+	for _, d := range ready {
+		target, _ := d.proxyOf(port)
+		if p := d.spec.NamedPort(target.TargetPort); p > 0 && !slices.Contains(ports, p) {
+			ports = append(ports, p)
+			targets = append(targets, d)
+		}
+	}
+	if len(targets) == 0 {
+		return ports, nil
+	}
+	c, ok := canaries.Load(rootName(targets[0]))
+	if !ok {
+		return ports, nil
+	}
+	weights := canaryWeights(c, targets)
+	if weights == nil {
+		return ports, nil
+	}
+	// the share of one port can be rounded down to zero.
+	var weightedPorts, positive []int
+	for i, w := range weights {
+		if w > 0 {
+			weightedPorts = append(weightedPorts, ports[i])
+			positive = append(positive, w)
+		}
+	}
+	if len(weightedPorts) == 1 {
+		return weightedPorts, nil
+	}
+	return weightedPorts, positive
+}
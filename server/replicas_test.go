@@ -0,0 +1,175 @@
+package server
+
+import (
+	"context"
+	"github.com/glossd/fetch"
+	"github.com/glossd/yetis/common"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+func TestReplicas(t *testing.T) {
+	config := common.DeploymentSpec{Name: "replicas", Cmd: "sleep 10", Logdir: "stdout", Replicas: 3}
+	_, err := CreateOrRestartDeployment(fetch.Request[common.DeploymentSpec]{Context: context.Background(), Body: config})
+	assert(t, err, nil)
+	defer deleteReplicas(context.Background(), config.Name)
+
+	replicas := getReplicas(config.Name)
+	assert(t, len(replicas), 3)
+	var ports []int
+	for i, d := range replicas {
+		assert(t, d.replica, i)
+		assert(t, d.spec.Name, replicaName(config.Name, i))
+		assert(t, d.status, Running)
+		if slices.Contains(ports, d.spec.YetisPort()) {
+			t.Errorf("replicas must have different ports, got %d twice", d.spec.YetisPort())
+		}
+		ports = append(ports, d.spec.YetisPort())
+	}
+	assert(t, replicas[2].spec.Name, "replicas.2")
+
+	oldPid := replicas[1].pid
+	config.Replicas = 2
+	err = restartDeployment(context.Background(), config.Name, &config)
+	assert(t, err, nil)
+	replicas = getReplicas(config.Name)
+	assert(t, len(replicas), 2)
+	if replicas[1].pid == oldPid {
+		t.Errorf("replica wasn't restarted")
+	}
+
+	err = DeleteDeployment(fetch.Request[fetch.Empty]{Context: context.Background(), PathValues: map[string]string{"name": "replicas.1"}})
+	assert(t, err, nil)
+	assert(t, len(getReplicas(config.Name)), 0)
+}
+
+func TestInstanceName(t *testing.T) {
+	assert(t, instanceName("hello", 0, 0), "hello")
+	assert(t, instanceName("hello", 3, 0), "hello.3")
+	assert(t, instanceName("hello-2", 0, 1), "hello-2@1")
+	assert(t, instanceName("hello-2", 3, 12), "hello-2.3@12")
+}
+
+func TestGetInstance(t *testing.T) {
+	store := func(d deployment) {
+		d.spec.Name = instanceName(d.name, d.replica, d.generation)
+		deploymentStore.Store(d.spec.Name, d)
+	}
+	store(deployment{pid: 1, status: Terminating, instance: instance{name: "worker-2", generation: 1}})
+	store(deployment{pid: 2, status: Running, instance: instance{name: "worker-2", generation: 2}})
+	store(deployment{pid: 3, status: Running, instance: instance{name: "worker-2", replica: 1, generation: 2}})
+	defer func() {
+		deploymentStore.Delete("worker-2@1")
+		deploymentStore.Delete("worker-2@2")
+		deploymentStore.Delete("worker-2.1@2")
+	}()
+	get := func(name string) int {
+		t.Helper()
+		d, ok := getInstance(name)
+		assert(t, ok, true)
+		assert(t, rootName(d), "worker-2")
+		return d.pid
+	}
+	assert(t, get("worker-2"), 2)
+	assert(t, get("worker-2.1"), 3)
+	assert(t, get("worker-2@1"), 1)
+	assert(t, get("worker-2.1@2"), 3)
+	_, ok := getInstance("worker")
+	assert(t, ok, false)
+	assert(t, resolveRootName("worker-2.1"), "worker-2")
+}
+
+func TestProxyTargetPorts(t *testing.T) {
+	withPort := func(name string, port int) common.DeploymentSpec {
+		return common.DeploymentSpec{Name: name, Env: []common.EnvVar{{Name: yetisPortEnv, Value: strconv.Itoa(port)}}, Proxy: common.Proxies{{Port: 1234}}}
+	}
+	deploymentStore.Store("p", deployment{pid: 1, status: Pending, spec: withPort("p", 3001), instance: instance{name: "p"}})
+	deploymentStore.Store("p.1", deployment{pid: 2, status: Running, spec: withPort("p.1", 3002), instance: instance{name: "p", replica: 1}})
+	deploymentStore.Store("p.2", deployment{pid: 3, status: Running, spec: withPort("p.2", 3003), instance: instance{name: "p", replica: 2}})
+	defer func() {
+		deploymentStore.Delete("p")
+		deploymentStore.Delete("p.1")
+		deploymentStore.Delete("p.2")
+	}()
+	assert(t, slices.Equal(targetPorts(1234), []int{3002, 3003}), true)
+
+	d, _ := getDeployment("p.2")
+	d.status = Terminating
+	deploymentStore.Store("p.2", d)
+	assert(t, slices.Equal(targetPorts(1234), []int{3002}), true)
+
+	d, _ = getDeployment("p.1")
+	d.status = Failed
+	deploymentStore.Store("p.1", d)
+	// none is ready, nothing is forwarded.
+	assert(t, len(targetPorts(1234)), 0)
+}
+
+func TestSyncProxyLater(t *testing.T) {
+	backend := newFakeBackend()
+	useProxyBackend(t, backend)
+	proxyPort := common.MustGetFreePort()
+	spec := common.DeploymentSpec{Name: "later", Env: []common.EnvVar{{Name: yetisPortEnv, Value: "3005"}}, Proxy: common.Proxies{{Port: proxyPort}}}
+	d := deployment{pid: 1, status: Running, spec: spec, instance: instance{name: "later"}}
+	deploymentStore.Store("later", d)
+	defer func() {
+		deploymentStore.Delete("later")
+		assert(t, syncProxy("later", proxyPort), nil)
+	}()
+	// the changes are coalesced into the worker of the deployment.
+	for i := 0; i < 100; i++ {
+		syncProxyLater(d)
+	}
+	flushProxySyncs()
+	assert(t, len(proxySyncs), 0)
+	assert(t, slices.Equal(backend.forwarding(proxyPort).ToPorts, []int{3005}), true)
+}
+
+func targetPorts(port int) []int {
+	ports, _ := proxyTargetPorts(port)
+	return ports
+}
+
+func TestProxyTargetPorts_Named(t *testing.T) {
+	spec := common.DeploymentSpec{
+		Name:  "n",
+		Env:   []common.EnvVar{{Name: yetisPortEnv, Value: "3001"}, {Name: "YETIS_PORT_ADMIN", Value: "3002"}},
+		Ports: []common.Port{{Name: "admin"}},
+		Proxy: common.Proxies{{Port: 1234}, {Port: 1235, TargetPort: "admin"}},
+	}
+	deploymentStore.Store("n", deployment{pid: 1, status: Running, spec: spec, instance: instance{name: "n"}})
+	defer deploymentStore.Delete("n")
+	assert(t, slices.Equal(targetPorts(1234), []int{3001}), true)
+	assert(t, slices.Equal(targetPorts(1235), []int{3002}), true)
+	owner, ok := getProxyOwner(1235)
+	assert(t, ok, true)
+	assert(t, owner, "n")
+}
+
+func TestScaleDeployment(t *testing.T) {
+	config := common.DeploymentSpec{Name: "scale", Cmd: "sleep 10", Logdir: "stdout", Replicas: 2}
+	_, err := CreateOrRestartDeployment(fetch.Request[common.DeploymentSpec]{Context: context.Background(), Body: config})
+	assert(t, err, nil)
+	defer deleteReplicas(context.Background(), config.Name)
+	pids := []int{getReplicas(config.Name)[0].pid, getReplicas(config.Name)[1].pid}
+
+	err = scaleDeployment(context.Background(), config.Name, 4)
+	assert(t, err, nil)
+	replicas := getReplicas(config.Name)
+	assert(t, len(replicas), 4)
+	for i, d := range replicas {
+		assert(t, d.spec.Replicas, 4)
+		if i < 2 {
+			assert(t, d.pid, pids[i])
+		}
+	}
+	assert(t, replicas[3].spec.Name, "scale.3")
+
+	err = ScaleDeployment(fetch.Request[ScaleRequest]{Context: context.Background(), PathValues: map[string]string{"name": "scale"}, Body: ScaleRequest{Replicas: 1}})
+	assert(t, err, nil)
+	replicas = getReplicas(config.Name)
+	assert(t, len(replicas), 1)
+	assert(t, replicas[0].pid, pids[0])
+	assert(t, replicas[0].spec.Replicas, 1)
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/glossd/yetis/common/unix"
+	"log"
+	"time"
+)
+
+// restoreDeployments brings back up the deployments persisted by the previous run of Yetis.
+func restoreDeployments() {
+	records, err := loadPersistedDeployments()
+	if err != nil {
+		log.Printf("Failed to load persisted deployments: %s\n", err)
+		return
+	}
+	for _, rec := range records {
+		err := restoreDeploymentRecord(rec)
+		if err != nil {
+			log.Printf("Failed to restore deployment '%s': %s\n", rec.Spec.Name, err)
+		} else {
+			log.Printf("Restored deployment '%s'\n", rec.Spec.Name)
+		}
+	}
+}
+
+func restoreDeploymentRecord(rec deploymentRecord) error {
+	if rec.Exited {
+		// restartPolicy didn't restart it.
+		restoreDeployment(rec)
+		return nil
+	}
+	if rec.Kept && isSameProcess(rec.Pid, rec.PidStartTime) && isSameCmdline(rec.Pid, rec.PidCmdline) {
+		return adoptProcess(rec)
+	}
+	if isSameProcess(rec.Pid, rec.PidStartTime) {
+		// Yetis crashed, but the process survived in its own session.
+		// It's launched again to be supervised.
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		err := terminateProcess(ctx, rec.Pid)
+		if err != nil {
+			return fmt.Errorf("failed to terminate the process of the previous run, pid=%d: %s", rec.Pid, err)
+		}
+	}
+
+	restoreDeployment(rec)
+	oldSpec := rec.Spec
+	spec, err := setYetisPortEnv(oldSpec)
+	if err != nil {
+		deleteDeployment(oldSpec.Name)
+		return err
+	}
+	pid, logPath, err := launchProcess(spec, false)
+	if err != nil {
+		_ = updateDeployment(spec, 0, "", false)
+		setDeploymentExited(spec.Name, Failed)
+		return err
+	}
+	err = updateDeployment(spec, pid, logPath, false)
+	if err != nil {
+		return err
+	}
+	superviseProcess(spec.Name, pid)
+	startLivenessCheck(spec)
+	// The rules of the previous run could have survived, they are replaced.
+	d, _ := getDeployment(spec.Name)
+	err = syncProxy(rootName(d), d.proxyPorts()...)
+	if err != nil {
+		return fmt.Errorf("failed to restore proxy: %s", err)
+	}
+	return nil
+}
+
+// adoptProcess resumes supervising the process left running by 'shutdown --keep-processes'.
+// The proxy rule still points to its port.
+func adoptProcess(rec deploymentRecord) error {
+	restoreDeployment(rec)
+	err := updateDeployment(rec.Spec, rec.Pid, rec.LogPath, false)
+	if err != nil {
+		return err
+	}
+	if rec.Ready {
+		// the proxy isn't forwarded to the replicas which aren't ready.
+		updateDeploymentStatus(rec.Spec.Name, Running)
+		updateDeploymentReady(rec.Spec.Name, true)
+	}
+	superviseAdoptedProcess(rec.Spec.Name, rec.Pid, rec.PidStartTime)
+	startLivenessCheck(rec.Spec)
+	log.Printf("Adopted '%s' deployment, pid=%d\n", rec.Spec.Name, rec.Pid)
+	return nil
+}
+
+func isSameCmdline(pid int, cmdline string) bool {
+	actual, err := unix.ProcessCmdline(pid)
+	return err == nil && actual == cmdline
+}
+
+// isSameProcess checks the pid hasn't been reused by another process.
+func isSameProcess(pid int, startTime uint64) bool {
+	if pid == 0 || startTime == 0 {
+		return false
+	}
+	actual, err := unix.ProcessStartTime(pid)
+	return err == nil && actual == startTime
+}
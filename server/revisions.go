@@ -0,0 +1,209 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/glossd/fetch"
+	"github.com/glossd/yetis/common"
+	bolt "go.etcd.io/bbolt"
+	"log"
+	"reflect"
+	"time"
+)
+
+// Revision is the spec applied to the deployment.
+type Revision struct {
+	Number    int
+	CreatedAt time.Time
+	Spec      common.DeploymentSpec
+}
+
+// root name -> the revisions, the latest is the last.
+var revisions = common.Map[string, []Revision]{}
+
+// The number of the revisions kept per deployment, the oldest are dropped.
+const revisionHistoryLimit = 10
+
+// root name -> the spec of the BlueGreen or Canary rollout in progress, it becomes a revision once promoted.
+var pendingRevisions = common.Map[string, common.DeploymentSpec]{}
+
+var revisionsBucket = []byte("revisions")
+var pendingRevisionsBucket = []byte("pendingRevisions")
+
+func GetRevisions(r fetch.Request[fetch.Empty]) ([]Revision, error) {
+	name := r.PathValues["name"]
+	if name == "" {
+		return nil, fmt.Errorf("name can't be empty")
+	}
+	revs, ok := revisions.Load(resolveRootName(name))
+	if !ok {
+		return nil, fmt.Errorf("deployment '%s' doesn't have revisions", name)
+	}
+	return revs, nil
+}
+
+type UndoRequest struct {
+	// Zero for the previous revision.
+	ToRevision int
+}
+
+type UndoResponse struct {
+	// The revision the deployment was rolled back to.
+	Revision int
+}
+
+// UndoRollout restarts the deployment with the spec of the revision according to its strategy.
+func UndoRollout(r fetch.Request[UndoRequest]) (*UndoResponse, error) {
+	name := r.PathValues["name"]
+	if name == "" {
+		return nil, fmt.Errorf("name can't be empty")
+	}
+	root := resolveRootName(name)
+	rev, err := findRevision(root, r.Body.ToRevision)
+	if err != nil {
+		return nil, err
+	}
+	spec := rev.Spec
+	err = restartDeployment(r.Context, root, &spec)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Rolled back deployment '%s' to revision %d\n", root, rev.Number)
+	return &UndoResponse{Revision: rev.Number}, nil
+}
+
+func findRevision(root string, number int) (Revision, error) {
+	revs, ok := revisions.Load(root)
+	if !ok {
+		return Revision{}, fmt.Errorf("deployment '%s' doesn't have revisions", root)
+	}
+	if number == 0 {
+		if len(revs) < 2 {
+			return Revision{}, fmt.Errorf("deployment '%s' doesn't have a previous revision", root)
+		}
+		return revs[len(revs)-2], nil
+	}
+	for _, rev := range revs {
+		if rev.Number == number {
+			return rev, nil
+		}
+	}
+	return Revision{}, fmt.Errorf("revision %d of '%s' doesn't exist", number, root)
+}
+
+// recordRevision stores the applied spec as the next revision, the spec equal to the latest one isn't recorded.
+func recordRevision(spec common.DeploymentSpec) {
+	spec = spec.WithDefaults().(common.DeploymentSpec)
+	revs, _ := revisions.Load(spec.Name)
+	next := 1
+	if len(revs) > 0 {
+		latest := revs[len(revs)-1]
+		if reflect.DeepEqual(latest.Spec, spec) {
+			return
+		}
+		next = latest.Number + 1
+	}
+	revs = append(revs, Revision{Number: next, CreatedAt: time.Now(), Spec: spec})
+	if len(revs) > revisionHistoryLimit {
+		revs = revs[len(revs)-revisionHistoryLimit:]
+	}
+	// copy, the loaded slice can be read concurrently.
+	revisions.Store(spec.Name, append([]Revision(nil), revs...))
+	persistRevisions(spec.Name, revs)
+}
+
+func deleteRevisions(root string) {
+	if _, ok := revisions.LoadAndDelete(root); ok {
+		persistRevisions(root, nil)
+	}
+	dropRevision(root)
+}
+
+// holdRevision keeps the spec of the rollout waiting for the promotion, see commitRevision and dropRevision.
+func holdRevision(spec common.DeploymentSpec) {
+	pendingRevisions.Store(spec.Name, spec)
+	persistPendingRevision(spec.Name, &spec)
+}
+
+// commitRevision records the spec of the promoted rollout.
+func commitRevision(root string) {
+	if spec, ok := pendingRevisions.LoadAndDelete(root); ok {
+		persistPendingRevision(root, nil)
+		recordRevision(spec)
+	}
+}
+
+// dropRevision forgets the spec of the failed or aborted rollout, undo goes back to the revision before it.
+func dropRevision(root string) {
+	if _, ok := pendingRevisions.LoadAndDelete(root); ok {
+		persistPendingRevision(root, nil)
+	}
+}
+
+// persistRevisions saves the revisions of the deployment, nil deletes them.
+func persistRevisions(root string, revs []Revision) {
+	var value []byte
+	if revs != nil {
+		var err error
+		value, err = json.Marshal(revs)
+		if err != nil {
+			log.Printf("Failed to marshal revisions of '%s': %s\n", root, err)
+			return
+		}
+	}
+	persistRecord(revisionsBucket, root, value)
+}
+
+// persistPendingRevision saves the spec waiting for the promotion, nil deletes it.
+func persistPendingRevision(root string, spec *common.DeploymentSpec) {
+	var value []byte
+	if spec != nil {
+		var err error
+		value, err = json.Marshal(spec)
+		if err != nil {
+			log.Printf("Failed to marshal pending revision of '%s': %s\n", root, err)
+			return
+		}
+	}
+	persistRecord(pendingRevisionsBucket, root, value)
+}
+
+func restoreRevisions() {
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+	if db == nil {
+		return
+	}
+	// read the own writes
+	flushRecords(db)
+	err := db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(revisionsBucket).ForEach(func(k, v []byte) error {
+			var revs []Revision
+			err := json.Unmarshal(v, &revs)
+			if err != nil {
+				log.Printf("Skipping invalid revisions of '%s': %s\n", k, err)
+				return nil
+			}
+			revisions.Store(string(k), revs)
+			return nil
+		})
+	})
+	if err != nil {
+		log.Printf("Failed to load revisions: %s\n", err)
+	}
+	err = db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(pendingRevisionsBucket).ForEach(func(k, v []byte) error {
+			var spec common.DeploymentSpec
+			err := json.Unmarshal(v, &spec)
+			if err != nil {
+				log.Printf("Skipping invalid pending revision of '%s': %s\n", k, err)
+				return nil
+			}
+			pendingRevisions.Store(string(k), spec)
+			return nil
+		})
+	})
+	if err != nil {
+		log.Printf("Failed to load revisions: %s\n", err)
+	}
+}
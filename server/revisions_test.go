@@ -0,0 +1,106 @@
+package server
+
+import (
+	"context"
+	"github.com/glossd/fetch"
+	"github.com/glossd/yetis/common"
+	"testing"
+)
+
+func TestUndoRollout(t *testing.T) {
+	assert(t, openDB(t.TempDir()), nil)
+	defer closeDB()
+	config := common.DeploymentSpec{Name: "undo", Cmd: "sleep 10", Logdir: "stdout"}
+	_, err := CreateOrRestartDeployment(fetch.Request[common.DeploymentSpec]{Context: context.Background(), Body: config})
+	assert(t, err, nil)
+	defer deleteReplicas(context.Background(), config.Name)
+
+	config.Cmd = "sleep 20"
+	_, err = CreateOrRestartDeployment(fetch.Request[common.DeploymentSpec]{Context: context.Background(), Body: config})
+	assert(t, err, nil)
+	// the same spec isn't a new revision
+	assert(t, restartDeployment(context.Background(), config.Name, &config), nil)
+	revs, err := GetRevisions(fetch.Request[fetch.Empty]{PathValues: map[string]string{"name": "undo"}})
+	assert(t, err, nil)
+	assert(t, len(revs), 2)
+	assert(t, revs[1].Number, 2)
+	assert(t, revs[1].Spec.Cmd, "sleep 20")
+
+	res, err := UndoRollout(fetch.Request[UndoRequest]{Context: context.Background(), PathValues: map[string]string{"name": "undo"}})
+	assert(t, err, nil)
+	assert(t, res.Revision, 1)
+	d, _ := getInstance("undo")
+	assert(t, d.spec.Cmd, "sleep 10")
+	revs, _ = revisions.Load("undo")
+	assert(t, len(revs), 3)
+	assert(t, revs[2].Number, 3)
+
+	// survives the restart of Yetis
+	revisions.Delete("undo")
+	restoreRevisions()
+	_, err = findRevision("undo", 2)
+	assert(t, err, nil)
+	_, err = UndoRollout(fetch.Request[UndoRequest]{Context: context.Background(), PathValues: map[string]string{"name": "undo"}, Body: UndoRequest{ToRevision: 7}})
+	if err == nil {
+		t.Error("expected the missing revision to fail")
+	}
+
+	assert(t, deleteReplicas(context.Background(), "undo"), nil)
+	_, ok := revisions.Load("undo")
+	assert(t, ok, false)
+}
+
+func TestRecordRevision_Limit(t *testing.T) {
+	defer revisions.Delete("limit")
+	for i := 0; i < revisionHistoryLimit+2; i++ {
+		recordRevision(common.DeploymentSpec{Name: "limit", Cmd: "sleep", Replicas: i + 1})
+	}
+	revs, _ := revisions.Load("limit")
+	assert(t, len(revs), revisionHistoryLimit)
+	assert(t, revs[0].Number, 3)
+}
+
+func TestRevision_BlueGreenPromoted(t *testing.T) {
+	backend := newFakeBackend()
+	useProxyBackend(t, backend)
+	assert(t, openDB(t.TempDir()), nil)
+	defer closeDB()
+
+	config := common.DeploymentSpec{
+		Name:          "rbg",
+		Cmd:           "sleep 10",
+		Logdir:        "stdout",
+		Strategy:      common.DeploymentStrategy{Type: common.BlueGreen, PreviewPort: common.MustGetFreePort()},
+		Proxy:         common.Proxies{{Port: common.MustGetFreePort()}},
+		LivenessProbe: common.Probe{Exec: common.Exec{Command: "true"}, InitialDelaySeconds: 0.01, PeriodSeconds: 0.1},
+	}
+	_, err := CreateOrRestartDeployment(fetch.Request[common.DeploymentSpec]{Context: context.Background(), Body: config})
+	assert(t, err, nil)
+	defer deleteReplicas(context.Background(), config.Name)
+
+	// the aborted preview isn't a revision
+	config.Cmd = "sleep 20"
+	_, err = CreateOrRestartDeployment(fetch.Request[common.DeploymentSpec]{Context: context.Background(), Body: config})
+	assert(t, err, nil)
+	revs, _ := revisions.Load("rbg")
+	assert(t, len(revs), 1)
+	assert(t, abortDeployment(context.Background(), "rbg"), nil)
+	_, ok := pendingRevisions.Load("rbg")
+	assert(t, ok, false)
+
+	config.Cmd = "sleep 30"
+	_, err = CreateOrRestartDeployment(fetch.Request[common.DeploymentSpec]{Context: context.Background(), Body: config})
+	assert(t, err, nil)
+	// the pending one survives the restart of Yetis
+	pendingRevisions.Delete("rbg")
+	restoreRevisions()
+	assert(t, promoteDeployment(context.Background(), "rbg"), nil)
+	revs, _ = revisions.Load("rbg")
+	assert(t, len(revs), 2)
+	assert(t, revs[1].Spec.Cmd, "sleep 30")
+	ro, _ := rollouts.Load("rbg")
+	assert(t, ro.Revision, 2)
+	rev, err := findRevision("rbg", 0)
+	assert(t, err, nil)
+	assert(t, rev.Spec.Cmd, "sleep 10")
+}
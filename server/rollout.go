@@ -0,0 +1,218 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/glossd/fetch"
+	"github.com/glossd/yetis/common"
+	bolt "go.etcd.io/bbolt"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+type RolloutStatus string
+
+const (
+	RolloutProgressing RolloutStatus = "Progressing"
+	RolloutComplete    RolloutStatus = "Complete"
+	RolloutFailed      RolloutStatus = "Failed"
+	// BlueGreen waits for promote or abort.
+	RolloutPreview RolloutStatus = "Preview"
+	RolloutAborted RolloutStatus = "Aborted"
+)
+
+// Rollout is the last restart of the deployment.
+type Rollout struct {
+	Name   string
+	Status RolloutStatus
+	// The latest revision of the deployment, zero if it doesn't have revisions.
+	Revision int
+	// True if the failed rollout was rolled back to the previous spec.
+	RolledBack bool
+	Message    string
+	StartedAt  time.Time
+	// Zero while progressing.
+	FinishedAt time.Time
+	// The percentage of the connections the Canary rollout forwards to the new instances while progressing.
+	Weight int
+	// The instance which failed the rollout, captured before the rollback terminated it.
+	Failure *RolloutFailure
+}
+
+// RolloutFailure is the state of the failed instance at the moment of the rollback.
+type RolloutFailure struct {
+	Instance        string
+	Pid             int
+	Status          string
+	Restarts        int
+	ProbeOutput     string
+	LastTermination *Termination
+	// The end of the log file.
+	Logs string
+}
+
+// root name -> the last rollout, persisted so that the failure survives the restart of Yetis.
+var rollouts = common.Map[string, Rollout]{}
+
+var rolloutsBucket = []byte("rollouts")
+
+// The size of the log kept in the failure.
+const rolloutLogSize = 4096
+
+func GetRollout(r fetch.Request[fetch.Empty]) (*Rollout, error) {
+	name := r.PathValues["name"]
+	if name == "" {
+		return nil, fmt.Errorf("name can't be empty")
+	}
+	ro, ok := rollouts.Load(resolveRootName(name))
+	if !ok {
+		return nil, fmt.Errorf("deployment '%s' hasn't been restarted", name)
+	}
+	return &ro, nil
+}
+
+func startRollout(root string) {
+	ro := Rollout{Name: root, Status: RolloutProgressing, StartedAt: time.Now()}
+	if revs, ok := revisions.Load(root); ok {
+		ro.Revision = revs[len(revs)-1].Number
+	}
+	storeRollout(root, ro)
+}
+
+// finishRollout marks the rollout Complete or Failed with the error.
+func finishRollout(root string, err error, rolledBack bool) {
+	ro, _ := rollouts.Load(root)
+	ro.FinishedAt = time.Now()
+	ro.Status = RolloutComplete
+	// the revision of the rollout is recorded once it succeeds.
+	if revs, ok := revisions.Load(root); ok && err == nil {
+		ro.Revision = revs[len(revs)-1].Number
+	}
+	if err != nil {
+		ro.Status = RolloutFailed
+		ro.Message = err.Error()
+		ro.RolledBack = rolledBack
+	}
+	storeRollout(root, ro)
+}
+
+// previewRollout marks the BlueGreen rollout waiting for the promotion.
+func previewRollout(root string) {
+	ro, _ := rollouts.Load(root)
+	ro.Status = RolloutPreview
+	storeRollout(root, ro)
+}
+
+// canaryRollout records the weight of the canary.
+func canaryRollout(root string, weight int) {
+	ro, _ := rollouts.Load(root)
+	ro.Weight = weight
+	storeRollout(root, ro)
+}
+
+func abortRollout(root string) {
+	ro, _ := rollouts.Load(root)
+	ro.Status = RolloutAborted
+	ro.FinishedAt = time.Now()
+	storeRollout(root, ro)
+}
+
+func setRolloutFailure(root string, f RolloutFailure) {
+	ro, _ := rollouts.Load(root)
+	ro.Failure = &f
+	storeRollout(root, ro)
+}
+
+func storeRollout(root string, ro Rollout) {
+	ro.Name = root
+	rollouts.Store(root, ro)
+	persistRollout(root, &ro)
+}
+
+func deleteRollout(root string) {
+	if _, ok := rollouts.LoadAndDelete(root); ok {
+		persistRollout(root, nil)
+	}
+}
+
+// persistRollout saves the last rollout of the deployment, nil deletes it.
+func persistRollout(root string, ro *Rollout) {
+	var value []byte
+	if ro != nil {
+		var err error
+		value, err = json.Marshal(ro)
+		if err != nil {
+			log.Printf("Failed to marshal rollout of '%s': %s\n", root, err)
+			return
+		}
+	}
+	persistRecord(rolloutsBucket, root, value)
+}
+
+func restoreRollouts() {
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+	if db == nil {
+		return
+	}
+	// read the own writes
+	flushRecords(db)
+	err := db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(rolloutsBucket).ForEach(func(k, v []byte) error {
+			var ro Rollout
+			err := json.Unmarshal(v, &ro)
+			if err != nil {
+				log.Printf("Skipping invalid rollout of '%s': %s\n", k, err)
+				return nil
+			}
+			rollouts.Store(string(k), ro)
+			return nil
+		})
+	})
+	if err != nil {
+		log.Printf("Failed to load rollouts: %s\n", err)
+	}
+}
+
+// captureFailure records the state and the log of the instance before it's terminated.
+func captureFailure(d deployment) RolloutFailure {
+	f := RolloutFailure{
+		Instance:        d.spec.Name,
+		Pid:             d.pid,
+		Status:          d.status.String(),
+		Restarts:        d.restarts,
+		ProbeOutput:     d.probeOutput,
+		LastTermination: d.lastTermination,
+	}
+	logs, err := tailFile(d.logPath, rolloutLogSize)
+	if err != nil {
+		log.Printf("Failed to read the log of '%s': %s\n", d.spec.Name, err)
+	}
+	f.Logs = logs
+	return f
+}
+
+func tailFile(path string, size int64) (string, error) {
+	if path == "" {
+		return "", nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	if info.Size() > size {
+		_, err = f.Seek(-size, io.SeekEnd)
+		if err != nil {
+			return "", err
+		}
+	}
+	b, err := io.ReadAll(f)
+	return string(b), err
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/glossd/fetch"
+	"github.com/glossd/yetis/common"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRollout(t *testing.T) {
+	defer rollouts.Delete("web")
+	deploymentStore.Store("web@1", deployment{spec: common.DeploymentSpec{Name: "web@1"}, instance: instance{name: "web", generation: 1}})
+	defer deploymentStore.Delete("web@1")
+
+	_, err := GetRollout(fetch.Request[fetch.Empty]{PathValues: map[string]string{"name": "web@1"}})
+	if err == nil {
+		t.Fatal("expected no rollout before restart")
+	}
+
+	logPath := filepath.Join(t.TempDir(), "web-2.log")
+	err = os.WriteFile(logPath, []byte(strings.Repeat("x", rolloutLogSize)+"panic: boom"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	startRollout("web")
+	ro, err := GetRollout(fetch.Request[fetch.Empty]{PathValues: map[string]string{"name": "web@1"}})
+	assert(t, err, nil)
+	assert(t, ro.Status, RolloutProgressing)
+
+	setRolloutFailure("web", captureFailure(deployment{pid: 3, status: Failed, restarts: 2, logPath: logPath, spec: common.DeploymentSpec{Name: "web@2"}}))
+	finishRollout("web", fmt.Errorf("isn't healthy"), true)
+	ro, err = GetRollout(fetch.Request[fetch.Empty]{PathValues: map[string]string{"name": "web@1"}})
+	assert(t, err, nil)
+	assert(t, ro.Status, RolloutFailed)
+	assert(t, ro.RolledBack, true)
+	assert(t, ro.Failure.Instance, "web@2")
+	assert(t, ro.Failure.Restarts, 2)
+	assert(t, len(ro.Failure.Logs), rolloutLogSize)
+	assert(t, strings.HasSuffix(ro.Failure.Logs, "panic: boom"), true)
+
+	startRollout("web")
+	finishRollout("web", nil, false)
+	ro, _ = GetRollout(fetch.Request[fetch.Empty]{PathValues: map[string]string{"name": "web"}})
+	assert(t, ro.Status, RolloutComplete)
+	assert(t, ro.Failure == nil, true)
+}
+
+func TestRollingUpdate_RollbackOnFailure(t *testing.T) {
+	backend := newFakeBackend()
+	useProxyBackend(t, backend)
+	prevGrace := readyGracePeriod
+	readyGracePeriod = 500 * time.Millisecond
+	defer func() { readyGracePeriod = prevGrace }()
+
+	proxyPort := common.MustGetFreePort()
+	config := common.DeploymentSpec{
+		Name:          "rb",
+		Cmd:           "sleep 10",
+		Logdir:        t.TempDir(),
+		Strategy:      common.DeploymentStrategy{Type: common.RollingUpdate, RollbackOnFailure: true},
+		Proxy:         common.Proxies{{Port: proxyPort}},
+		LivenessProbe: common.Probe{Exec: common.Exec{Command: "true"}, InitialDelaySeconds: 0.01, PeriodSeconds: 0.1},
+	}
+	_, err := CreateOrRestartDeployment(fetch.Request[common.DeploymentSpec]{Context: context.Background(), Body: config})
+	assert(t, err, nil)
+	defer deleteReplicas(context.Background(), config.Name)
+	old, _ := getInstance("rb")
+	assert(t, waitReady(old.spec), nil)
+	assert(t, syncProxy("rb", proxyPort), nil)
+
+	config.Cmd = "sh -c 'echo broken; sleep 20'"
+	config.LivenessProbe.Exec.Command = "false"
+	_, err = CreateOrRestartDeployment(fetch.Request[common.DeploymentSpec]{Context: context.Background(), Body: config})
+	if err == nil {
+		t.Fatal("expected the unhealthy rollout to fail")
+	}
+	// the old instance is the only one and keeps the proxy
+	replicas := getReplicas("rb")
+	assert(t, len(replicas), 1)
+	assert(t, replicas[0].spec.Name, "rb")
+	assert(t, replicas[0].spec.Cmd, "sleep 10")
+	assert(t, slices.Equal(backend.forwarding(proxyPort).ToPorts, []int{old.spec.YetisPort()}), true)
+	ro, _ := rollouts.Load("rb")
+	assert(t, ro.Status, RolloutFailed)
+	assert(t, ro.RolledBack, true)
+	assert(t, ro.Failure.Instance, "rb@1")
+	assert(t, strings.Contains(ro.Failure.Logs, "broken"), true)
+	revs, _ := revisions.Load("rb")
+	assert(t, len(revs), 1)
+}
+
+func TestRestoreRollouts(t *testing.T) {
+	dir := t.TempDir()
+	assert(t, openDB(dir), nil)
+	defer closeDB()
+	defer deleteRollout("saved")
+
+	startRollout("saved")
+	setRolloutFailure("saved", RolloutFailure{Instance: "saved@1", Logs: "panic: boom"})
+	finishRollout("saved", fmt.Errorf("isn't healthy"), true)
+	// imitate the restart of Yetis
+	closeDB()
+	rollouts.Delete("saved")
+	assert(t, openDB(dir), nil)
+	restoreRollouts()
+	ro, ok := rollouts.Load("saved")
+	assert(t, ok, true)
+	assert(t, ro.Status, RolloutFailed)
+	assert(t, ro.RolledBack, true)
+	assert(t, ro.Failure.Logs, "panic: boom")
+}
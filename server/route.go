@@ -0,0 +1,139 @@
+package server
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"github.com/glossd/yetis/common"
+	"github.com/glossd/yetis/proxy"
+	"log"
+	"os"
+	"slices"
+	"strings"
+)
+
+// Nil if proxy.http.port isn't configured, the deployments with a route are rejected.
+var httpProxy *proxy.HttpProxy
+
+// Closed when the HTTP proxy stops.
+var httpAccessLog *os.File
+
+// deployment name -> the applied route.
+var appliedRoutes = common.Map[string, proxy.Route]{}
+
+// startHttpProxy listens on proxy.http.port of the server config.
+func startHttpProxy(c common.HttpProxyConfig) error {
+	var errorPage []byte
+	if c.ErrorPage != "" {
+		page, err := os.ReadFile(c.ErrorPage)
+		if err != nil {
+			return fmt.Errorf("failed to read error page: %s", err)
+		}
+		errorPage = page
+	}
+	accessLog, err := os.OpenFile(c.AccessLog, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open access log: %s", err)
+	}
+	p := proxy.NewHttpProxy(errorPage, accessLog)
+	err = p.Listen(c.Port)
+	if err != nil {
+		_ = accessLog.Close()
+		return err
+	}
+	httpProxy = p
+	httpAccessLog = accessLog
+	log.Printf("HTTP proxy listens on port %d, access log %s\n", c.Port, c.AccessLog)
+	return nil
+}
+
+// stopHttpProxy waits for the requests in flight until the context is done.
+func stopHttpProxy(ctx context.Context) {
+	proxyLock.Lock()
+	defer proxyLock.Unlock()
+	if httpProxy == nil {
+		return
+	}
+	if err := httpProxy.Shutdown(ctx); err != nil {
+		log.Printf("HTTP proxy forced to shutdown: %s\n", err)
+	}
+	httpProxy = nil
+	appliedRoutes = common.Map[string, proxy.Route]{}
+	if httpAccessLog != nil {
+		if err := httpAccessLog.Close(); err != nil {
+			log.Printf("Failed to close access log: %s\n", err)
+		}
+		httpAccessLog = nil
+	}
+}
+
+// syncRoute points the route of the deployment to its ready replicas, while none of them is ready the requests get the error page.
+// Without replicas the route is deleted. Must be called under proxyLock.
+func syncRoute(name string) error {
+	if httpProxy == nil {
+		return nil
+	}
+	r, ok := latestRoute(name)
+	if !ok {
+		if _, applied := appliedRoutes.LoadAndDelete(name); applied {
+			httpProxy.DeleteRoute(name)
+			log.Printf("Deleted route of '%s' deployment\n", name)
+		}
+		return nil
+	}
+	if applied, ok := appliedRoutes.Load(name); ok && applied.Equal(r) {
+		return nil
+	}
+	err := httpProxy.SetRoute(r)
+	if err != nil {
+		return err
+	}
+	appliedRoutes.Store(name, r)
+	log.Printf("Route %s%s routes to %v\n", r.Host, r.Path, r.ToPorts)
+	return nil
+}
+
+// latestRoute returns the route of the deployment with its ready replicas, the latest applied spec wins during RollingUpdate.
+func latestRoute(name string) (proxy.Route, bool) {
+	var latest *deployment
+	var ready []deployment
+	rangeDeployments(func(_ string, d deployment) {
+		if d.spec.Route == nil || rootName(d) != name || d.preview {
+			return
+		}
+		if d.status != Terminating && (latest == nil || d.createdAt.After(latest.createdAt)) {
+			latest = &d
+		}
+		if d.pid != 0 && !d.exited && d.status != Terminating && d.isReady() {
+			ready = append(ready, d)
+		}
+	})
+	if latest == nil {
+		return proxy.Route{}, false
+	}
+	slices.SortFunc(ready, func(a, b deployment) int {
+		return cmp.Compare(a.spec.Name, b.spec.Name)
+	})
+	r := proxy.Route{Name: name, Host: latest.spec.Route.Host, Path: latest.spec.Route.Path}
+	for _, d := range ready {
+		if p := d.spec.NamedPort(d.spec.Route.TargetPort); p > 0 && !slices.Contains(r.ToPorts, p) {
+			r.ToPorts = append(r.ToPorts, p)
+		}
+	}
+	return r, true
+}
+
+// getRouteOwner returns the root name of the deployment with the same host and path.
+func getRouteOwner(r common.Route) (string, bool) {
+	var owner string
+	var found bool
+	deploymentStore.Range(func(name string, d deployment) bool {
+		if d.spec.Route != nil && !d.preview && d.spec.Route.Path == r.Path && strings.EqualFold(d.spec.Route.Host, r.Host) {
+			owner = rootName(d)
+			found = true
+			return false
+		}
+		return true
+	})
+	return owner, found
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"context"
+	"github.com/glossd/fetch"
+	"github.com/glossd/yetis/common"
+	"github.com/glossd/yetis/proxy"
+	"io"
+	"slices"
+	"strconv"
+	"testing"
+)
+
+func TestSyncRoute(t *testing.T) {
+	httpProxy = proxy.NewHttpProxy(nil, io.Discard)
+	defer func() {
+		httpProxy = nil
+		appliedRoutes.Delete("web")
+	}()
+
+	spec := func(name string, port int) common.DeploymentSpec {
+		return common.DeploymentSpec{Name: name, Env: []common.EnvVar{{Name: yetisPortEnv, Value: strconv.Itoa(port)}}, Route: &common.Route{Host: "example.com", Path: "/"}}
+	}
+	deploymentStore.Store("web", deployment{pid: 1, status: Pending, spec: spec("web", 5001), instance: instance{name: "web"}})
+	defer deploymentStore.Delete("web")
+
+	assert(t, syncProxy("web"), nil)
+	routes := httpProxy.Routes()
+	assert(t, len(routes), 1)
+	// not ready yet, the requests get the error page.
+	assert(t, len(routes[0].ToPorts), 0)
+
+	d, _ := getDeployment("web")
+	d.status = Running
+	deploymentStore.Store("web", d)
+	deploymentStore.Store("web@1", deployment{pid: 2, status: Running, spec: spec("web@1", 5002), instance: instance{name: "web", generation: 1}})
+	defer deploymentStore.Delete("web@1")
+	assert(t, syncProxy("web"), nil)
+	assert(t, slices.Equal(httpProxy.Routes()[0].ToPorts, []int{5001, 5002}), true)
+
+	owner, ok := getRouteOwner(common.Route{Host: "EXAMPLE.com", Path: "/"})
+	assert(t, ok, true)
+	assert(t, owner, "web")
+
+	deploymentStore.Delete("web")
+	deploymentStore.Delete("web@1")
+	assert(t, syncProxy("web"), nil)
+	assert(t, len(httpProxy.Routes()), 0)
+}
+
+func TestCreateDeployment_RouteWithoutHttpProxy(t *testing.T) {
+	spec := common.DeploymentSpec{Name: "routed", Cmd: "sleep 10", Strategy: common.DeploymentStrategy{Type: common.RollingUpdate}, Route: &common.Route{Path: "/"}}
+	_, err := CreateOrRestartDeployment(fetch.Request[common.DeploymentSpec]{Context: context.Background(), Body: spec})
+	if err == nil {
+		_ = deleteReplicas(context.Background(), spec.Name)
+		t.Fatal("expected the route without the HTTP proxy to be rejected")
+	}
+}
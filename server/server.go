@@ -5,10 +5,14 @@ import (
 	"fmt"
 	"github.com/glossd/fetch"
 	"github.com/glossd/yetis/common"
+	"github.com/glossd/yetis/proxy"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"slices"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 )
@@ -23,11 +27,38 @@ var serverConfig = common.YetisConfig{}.WithDefaults()
 
 func Run(configPath string) {
 	log.SetFlags(log.LstdFlags | log.Lmicroseconds) // adds time to the log
+	keepProcesses.Store(false)
 
+	serverConfig = common.YetisConfig{}.WithDefaults()
 	if configPath != "" {
 		serverConfig = common.ReadServerConfig(configPath)
 	}
 
+	proxyBackend = selectProxyBackend(serverConfig.Proxy.Backend)
+	log.Printf("Proxy backend: %s\n", proxyBackend.Name())
+	if serverConfig.Proxy.Http.Port > 0 {
+		err := startHttpProxy(serverConfig.Proxy.Http)
+		if err != nil {
+			log.Printf("HTTP proxy won't route the requests: %s\n", err)
+		}
+	}
+
+	err := openDB(serverConfig.Datadir)
+	if err != nil {
+		log.Printf("Deployments won't be persisted: %s\n", err)
+	}
+	restoreDeployments()
+	restoreRevisions()
+	restoreRollouts()
+	resumePreviews()
+	resumeCanaries()
+	_, err = reconcileProxy()
+	if err != nil {
+		log.Printf("Failed to reconcile proxy: %s\n", err)
+	}
+	stopReconcile := make(chan bool)
+	go runReconcileLoop(stopReconcile)
+
 	mux := http.NewServeMux()
 
 	fetch.SetHandlerConfig(fetch.HandlerConfig{
@@ -36,21 +67,31 @@ func Run(configPath string) {
 		},
 	})
 	mux.HandleFunc("GET /info", fetch.ToHandlerFunc(Info))
+	mux.HandleFunc("POST /shutdown", fetch.ToHandlerFuncEmptyOut(Shutdown))
 
 	mux.HandleFunc("GET /deployments", fetch.ToHandlerFuncEmptyIn(ListDeployment))
 	mux.HandleFunc("GET /deployments/{name}", fetch.ToHandlerFunc(GetDeployment))
 	mux.HandleFunc("POST /deployments", fetch.ToHandlerFunc(CreateOrRestartDeployment))
 	mux.HandleFunc("DELETE /deployments/{name}", fetch.ToHandlerFuncEmptyOut(DeleteDeployment))
 	mux.HandleFunc("PUT /deployments/{name}/restart", fetch.ToHandlerFuncEmptyOut(RestartDeployment))
+	mux.HandleFunc("PUT /deployments/{name}/scale", fetch.ToHandlerFuncEmptyOut(ScaleDeployment))
+	mux.HandleFunc("GET /deployments/{name}/instances", fetch.ToHandlerFunc(GetInstances))
+	mux.HandleFunc("GET /deployments/{name}/rollout", fetch.ToHandlerFunc(GetRollout))
+	mux.HandleFunc("POST /deployments/{name}/promote", fetch.ToHandlerFuncEmptyOut(PromoteDeployment))
+	mux.HandleFunc("POST /deployments/{name}/abort", fetch.ToHandlerFuncEmptyOut(AbortDeployment))
+	mux.HandleFunc("GET /deployments/{name}/rollout/history", fetch.ToHandlerFunc(GetRevisions))
+	mux.HandleFunc("POST /deployments/{name}/rollout/undo", fetch.ToHandlerFunc(UndoRollout))
+
+	mux.HandleFunc("POST /proxy/reconcile", fetch.ToHandlerFunc(ReconcileProxy))
 
-	runWithGracefulShutDown(mux)
+	runWithGracefulShutDown(mux, stopReconcile)
 }
 
-var quit = make(chan os.Signal)
+var quit = make(chan os.Signal, 1)
 var finished = make(chan bool, 1)
 
 // https://github.com/gin-gonic/examples/blob/master/graceful-shutdown/graceful-shutdown/server.go
-func runWithGracefulShutDown(r *http.ServeMux) {
+func runWithGracefulShutDown(r *http.ServeMux, stopReconcile chan bool) {
 	srv := &http.Server{
 		Addr:    fmt.Sprintf(":%d", YetisServerPort),
 		Handler: r,
@@ -69,11 +110,22 @@ func runWithGracefulShutDown(r *http.ServeMux) {
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
 	log.Printf("Shutting down Yetis server %s...\n", common.YetisVersion)
-
-	deleteDeploymentsGracefully()
+	close(stopReconcile)
+
+	if keepProcesses.Load() {
+		keepDeployments()
+		closeDB()
+	} else {
+		// the records stay as they were, the next run of Yetis starts the deployments again.
+		closeDB()
+		stopDeploymentsGracefully()
+	}
+	// the proxy follows the last changes of the deployments before exiting.
+	flushProxySyncs()
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
+	stopHttpProxy(ctx)
 	if err := srv.Shutdown(ctx); err != nil {
 		log.Fatalf("Server forced to shutdown: %s", err)
 	}
@@ -87,30 +139,80 @@ func Stop() {
 	<-finished
 }
 
-func deleteDeploymentsGracefully() {
-	rangeDeployments(func(name string, p deployment) {
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		defer cancel()
-		err := DeleteDeployment(fetch.Request[fetch.Empty]{
-			Context:    ctx,
-			PathValues: map[string]string{"name": name},
+// If true, the shutdown leaves the processes running for the next run of Yetis to adopt them.
+var keepProcesses atomic.Bool
+
+type ShutdownRequest struct {
+	KeepProcesses bool
+}
+
+// Shutdown is non-blocking, the server shuts down after responding.
+func Shutdown(r fetch.Request[ShutdownRequest]) error {
+	if r.Body.KeepProcesses && proxyBackend.Name() == proxy.Userspace.Name() {
+		var ports []int
+		proxyTargets.Range(func(port int, _ proxy.Forwarding) bool {
+			ports = append(ports, port)
+			return true
 		})
-		if err == nil {
-			log.Println("Deleted deployment", name)
-		} else {
-			log.Printf("Failed to delete %s deployment: %s\n", name, err)
+		if len(ports) > 0 {
+			slices.Sort(ports)
+			return fmt.Errorf("the userspace proxy closes with Yetis, the kept processes would lose the connections of proxy ports %v, shutdown without --keep-processes", ports)
 		}
+	}
+	keepProcesses.Store(r.Body.KeepProcesses)
+	select {
+	case quit <- syscall.SIGTERM:
+	default:
+		// already shutting down
+	}
+	return nil
+}
+
+// keepDeployments stops supervising the deployments, but leaves their processes and proxy rules.
+func keepDeployments() {
+	rangeDeployments(func(name string, d deployment) {
+		deleteLivenessCheck(name)
+		persistKeptDeployment(d)
+		log.Printf("Kept deployment %s, pid=%d\n", name, d.pid)
 	})
 }
 
+// stopDeploymentsGracefully terminates the processes of the deployments in parallel, the database must be closed to keep their records.
+func stopDeploymentsGracefully() {
+	var names []string
+	rangeDeployments(func(name string, d deployment) {
+		// the steps must not abort or promote the canary being stopped, the revisions stay for the next run of Yetis.
+		deleteCanary(rootName(d))
+		names = append(names, name)
+	})
+	var wg sync.WaitGroup
+	for _, name := range names {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			err := deleteInstance(ctx, name)
+			if err == nil {
+				log.Println("Stopped deployment", name)
+			} else {
+				log.Printf("Failed to stop %s deployment: %s\n", name, err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
 type InfoResponse struct {
 	Version             string
 	NumberOfDeployments int
+	ProxyBackend        string
 }
 
 func Info(_ fetch.Empty) (*InfoResponse, error) {
 	return &InfoResponse{
 		Version:             common.YetisVersion,
 		NumberOfDeployments: deploymentsNum(),
+		ProxyBackend:        proxyBackend.Name(),
 	}, nil
 }
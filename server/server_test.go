@@ -0,0 +1,62 @@
+package server
+
+import (
+	"github.com/glossd/fetch"
+	"github.com/glossd/yetis/common"
+	"github.com/glossd/yetis/proxy"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestShutdown_KeepProcessesWithUserspace(t *testing.T) {
+	useProxyBackend(t, proxy.Userspace)
+	proxyTargets.Store(4321, proxy.Forwarding{Name: "kept", FromPort: 4321, ToPorts: []int{5001}})
+	defer proxyTargets.Delete(4321)
+
+	err := Shutdown(fetch.Request[ShutdownRequest]{Body: ShutdownRequest{KeepProcesses: true}})
+	if err == nil {
+		t.Fatal("expected the userspace proxy to reject keeping the processes")
+	}
+	assert(t, keepProcesses.Load(), false)
+}
+
+func TestStopDeploymentsGracefully_Parallel(t *testing.T) {
+	backend := newFakeBackend()
+	useProxyBackend(t, backend)
+
+	proxyPort := common.MustGetFreePort()
+	for i := 0; i < 3; i++ {
+		// the open connection keeps the replica draining for drainSeconds.
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		client, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		server, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer server.Close()
+		spec := common.DeploymentSpec{
+			Name:     replicaName("stop", i),
+			Env:      []common.EnvVar{{Name: yetisPortEnv, Value: strconv.Itoa(l.Addr().(*net.TCPAddr).Port)}},
+			Proxy:    common.Proxies{{Port: proxyPort}},
+			Strategy: common.DeploymentStrategy{DrainSeconds: 0.3},
+		}
+		deploymentStore.Store(spec.Name, deployment{status: Running, spec: spec, instance: instance{name: "stop", replica: i}})
+	}
+
+	start := time.Now()
+	stopDeploymentsGracefully()
+	if time.Since(start) > 650*time.Millisecond {
+		t.Errorf("expected the deployments to stop in parallel, took %s", time.Since(start))
+	}
+	assert(t, len(getReplicas("stop")), 0)
+}
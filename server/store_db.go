@@ -0,0 +1,311 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/glossd/yetis/common"
+	"github.com/glossd/yetis/common/unix"
+	bolt "go.etcd.io/bbolt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Nil until openDB is called, then the deployments are persisted.
+var db *bolt.DB
+
+// Read locked while db is used, closeDB waits for the writes in progress.
+var dbLock sync.RWMutex
+
+var deploymentsBucket = []byte("deployments")
+
+// deploymentRecord is the persisted state of a deployment.
+type deploymentRecord struct {
+	Spec common.DeploymentSpec
+	// Empty in the records of the older versions, see legacyRootName.
+	Name       string
+	Replica    int
+	Generation int
+	Preview    bool
+	Pid        int
+	// Identifies the process together with pid.
+	PidStartTime uint64
+	// Only recorded for kept processes.
+	PidCmdline string
+	// True if the process was left running by 'shutdown --keep-processes'.
+	Kept bool
+	// Only recorded for kept processes, the adopted ready one keeps the proxy until its probes fail.
+	Ready     bool
+	LogPath   string
+	Restarts  int
+	CreatedAt time.Time
+	// True if the process exited and wasn't restarted, then Status is Completed or Failed.
+	Exited bool
+	Status ProcessStatus
+}
+
+func openDB(dir string) error {
+	err := os.MkdirAll(dir, 0750)
+	if err != nil {
+		return fmt.Errorf("failed to create data dir: %s", err)
+	}
+	d, err := bolt.Open(filepath.Join(dir, "yetis.db"), 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return fmt.Errorf("failed to open database: %s", err)
+	}
+	err = d.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(deploymentsBucket)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(revisionsBucket)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(pendingRevisionsBucket)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(rolloutsBucket)
+		return err
+	})
+	if err != nil {
+		d.Close()
+		return fmt.Errorf("failed to create bucket: %s", err)
+	}
+	dbLock.Lock()
+	defer dbLock.Unlock()
+	db = d
+	stopWriting, writingDone = make(chan struct{}), make(chan struct{})
+	go writeRecords(d, stopWriting, writingDone)
+	return nil
+}
+
+// closeDB writes the queued records and closes the database, the later changes aren't persisted.
+func closeDB() {
+	dbLock.Lock()
+	defer dbLock.Unlock()
+	if db == nil {
+		return
+	}
+	close(stopWriting)
+	<-writingDone
+	err := db.Close()
+	if err != nil {
+		log.Printf("Failed to close database: %s\n", err)
+	}
+	db = nil
+}
+
+func persistDeployment(d deployment) {
+	putDeploymentRecord(newDeploymentRecord(d))
+}
+
+// persistKeptDeployment lets the next run of Yetis adopt the running process of the deployment.
+func persistKeptDeployment(d deployment) {
+	rec := newDeploymentRecord(d)
+	if d.pid != 0 {
+		// The shell could have executed into the command since the launch.
+		rec.PidCmdline, _ = unix.ProcessCmdline(d.pid)
+		rec.Kept = true
+		rec.Ready = d.isReady()
+	}
+	putDeploymentRecord(rec)
+}
+
+func newDeploymentRecord(d deployment) deploymentRecord {
+	rec := deploymentRecord{
+		Spec:       d.spec,
+		Name:       d.name,
+		Replica:    d.replica,
+		Generation: d.generation,
+		Preview:    d.preview,
+		Pid:        d.pid,
+		LogPath:    d.logPath,
+		Restarts:   d.restarts,
+		CreatedAt:  d.createdAt,
+		Exited:     d.exited,
+	}
+	if d.exited {
+		rec.Status = d.status
+	}
+	if d.pid != 0 {
+		rec.PidStartTime, _ = unix.ProcessStartTime(d.pid)
+	}
+	return rec
+}
+
+func putDeploymentRecord(rec deploymentRecord) {
+	value, err := json.Marshal(rec)
+	if err != nil {
+		log.Printf("Failed to marshal deployment '%s': %s\n", rec.Spec.Name, err)
+		return
+	}
+	persistRecord(deploymentsBucket, rec.Spec.Name, value)
+}
+
+func unpersistDeployment(name string) {
+	persistRecord(deploymentsBucket, name, nil)
+}
+
+// persistRecord queues the record of the bucket for writeRecords, nil value deletes it.
+func persistRecord(bucket []byte, name string, value []byte) {
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+	if db == nil {
+		return
+	}
+	queueRecord(recordKey{bucket: string(bucket), name: name}, value)
+}
+
+type recordKey struct {
+	bucket string
+	name   string
+}
+
+// The records are written in batches by writeRecords, the updates of the store don't wait for the disk under writeLock.
+var (
+	// the latest value of the record, nil deletes it.
+	queuedRecords = map[recordKey][]byte{}
+	queueLock     sync.Mutex
+	// Held while the batch is written, so that an older batch never overwrites a newer one.
+	flushLock     sync.Mutex
+	recordsQueued = make(chan struct{}, 1)
+	stopWriting   chan struct{}
+	writingDone   chan struct{}
+)
+
+func queueRecord(key recordKey, value []byte) {
+	queueLock.Lock()
+	queuedRecords[key] = value
+	queueLock.Unlock()
+	select {
+	case recordsQueued <- struct{}{}:
+	default:
+	}
+}
+
+// writeRecords writes the queued records until stop, then writes the rest.
+func writeRecords(d *bolt.DB, stop, done chan struct{}) {
+	defer close(done)
+	for {
+		select {
+		case <-recordsQueued:
+			flushRecords(d)
+		case <-stop:
+			flushRecords(d)
+			return
+		}
+	}
+}
+
+func flushRecords(d *bolt.DB) {
+	flushLock.Lock()
+	defer flushLock.Unlock()
+	queueLock.Lock()
+	batch := queuedRecords
+	queuedRecords = map[recordKey][]byte{}
+	queueLock.Unlock()
+	if len(batch) == 0 {
+		return
+	}
+	err := d.Update(func(tx *bolt.Tx) error {
+		for key, value := range batch {
+			b := tx.Bucket([]byte(key.bucket))
+			var err error
+			if value == nil {
+				err = b.Delete([]byte(key.name))
+			} else {
+				err = b.Put([]byte(key.name), value)
+			}
+			if err != nil {
+				return fmt.Errorf("%s '%s': %s", key.bucket, key.name, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("Failed to persist records: %s\n", err)
+	}
+}
+
+func loadPersistedDeployments() ([]deploymentRecord, error) {
+	dbLock.RLock()
+	defer dbLock.RUnlock()
+	if db == nil {
+		return nil, nil
+	}
+	// read the own writes
+	flushRecords(db)
+	var records []deploymentRecord
+	err := db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(deploymentsBucket).ForEach(func(k, v []byte) error {
+			var rec deploymentRecord
+			err := json.Unmarshal(v, &rec)
+			if err != nil {
+				log.Printf("Skipping invalid persisted deployment '%s': %s\n", k, err)
+				return nil
+			}
+			records = append(records, rec)
+			return nil
+		})
+	})
+	setLegacyRootNames(records)
+	return records, err
+}
+
+var legacyRollingUpdatePattern = regexp.MustCompile(`^(.+)-\d+$`)
+
+// setLegacyRootNames names the deployments of the records persisted by the older versions, see legacyRootName.
+func setLegacyRootNames(records []deploymentRecord) {
+	var names []string
+	for _, rec := range records {
+		if rec.Name == "" {
+			names = append(names, legacyInstanceName(rec))
+		}
+	}
+	for i, rec := range records {
+		if rec.Name != "" {
+			continue
+		}
+		records[i].Name = legacyRootName(rec, names)
+		if records[i].Name == legacyInstanceName(rec) && rec.Spec.Strategy.Type == common.RollingUpdate && legacyRollingUpdatePattern.MatchString(records[i].Name) {
+			log.Printf("Keeping the name of deployment '%s', no other record proves its suffix is the RollingUpdate generation\n", records[i].Name)
+		}
+	}
+}
+
+// legacyRootName returns the name of the deployment persisted by the older versions, which suffixed the RollingUpdate instances with -1, -2 and so on.
+// The suffix is only stripped if another of the names is the deployment or its other instance, the name itself can end with -N.
+func legacyRootName(rec deploymentRecord, names []string) string {
+	name := legacyInstanceName(rec)
+	if rec.Spec.Strategy.Type != common.RollingUpdate {
+		return name
+	}
+	m := legacyRollingUpdatePattern.FindStringSubmatch(name)
+	if m == nil {
+		return name
+	}
+	for _, other := range names {
+		if other == name {
+			continue
+		}
+		if o := legacyRollingUpdatePattern.FindStringSubmatch(other); other == m[1] || o != nil && o[1] == m[1] {
+			return m[1]
+		}
+	}
+	return name
+}
+
+// legacyInstanceName strips the replica suffix.
+func legacyInstanceName(rec deploymentRecord) string {
+	if rec.Replica > 0 {
+		return strings.TrimSuffix(rec.Spec.Name, "."+strconv.Itoa(rec.Replica))
+	}
+	return rec.Spec.Name
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"github.com/glossd/yetis/common"
+	"github.com/glossd/yetis/common/unix"
+	"testing"
+	"time"
+)
+
+func TestPersistDeployment(t *testing.T) {
+	assert(t, openDB(t.TempDir()), nil)
+	defer closeDB()
+
+	spec := common.DeploymentSpec{Name: "persist", Cmd: "sleep 10", Logdir: "stdout"}
+	saveDeployment(spec, false)
+	assert(t, updateDeployment(spec, 12345, "/tmp/persist-0.log", true), nil)
+	records, err := loadPersistedDeployments()
+	assert(t, err, nil)
+	assert(t, len(records), 1)
+	assert(t, records[0].Spec.Cmd, "sleep 10")
+	assert(t, records[0].Pid, 12345)
+	assert(t, records[0].LogPath, "/tmp/persist-0.log")
+	assert(t, records[0].Restarts, 1)
+
+	deleteDeployment(spec.Name)
+	records, err = loadPersistedDeployments()
+	assert(t, err, nil)
+	assert(t, len(records), 0)
+}
+
+func TestCloseDB_WhileWriting(t *testing.T) {
+	assert(t, openDB(t.TempDir()), nil)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			persistRollout("closing", &Rollout{Revision: i})
+			persistRevisions("closing", []Revision{{Number: i}})
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+	closeDB()
+	// the writes after closing are dropped.
+	time.Sleep(10 * time.Millisecond)
+	close(stop)
+	<-done
+}
+
+func TestRestoreDeployments(t *testing.T) {
+	dir := t.TempDir()
+	assert(t, openDB(dir), nil)
+	config := common.DeploymentSpec{Name: "restore", Cmd: "sleep 10", Logdir: "stdout"}
+	spec, err := startDeploymentWithEnv(config, false, true)
+	assert(t, err, nil)
+	old, _ := getDeployment(spec.Name)
+	assert(t, updateDeployment(spec, old.pid, old.logPath, true), nil)
+	// imitate Yetis crash
+	deploymentStore.Delete(spec.Name)
+	closeDB()
+
+	assert(t, openDB(dir), nil)
+	defer closeDB()
+	restoreDeployments()
+	defer deleteDeployment(spec.Name)
+	d, ok := getDeployment(spec.Name)
+	assert(t, ok, true)
+	assert(t, d.restarts, 1)
+	assert(t, d.createdAt.Equal(old.createdAt), true)
+	assert(t, d.spec.Cmd, "sleep 10")
+	if d.pid == 0 || d.pid == old.pid {
+		t.Fatal("expected the deployment to be launched again")
+	}
+	assert(t, d.status, Running)
+	// the process of the previous run is terminated
+	assert(t, unix.IsProcessAlive(old.pid), false)
+}
+
+func TestRestoreDeployments_AdoptKeptProcess(t *testing.T) {
+	dir := t.TempDir()
+	assert(t, openDB(dir), nil)
+	config := common.DeploymentSpec{Name: "adopt", Cmd: "sleep 10", Logdir: "stdout", LivenessProbe: common.Probe{Exec: common.Exec{Command: "true"}, InitialDelaySeconds: 60}}
+	spec, err := startDeploymentWithEnv(config, false, true)
+	assert(t, err, nil)
+	updateDeploymentStatus(spec.Name, Running)
+	old, _ := getDeployment(spec.Name)
+	persistKeptDeployment(old)
+	deploymentStore.Delete(spec.Name)
+	closeDB()
+
+	assert(t, openDB(dir), nil)
+	defer closeDB()
+	restoreDeployments()
+	defer func() {
+		d, _ := getDeployment(spec.Name)
+		deleteDeployment(spec.Name)
+		unix.TerminateProcessTimeout(d.pid, time.Second)
+	}()
+	d, ok := getDeployment(spec.Name)
+	assert(t, ok, true)
+	assert(t, d.pid, old.pid)
+	// ready before the first probe, the proxy stays on it
+	assert(t, d.status, Running)
+	assert(t, d.isReady(), true)
+	assert(t, unix.IsProcessAlive(old.pid), true)
+	records, err := loadPersistedDeployments()
+	assert(t, err, nil)
+	assert(t, records[0].Kept, false)
+}
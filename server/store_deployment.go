@@ -8,7 +8,7 @@ import (
 	"time"
 )
 
-// todo presist in sqlite
+// Persisted in the database, see store_db.go
 var deploymentStore = common.Map[string, deployment]{}
 
 type resource interface {
@@ -23,6 +23,67 @@ type deployment struct {
 	status    ProcessStatus
 	createdAt time.Time
 	spec      common.DeploymentSpec
+	instance
+	// The output of the last exec liveness probe.
+	probeOutput string
+	// True once startupProbe succeeded.
+	started bool
+	// Set by readinessProbe.
+	ready bool
+	// True if the process exited and wasn't restarted according to restartPolicy.
+	exited bool
+	// How the last process of the deployment exited.
+	lastTermination *Termination
+}
+
+// instance identifies the process of the deployment and its place in the rollout, see instanceName.
+type instance struct {
+	// The name the deployment was applied with.
+	name string
+	// The number of the replica, see replicaName.
+	replica int
+	// Incremented by each RollingUpdate, BlueGreen and Canary rollout.
+	generation int
+	// True while the BlueGreen instance waits for the promotion, until then only strategy.previewPort forwards to it.
+	preview bool
+}
+
+// proxyPorts returns the proxy ports forwarding to the instance.
+func (d deployment) proxyPorts() []int {
+	if d.preview {
+		return []int{d.spec.Strategy.PreviewPort}
+	}
+	return d.spec.ProxyPorts()
+}
+
+// proxyOf returns the proxy forwarding from the port to the instance.
+func (d deployment) proxyOf(port int) (common.Proxy, bool) {
+	if d.preview {
+		return d.spec.PreviewProxy(), port == d.spec.Strategy.PreviewPort
+	}
+	return d.spec.ProxyOf(port)
+}
+
+type Termination struct {
+	Pid int
+	// 128 + signal number if the process was killed by a signal.
+	ExitCode int
+	Signal   string
+	// Completed, Error, Signaled, OOMKilled or the reason Yetis terminated the process with.
+	Reason     string
+	OOMKilled  bool
+	FinishedAt time.Time
+}
+
+func (t Termination) String() string {
+	s := fmt.Sprintf("pid=%d, reason=%s, exit code=%d", t.Pid, t.Reason, t.ExitCode)
+	if t.Signal != "" {
+		s += ", signal=" + t.Signal
+	}
+	if t.OOMKilled {
+		s += ", OOM killed"
+	}
+	return s
 }
 
 func (d deployment) getPid() int {
@@ -33,6 +94,14 @@ func (d deployment) getPort() int {
 	return d.spec.LivenessProbe.Port()
 }
 
+// Without readinessProbe the deployment is ready when it's running.
+func (d deployment) isReady() bool {
+	if d.spec.ReadinessProbe == nil {
+		return d.status == Running
+	}
+	return d.ready
+}
+
 type ProcessStatus int
 
 const (
@@ -40,6 +109,10 @@ const (
 	Running
 	Failed
 	Terminating
+	// The process exited successfully and restartPolicy doesn't restart it.
+	Completed
+	// The process keeps exiting and waits before the next restart.
+	BackOff
 )
 
 var processStatusMap = map[ProcessStatus]string{
@@ -47,6 +120,8 @@ var processStatusMap = map[ProcessStatus]string{
 	Running:     "Running",
 	Failed:      "Failed",
 	Terminating: "Terminating",
+	Completed:   "Completed",
+	BackOff:     "BackOff",
 }
 
 func (pc ProcessStatus) String() string {
@@ -56,6 +131,10 @@ func (pc ProcessStatus) String() string {
 var writeLock sync.Mutex
 
 func saveDeployment(c common.DeploymentSpec, upsert bool) bool {
+	return saveReplica(c, instance{name: c.Name}, upsert)
+}
+
+func saveReplica(c common.DeploymentSpec, inst instance, upsert bool) bool {
 	writeLock.Lock()
 	defer writeLock.Unlock()
 	if !upsert {
@@ -64,10 +143,27 @@ func saveDeployment(c common.DeploymentSpec, upsert bool) bool {
 			return false
 		}
 	}
-	deploymentStore.Store(c.Name, deployment{createdAt: time.Now(), spec: c})
+	d := deployment{createdAt: time.Now(), spec: c, instance: inst}
+	deploymentStore.Store(c.Name, d)
+	persistDeployment(d)
 	return true
 }
 
+// restoreDeployment saves the persisted deployment without the process.
+func restoreDeployment(rec deploymentRecord) {
+	writeLock.Lock()
+	defer writeLock.Unlock()
+	deploymentStore.Store(rec.Spec.Name, deployment{
+		logPath:   rec.LogPath,
+		restarts:  rec.Restarts,
+		createdAt: rec.CreatedAt,
+		spec:      rec.Spec,
+		instance:  instance{name: rec.Name, replica: rec.Replica, generation: rec.Generation, preview: rec.Preview},
+		exited:    rec.Exited,
+		status:    rec.Status,
+	})
+}
+
 func updateDeployment(s common.DeploymentSpec, pid int, logPath string, incRestarts bool) error {
 	writeLock.Lock()
 	defer writeLock.Unlock()
@@ -77,11 +173,17 @@ func updateDeployment(s common.DeploymentSpec, pid int, logPath string, incResta
 	}
 	d.pid = pid
 	d.logPath = logPath
+	// the new process must pass the probes again
+	d.started = false
+	d.ready = false
+	d.exited = false
 	if incRestarts {
 		d.restarts++
 	}
 	d.spec = s
 	deploymentStore.Store(s.Name, d)
+	syncProxyLater(d)
+	persistDeployment(d)
 	return nil
 }
 
@@ -95,28 +197,113 @@ func updateDeploymentStatus(name string, status ProcessStatus) {
 	}
 	v.status = status
 	deploymentStore.Store(name, v)
+	syncProxyLater(v)
 }
 
-func getDeployment(name string) (deployment, bool) {
-	return deploymentStore.Load(name)
+// setDeploymentPreview takes the BlueGreen instance out of the preview or back, the caller syncs the proxy.
+func setDeploymentPreview(name string, preview bool) {
+	writeLock.Lock()
+	defer writeLock.Unlock()
+	v, ok := deploymentStore.Load(name)
+	if !ok {
+		return
+	}
+	v.preview = preview
+	deploymentStore.Store(name, v)
+	persistDeployment(v)
 }
 
-func getDeploymentByRootName(rootName string) (deployment, bool) {
-	var dep deployment
-	var found bool
-	dep, found = getDeployment(rootName)
-	if found {
-		return dep, found
+// markTerminating sets Terminating status if the deployment still runs the process with the pid.
+// Returns false if someone else is already terminating it.
+func markTerminating(name string, pid int) bool {
+	writeLock.Lock()
+	defer writeLock.Unlock()
+	v, ok := deploymentStore.Load(name)
+	if !ok || v.pid != pid || v.status == Terminating {
+		return false
 	}
-	deploymentStore.Range(func(name string, d deployment) bool {
-		if rootName == rootNameForRollingUpdate(name) {
-			found = true
-			dep = d
-			return false
-		}
-		return true
-	})
-	return dep, found
+	v.status = Terminating
+	deploymentStore.Store(name, v)
+	syncProxyLater(v)
+	return true
+}
+
+func setDeploymentTermination(name string, t Termination) {
+	writeLock.Lock()
+	defer writeLock.Unlock()
+	v, ok := deploymentStore.Load(name)
+	if !ok {
+		return
+	}
+	v.lastTermination = &t
+	deploymentStore.Store(name, v)
+}
+
+// setDeploymentExited marks the deployment as not restarted after the exit.
+func setDeploymentExited(name string, status ProcessStatus) {
+	writeLock.Lock()
+	defer writeLock.Unlock()
+	v, ok := deploymentStore.Load(name)
+	if !ok {
+		return
+	}
+	v.status = status
+	v.exited = true
+	v.ready = false
+	deploymentStore.Store(name, v)
+	syncProxyLater(v)
+	persistDeployment(v)
+}
+
+func setDeploymentStarted(name string) {
+	writeLock.Lock()
+	defer writeLock.Unlock()
+	v, ok := deploymentStore.Load(name)
+	if !ok {
+		return
+	}
+	v.started = true
+	deploymentStore.Store(name, v)
+}
+
+func updateDeploymentReady(name string, ready bool) {
+	writeLock.Lock()
+	defer writeLock.Unlock()
+	v, ok := deploymentStore.Load(name)
+	if !ok {
+		return
+	}
+	v.ready = ready
+	deploymentStore.Store(name, v)
+	syncProxyLater(v)
+}
+
+// updateDeploymentReplicas changes the number of replicas in the spec without restarting the process.
+func updateDeploymentReplicas(name string, replicas int) {
+	writeLock.Lock()
+	defer writeLock.Unlock()
+	v, ok := deploymentStore.Load(name)
+	if !ok {
+		return
+	}
+	v.spec.Replicas = replicas
+	deploymentStore.Store(name, v)
+	persistDeployment(v)
+}
+
+func updateDeploymentProbeOutput(name string, output string) {
+	writeLock.Lock()
+	defer writeLock.Unlock()
+	v, ok := deploymentStore.Load(name)
+	if !ok {
+		return
+	}
+	v.probeOutput = output
+	deploymentStore.Store(name, v)
+}
+
+func getDeployment(name string) (deployment, bool) {
+	return deploymentStore.Load(name)
 }
 
 func getDeploymentStatus(name string) (ProcessStatus, bool) {
@@ -128,7 +315,13 @@ func getDeploymentStatus(name string) (ProcessStatus, bool) {
 }
 
 func deleteDeployment(name string) {
-	deploymentStore.Delete(name)
+	writeLock.Lock()
+	defer writeLock.Unlock()
+	d, ok := deploymentStore.LoadAndDelete(name)
+	unpersistDeployment(name)
+	if ok {
+		syncProxyLater(d)
+	}
 }
 
 func rangeDeployments(f func(name string, p deployment)) {
@@ -0,0 +1,206 @@
+package server
+
+import (
+	"fmt"
+	"github.com/glossd/yetis/common"
+	"github.com/glossd/yetis/common/unix"
+	"log"
+	"os"
+	"syscall"
+	"time"
+)
+
+// name -> the number of exits in a row, each happened shortly after the start.
+var crashLoopMap = common.Map[string, int]{}
+
+const (
+	// If the process ran longer than this, its exit doesn't count as a crash loop.
+	crashLoopResetAfter = time.Minute
+	crashLoopBackOff    = 10 * time.Second
+	maxCrashLoopBackOff = 5 * time.Minute
+)
+
+// pid -> the reason Yetis terminates the process with.
+var terminationReasons = common.Map[int, string]{}
+
+// Non-blocking. Waits for the process launched by launchProcess to exit and
+// restarts it according to the restartPolicy.
+func superviseProcess(name string, pid int) {
+	cmd, ok := launchedCmds.LoadAndDelete(pid)
+	if !ok {
+		return
+	}
+	launchedAt := time.Now()
+	// the cgroup of the process itself, it's the one of Yetis unless the process moved to its own.
+	oomCounter, oomErr := unix.OOMKillCounter(pid)
+	var oomBefore int
+	if oomErr == nil {
+		oomBefore, oomErr = unix.OOMKillCount(oomCounter)
+	}
+	go func() {
+		_ = cmd.Wait()
+		if f, ok := cmd.Stdout.(*os.File); ok {
+			f.Close()
+		}
+		t := newTermination(pid, cmd.ProcessState)
+		if oomErr == nil && killedBySIGKILL(t) {
+			// The OOM killer sends SIGKILL. Yetis or the user could have sent it too,
+			// then the counter of the cgroup helps to tell them apart.
+			oomAfter, err := unix.OOMKillCount(oomCounter)
+			t.OOMKilled = err == nil && oomAfter > oomBefore
+		}
+		if t.OOMKilled {
+			t.Reason = "OOMKilled"
+		}
+		if reason, ok := terminationReasons.LoadAndDelete(pid); ok {
+			t.Reason = reason
+		}
+		onProcessExit(name, t, time.Since(launchedAt))
+	}()
+}
+
+// How often the adopted process is checked.
+var adoptedPollPeriod = time.Second
+
+// Non-blocking. The adopted process isn't a child of Yetis and can't be waited for,
+// then it's polled until it exits. The exit code is unknown.
+func superviseAdoptedProcess(name string, pid int, startTime uint64) {
+	adoptedAt := time.Now()
+	go func() {
+		for {
+			time.Sleep(adoptedPollPeriod)
+			d, ok := getDeployment(name)
+			if !ok || d.pid != pid {
+				// deleted or restarted
+				return
+			}
+			if !isSameProcess(pid, startTime) {
+				t := Termination{Pid: pid, ExitCode: -1, Reason: "Unknown", FinishedAt: time.Now()}
+				if reason, ok := terminationReasons.LoadAndDelete(pid); ok {
+					t.Reason = reason
+				}
+				onProcessExit(name, t, time.Since(adoptedAt))
+				return
+			}
+		}
+	}()
+}
+
+// killedBySIGKILL tells if the process or, with 'sh -c', the command of the shell was killed by SIGKILL.
+// The shell exits with 128+9 then instead of being signaled.
+func killedBySIGKILL(t Termination) bool {
+	return t.Signal == syscall.SIGKILL.String() || t.ExitCode == 128+int(syscall.SIGKILL)
+}
+
+func newTermination(pid int, state *os.ProcessState) Termination {
+	t := Termination{Pid: pid, FinishedAt: time.Now()}
+	if state == nil {
+		t.ExitCode = -1
+		t.Reason = "Unknown"
+		return t
+	}
+	t.ExitCode = state.ExitCode()
+	if ws, ok := state.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		// Shell convention
+		t.ExitCode = 128 + int(ws.Signal())
+		t.Signal = ws.Signal().String()
+	}
+	switch {
+	case t.Signal != "":
+		t.Reason = "Signaled"
+	case t.ExitCode == 0:
+		t.Reason = "Completed"
+	default:
+		t.Reason = "Error"
+	}
+	return t
+}
+
+func onProcessExit(name string, t Termination, lifetime time.Duration) {
+	pid := t.Pid
+	setDeploymentTermination(name, t)
+	// Terminated by Yetis or already restarted.
+	if !markTerminating(name, pid) {
+		return
+	}
+	d, ok := getDeployment(name)
+	if !ok {
+		return
+	}
+	code := t.ExitCode
+	log.Printf("'%s' deployment exited, %s\n", name, t)
+
+	policy := d.spec.RestartPolicy
+	if policy == common.Never || (policy == common.OnFailure && code == 0) {
+		if code == 0 {
+			setDeploymentExited(name, Completed)
+		} else {
+			setDeploymentExited(name, Failed)
+			AlertFail(name)
+		}
+		return
+	}
+
+	backOff := restartBackOff(name, lifetime)
+	if backOff > 0 {
+		log.Printf("'%s' deployment keeps exiting, restarting in %s\n", name, backOff)
+		updateDeploymentStatus(name, BackOff)
+		time.Sleep(backOff)
+		d, ok = getDeployment(name)
+		if !ok || d.pid != pid || d.status != BackOff {
+			// deleted or restarted in the meantime
+			return
+		}
+	}
+
+	_, err := relaunchDeployment(d)
+	if err != nil {
+		log.Printf("Failed to restart exited deployment '%s': %s\n", name, err)
+		setDeploymentExited(name, Failed)
+		AlertFail(name)
+	}
+}
+
+func restartBackOff(name string, lifetime time.Duration) time.Duration {
+	if lifetime > crashLoopResetAfter {
+		crashLoopMap.Delete(name)
+		return 0
+	}
+	n, _ := crashLoopMap.Load(name)
+	crashLoopMap.Store(name, n+1)
+	if n == 0 {
+		return 0
+	}
+	return min(crashLoopBackOff<<(n-1), maxCrashLoopBackOff)
+}
+
+// relaunchDeployment starts a new process of the deployment on a new $YETIS_PORT,
+// the store syncs the proxy with it. The old process must be terminated.
+func relaunchDeployment(p deployment) (common.DeploymentSpec, error) {
+	oldSpec := p.spec
+	updateDeploymentStatus(oldSpec.Name, Pending)
+
+	newSpec, err := setYetisPortEnv(oldSpec)
+	if err != nil {
+		return oldSpec, fmt.Errorf("failed to set port env: %s", err)
+	}
+
+	_ = updateDeployment(newSpec, 0, "", false)
+	pid, logPath, launchErr := launchProcess(newSpec, false)
+	_ = updateDeployment(newSpec, pid, logPath, true)
+	thresholdMap.Delete(newSpec.Name)
+	readinessThresholdMap.Delete(newSpec.Name)
+	if launchErr != nil {
+		return newSpec, launchErr
+	}
+	superviseProcess(newSpec.Name, pid)
+	if !hasHealthCheck(newSpec) {
+		updateDeploymentStatus(newSpec.Name, Running)
+	}
+	return newSpec, nil
+}
+
+// hasHealthCheck returns false if the deployment is only supervised by its exit.
+func hasHealthCheck(c common.DeploymentSpec) bool {
+	return c.LivenessProbe.IsSet() || c.StartupProbe != nil
+}
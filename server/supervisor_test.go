@@ -0,0 +1,106 @@
+package server
+
+import (
+	"github.com/glossd/yetis/common"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSupervise_RestartPolicyAlways(t *testing.T) {
+	config := common.DeploymentSpec{Name: "supervise", Cmd: "sleep 0.05", Logdir: "stdout"}
+	spec, err := startDeploymentWithEnv(config, false, true)
+	assert(t, err, nil)
+	defer deleteDeployment(config.Name)
+	defer crashLoopMap.Delete(config.Name)
+	startLivenessCheck(spec)
+	assertStatus(t, config.Name, Running, 0)
+
+	waitStatus(t, config.Name, Running, 1)
+	// the second exit in a row waits before the restart
+	waitStatus(t, config.Name, BackOff, 1)
+}
+
+func TestSupervise_RestartPolicyNever(t *testing.T) {
+	config := common.DeploymentSpec{Name: "supervise", Cmd: "sh -c 'exit 3'", Logdir: "stdout", RestartPolicy: common.Never}
+	_, err := startDeploymentWithEnv(config, false, true)
+	assert(t, err, nil)
+	defer deleteDeployment(config.Name)
+	waitStatus(t, config.Name, Failed, 0)
+	d, _ := getDeployment(config.Name)
+	assert(t, d.exited, true)
+	assert(t, d.lastTermination.ExitCode, 3)
+	assert(t, d.lastTermination.Reason, "Error")
+	assert(t, d.lastTermination.Signal, "")
+}
+
+func TestSupervise_RecordSignal(t *testing.T) {
+	config := common.DeploymentSpec{Name: "supervise", Cmd: "sleep 10", Logdir: "stdout", RestartPolicy: common.Never}
+	_, err := startDeploymentWithEnv(config, false, true)
+	assert(t, err, nil)
+	defer deleteDeployment(config.Name)
+	d, _ := getDeployment(config.Name)
+	assert(t, syscall.Kill(d.pid, syscall.SIGKILL), nil)
+	waitStatus(t, config.Name, Failed, 0)
+	d, _ = getDeployment(config.Name)
+	assert(t, d.lastTermination.Pid, d.pid)
+	assert(t, d.lastTermination.ExitCode, 137)
+	assert(t, d.lastTermination.Signal, "killed")
+	assert(t, d.lastTermination.Reason, "Signaled")
+	assert(t, d.lastTermination.OOMKilled, false)
+}
+
+func TestKilledBySIGKILL(t *testing.T) {
+	assert(t, killedBySIGKILL(Termination{ExitCode: 137, Signal: "killed"}), true)
+	// 'sh -c' exits with the code of the killed command
+	assert(t, killedBySIGKILL(Termination{ExitCode: 137}), true)
+	assert(t, killedBySIGKILL(Termination{ExitCode: 143, Signal: "terminated"}), false)
+	assert(t, killedBySIGKILL(Termination{ExitCode: 1}), false)
+}
+
+func TestSupervise_RestartPolicyOnFailure(t *testing.T) {
+	config := common.DeploymentSpec{Name: "supervise", Cmd: "true", Logdir: "stdout", RestartPolicy: common.OnFailure}
+	_, err := startDeploymentWithEnv(config, false, true)
+	assert(t, err, nil)
+	defer deleteDeployment(config.Name)
+	waitStatus(t, config.Name, Completed, 0)
+}
+
+func TestRestartBackOff(t *testing.T) {
+	defer crashLoopMap.Delete("backoff")
+	assert(t, restartBackOff("backoff", time.Second), 0)
+	assert(t, restartBackOff("backoff", time.Second), 10*time.Second)
+	assert(t, restartBackOff("backoff", time.Second), 20*time.Second)
+	assert(t, restartBackOff("backoff", 2*time.Minute), 0)
+	assert(t, restartBackOff("backoff", time.Second), 0)
+	for i := 0; i < 10; i++ {
+		restartBackOff("backoff", time.Second)
+	}
+	assert(t, restartBackOff("backoff", time.Second), 5*time.Minute)
+}
+
+func assertStatus(t *testing.T, name string, status ProcessStatus, restarts int) {
+	t.Helper()
+	d, ok := getDeployment(name)
+	assert(t, ok, true)
+	assert(t, d.status, status)
+	assert(t, d.restarts, restarts)
+}
+
+func waitStatus(t *testing.T, name string, status ProcessStatus, restarts int) {
+	t.Helper()
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case <-timeout:
+			assertStatus(t, name, status, restarts)
+			return
+		default:
+			d, ok := getDeployment(name)
+			if ok && d.status == status && d.restarts == restarts {
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+}